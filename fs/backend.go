@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// File is an open file of a storage backend.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Chmod(mode os.FileMode) error
+}
+
+// Backend stores the buckets, objects, uploads and configuration of tri as
+// files and directories addressed by path, with metadata attached to them.
+// It is shaped after a filesystem on purpose, so that the handlers keep the
+// on-disk layout of the posix backend whatever stores the data. Files of the
+// host that are not part of the storage, such as the master key file or the
+// directories a backend is opened on, are not accessed through it.
+type Backend interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	CreateTemp(dir, pattern string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Metadata() MetadataStore
+}
+
+var backend Backend = Posix{}
+
+// UseBackend selects the backend behind the file and metadata functions of
+// this package. It must not be called while files are in use.
+func UseBackend(b Backend) {
+	backend = b
+	store = b.Metadata()
+}
+
+// Posix stores files in the local filesystem and their metadata in Store,
+// extended attributes by default.
+type Posix struct {
+	Store MetadataStore
+}
+
+func (Posix) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (Posix) CreateTemp(dir, pattern string) (File, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (Posix) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (Posix) Lstat(name string) (os.FileInfo, error)       { return os.Lstat(name) }
+func (Posix) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (Posix) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (Posix) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (Posix) Remove(name string) error                     { return os.Remove(name) }
+func (Posix) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (Posix) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (Posix) Symlink(oldname, newname string) error        { return os.Symlink(oldname, newname) }
+func (Posix) Readlink(name string) (string, error)         { return os.Readlink(name) }
+
+func (Posix) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (p Posix) Metadata() MetadataStore {
+	if p.Store == nil {
+		return Xattrs{}
+	}
+	return p.Store
+}
+
+// backendError reports err of an operation on the file name as seen by the
+// callers of a backend, in place of the path it was stored at.
+func backendError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: pathCause(err)}
+}
+
+// pathCause returns the error behind a path or link error.
+func pathCause(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		err = linkErr.Err
+	}
+	return err
+}
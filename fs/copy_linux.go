@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneRange and copyFileRange are the system calls CopyFile tries before
+// falling back to a plain copy.
+var (
+	cloneRange    = unix.IoctlFileCloneRange
+	copyFileRange = unix.CopyFileRange
+)
+
+// CopyFile writes src into dst at offset, cloning extents where the filesystem supports reflinks.
+func CopyFile(dst File, src File, offset int64) (int64, error) {
+	dstFile, ok := dst.(*os.File)
+	srcFile, ok2 := src.(*os.File)
+	if !ok || !ok2 {
+		return copyFallback(dst, src, offset)
+	}
+	return copyExtents(dstFile, srcFile, offset)
+}
+
+func copyExtents(dst *os.File, src *os.File, offset int64) (int64, error) {
+	stat, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size()
+
+	clone := unix.FileCloneRange{
+		Src_fd:      int64(src.Fd()),
+		Src_offset:  0,
+		Src_length:  0,
+		Dest_offset: uint64(offset),
+	}
+	if size > 0 && cloneRange(int(dst.Fd()), &clone) == nil {
+		return size, nil
+	}
+
+	var roff int64
+	woff := offset
+	for roff < size {
+		n, err := copyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, int(size-roff), 0)
+		if err != nil {
+			if roff == 0 && isUnsupported(err) {
+				return copyFallback(dst, src, offset)
+			}
+			return roff, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if roff != size {
+		return roff, io.ErrUnexpectedEOF
+	}
+
+	return size, nil
+}
+
+func isUnsupported(err error) bool {
+	return errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
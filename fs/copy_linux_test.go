@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyFile(t *testing.T) {
+	clone, copyRange := cloneRange, copyFileRange
+	defer func() { cloneRange, copyFileRange = clone, copyRange }()
+	noClone := func(int, *unix.FileCloneRange) error { return unix.EOPNOTSUPP }
+	noCopyRange := func(int, *int64, int, *int64, int, int) (int, error) { return 0, unix.EXDEV }
+
+	parts := []string{"first part ", "", strings.Repeat("second part ", 10000), "last"}
+	for name, use := range map[string]func(){
+		"native":   func() { cloneRange, copyFileRange = clone, copyRange },
+		"range":    func() { cloneRange, copyFileRange = noClone, copyRange },
+		"fallback": func() { cloneRange, copyFileRange = noClone, noCopyRange },
+	} {
+		use()
+		dir := t.TempDir()
+		dst, err := os.Create(filepath.Join(dir, "dst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offset int64
+		for i, part := range parts {
+			src := filepath.Join(dir, string(rune('a'+i)))
+			if err := os.WriteFile(src, []byte(part), 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := CopyFile(dst, file, offset)
+			file.Close()
+			if err != nil || n != int64(len(part)) {
+				t.Fatalf("%s: copied %d of %d bytes: %v", name, n, len(part), err)
+			}
+			offset += n
+		}
+		dst.Close()
+
+		if data, err := os.ReadFile(dst.Name()); err != nil || !bytes.Equal(data, []byte(strings.Join(parts, ""))) {
+			t.Errorf("%s: copied data differs: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package fs
+
+func CopyFile(dst File, src File, offset int64) (int64, error) {
+	return copyFallback(dst, src, offset)
+}
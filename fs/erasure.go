@@ -0,0 +1,663 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErasureData is the directory of a disk holding the shards, below which
+// a metadata store keeps the metadata of the files.
+const ErasureData = "data"
+
+const (
+	erasureFormat = "tri.json"
+	erasureSpool  = "spool"
+)
+
+type erasureFormatFile struct {
+	Version int    `json:"version"`
+	Set     string `json:"set"`
+	Disk    int    `json:"disk"`
+	Disks   int    `json:"disks"`
+	Data    int    `json:"data"`
+	Parity  int    `json:"parity"`
+}
+
+// Erasure stores the files below root as Reed-Solomon data and parity shards,
+// one on each disk, so that files survive the loss of as many disks as there
+// are parity shards. Directories, symlinks and metadata are kept on every
+// disk. Paths outside root are passed to a Posix backend.
+type Erasure struct {
+	root    string
+	disks   []string
+	rs      *reedSolomon
+	store   MetadataStore
+	outside Backend
+
+	// writers are the files open for writing, whose data others must see
+	// as soon as they access the path, as on a POSIX filesystem.
+	mu      sync.Mutex
+	writers map[string]*erasureFile
+}
+
+// NewErasure returns the backend for root spread over disks, with parity of
+// them holding parity shards. The metadata of the shards is kept in store.
+// Disks are formatted on first use; an empty disk replacing a lost one is
+// formatted again and filled by Heal.
+func NewErasure(root string, disks []string, parity int, store MetadataStore) (*Erasure, error) {
+	if parity < 1 || parity >= len(disks) {
+		return nil, fmt.Errorf("parity must be between 1 and %d for %d disks", len(disks)-1, len(disks))
+	}
+	rs, err := newReedSolomon(len(disks)-parity, parity)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	e := &Erasure{root: root, rs: rs, store: store, outside: Posix{Store: store}, writers: map[string]*erasureFile{}}
+
+	formats := make([]*erasureFormatFile, len(disks))
+	set := ""
+	for i, disk := range disks {
+		if disk, err = filepath.Abs(disk); err != nil {
+			return nil, err
+		}
+		e.disks = append(e.disks, disk)
+		for _, dir := range []string{ErasureData, erasureSpool} {
+			if err := os.MkdirAll(filepath.Join(disk, dir), os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := os.ReadFile(filepath.Join(disk, erasureFormat))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		format := &erasureFormatFile{}
+		if err := json.Unmarshal(data, format); err != nil {
+			return nil, fmt.Errorf("%s: %w", disk, err)
+		}
+		switch {
+		case format.Disk != i:
+			return nil, fmt.Errorf("%s is disk %d of its set, not %d", disk, format.Disk+1, i+1)
+		case format.Disks != len(disks) || format.Parity != parity:
+			return nil, fmt.Errorf("%s belongs to a set of %d disks with %d parity", disk, format.Disks, format.Parity)
+		case len(set) > 0 && format.Set != set:
+			return nil, fmt.Errorf("%s belongs to another set", disk)
+		}
+		set = format.Set
+		formats[i] = format
+	}
+
+	if len(set) == 0 {
+		set = randomHex(16)
+	}
+	for i, format := range formats {
+		if format != nil {
+			continue
+		}
+		data, _ := json.Marshal(erasureFormatFile{Version: 1, Set: set, Disk: i, Disks: len(disks), Data: rs.data, Parity: parity})
+		if err := os.WriteFile(filepath.Join(e.disks[i], erasureFormat), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rel returns the path of name relative to the root, if it is below it.
+func (e *Erasure) rel(name string) (string, bool) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	if abs == e.root {
+		return ".", true
+	}
+	rel, found := strings.CutPrefix(abs, e.root+string(filepath.Separator))
+	return rel, found
+}
+
+func (e *Erasure) disk(i int, rel string) string {
+	return filepath.Join(e.disks[i], ErasureData, rel)
+}
+
+func (e *Erasure) quorum() int {
+	return e.rs.data
+}
+
+// each applies f to the path of rel on every disk. It fails when fewer disks
+// than needed to read the data back succeed; a missing path counts as success
+// with allowMissing, unless it is missing everywhere.
+func (e *Erasure) each(op, name, rel string, allowMissing bool, f func(i int, path string) error) error {
+	ok, missing := 0, 0
+	var first error
+	for i := range e.disks {
+		err := f(i, e.disk(i, rel))
+		switch {
+		case err == nil:
+			ok++
+		case allowMissing && os.IsNotExist(err):
+			missing++
+		case first == nil:
+			first = err
+		}
+	}
+	if missing == len(e.disks) {
+		return backendError(op, name, unix.ENOENT)
+	}
+	if ok > 0 && ok+missing >= e.quorum() {
+		return nil
+	}
+	if first == nil {
+		first = unix.EIO
+	}
+	return backendError(op, name, first)
+}
+
+// flush encodes the data written to rel by a file still open.
+func (e *Erasure) flush(rel string) error {
+	e.mu.Lock()
+	f := e.writers[rel]
+	e.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dirty && f.rel == rel {
+		return f.commit()
+	}
+	return nil
+}
+
+// moveWriters makes the files open for writing below oldrel follow it to
+// newrel, or detaches them from the path when newrel is empty.
+func (e *Erasure) moveWriters(oldrel, newrel string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for rel, f := range e.writers {
+		suffix, found := strings.CutPrefix(rel, oldrel)
+		if !found || (len(suffix) > 0 && suffix[0] != filepath.Separator) {
+			continue
+		}
+		delete(e.writers, rel)
+		f.mu.Lock()
+		if len(newrel) == 0 {
+			f.rel = ""
+		} else {
+			f.rel = newrel + suffix
+			e.writers[f.rel] = f
+		}
+		f.mu.Unlock()
+	}
+}
+
+// lstat returns the information of the first disk holding rel, with the
+// size of the data for files.
+func (e *Erasure) lstat(name, rel string) (os.FileInfo, error) {
+	if err := e.flush(rel); err != nil {
+		return nil, err
+	}
+	var first error
+	for i := range e.disks {
+		info, err := os.Lstat(e.disk(i, rel))
+		if err != nil {
+			if first == nil || os.IsNotExist(first) {
+				first = err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			return erasureInfo{info, filepath.Base(name), info.Size()}, nil
+		}
+		header, err := readShardHeader(e.disk(i, rel))
+		if err != nil || !e.validHeader(header, i) {
+			first = unix.EIO
+			continue
+		}
+		return erasureInfo{info, filepath.Base(name), int64(header.size)}, nil
+	}
+	return nil, backendError("lstat", name, first)
+}
+
+// resolve returns the path a final symlink at name points to.
+func (e *Erasure) resolve(name string, rel string) (string, bool, error) {
+	info, err := e.lstat(name, rel)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return name, false, err
+	}
+	target, err := e.Readlink(name)
+	if err != nil {
+		return "", false, err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(name), target)
+	}
+	return target, true, nil
+}
+
+func (e *Erasure) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.OpenFile(name, flag, perm)
+	}
+
+	info, err := e.lstat(name, rel)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, backendError("open", name, unix.EEXIST)
+	case err == nil && info.Mode()&os.ModeSymlink != 0:
+		target, _, err := e.resolve(name, rel)
+		if err != nil {
+			return nil, err
+		}
+		return e.openFollowed(target, flag, perm)
+	case err == nil && info.IsDir():
+		return nil, backendError("open", name, unix.EISDIR)
+	case os.IsNotExist(err) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		reader, err := e.openShards(name, rel)
+		if err != nil {
+			return nil, err
+		}
+		return &erasureFile{e: e, name: name, rel: rel, flag: flag, reader: reader}, nil
+	}
+
+	spool, err := e.createSpool()
+	if err != nil {
+		return nil, backendError("open", name, err)
+	}
+	file := &erasureFile{e: e, name: name, rel: rel, flag: flag, perm: perm, spool: spool}
+	defer func() {
+		if file != nil {
+			e.mu.Lock()
+			e.writers[rel] = file
+			e.mu.Unlock()
+		}
+	}()
+	switch {
+	case !exists:
+		if err := file.commit(); err != nil {
+			spool.Close()
+			file = nil
+			return nil, err
+		}
+	case flag&os.O_TRUNC != 0:
+		file.dirty = true
+	default:
+		if err := file.load(); err != nil {
+			spool.Close()
+			file = nil
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (e *Erasure) openFollowed(name string, flag int, perm os.FileMode) (File, error) {
+	if _, inside := e.rel(name); inside {
+		return e.OpenFile(name, flag&^(os.O_CREATE|os.O_EXCL), perm)
+	}
+	return e.outside.OpenFile(name, flag, perm)
+}
+
+// createSpool creates the unlinked file holding the data of a file open for
+// writing until it is encoded into shards.
+func (e *Erasure) createSpool() (*os.File, error) {
+	var first error
+	for _, disk := range e.disks {
+		spool, err := os.CreateTemp(filepath.Join(disk, erasureSpool), "spool-*")
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		os.Remove(spool.Name())
+		return spool, nil
+	}
+	return nil, first
+}
+
+func (e *Erasure) CreateTemp(dir, pattern string) (File, error) {
+	if _, inside := e.rel(dir); !inside {
+		return e.outside.CreateTemp(dir, pattern)
+	}
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(time.Now().UnixNano()), 36)+randomHex(4)+suffix)
+		file, err := e.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+}
+
+func (e *Erasure) Stat(name string) (os.FileInfo, error) {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.Stat(name)
+	}
+	target, followed, err := e.resolve(name, rel)
+	if err != nil {
+		return nil, backendError("stat", name, err)
+	}
+	if followed {
+		info, err := e.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		return erasureInfo{info, filepath.Base(name), info.Size()}, nil
+	}
+	return e.lstat(name, rel)
+}
+
+func (e *Erasure) Lstat(name string) (os.FileInfo, error) {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.Lstat(name)
+	}
+	return e.lstat(name, rel)
+}
+
+// ReadDir returns the union of the entries of the directory on all disks.
+func (e *Erasure) ReadDir(name string) ([]os.DirEntry, error) {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.ReadDir(name)
+	}
+
+	found := false
+	var first error
+	types := map[string]os.FileMode{}
+	for i := range e.disks {
+		entries, err := os.ReadDir(e.disk(i, rel))
+		if err != nil {
+			if first == nil || os.IsNotExist(first) {
+				first = err
+			}
+			continue
+		}
+		found = true
+		for _, entry := range entries {
+			if _, ok := types[entry.Name()]; !ok {
+				types[entry.Name()] = entry.Type()
+			}
+		}
+	}
+	if !found {
+		return nil, backendError("readdir", name, first)
+	}
+
+	entries := []os.DirEntry{}
+	for base, typ := range types {
+		entries = append(entries, erasureEntry{e: e, name: filepath.Join(name, base), rel: filepath.Join(rel, base), typ: typ})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (e *Erasure) Mkdir(name string, perm os.FileMode) error {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.Mkdir(name, perm)
+	}
+	return e.each("mkdir", name, rel, false, func(_ int, path string) error {
+		return os.Mkdir(path, perm)
+	})
+}
+
+func (e *Erasure) MkdirAll(path string, perm os.FileMode) error {
+	rel, inside := e.rel(path)
+	if !inside {
+		return e.outside.MkdirAll(path, perm)
+	}
+	return e.each("mkdir", path, rel, false, func(_ int, path string) error {
+		return os.MkdirAll(path, perm)
+	})
+}
+
+func (e *Erasure) Remove(name string) error {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.Remove(name)
+	}
+	e.moveWriters(rel, "")
+	return e.each("remove", name, rel, true, func(_ int, path string) error {
+		return os.Remove(path)
+	})
+}
+
+func (e *Erasure) RemoveAll(path string) error {
+	rel, inside := e.rel(path)
+	if !inside {
+		return e.outside.RemoveAll(path)
+	}
+	e.moveWriters(rel, "")
+	return e.each("remove", path, rel, true, func(_ int, path string) error {
+		return os.RemoveAll(path)
+	})
+}
+
+func (e *Erasure) Rename(oldpath, newpath string) error {
+	oldrel, oldinside := e.rel(oldpath)
+	newrel, newinside := e.rel(newpath)
+	switch {
+	case !oldinside && !newinside:
+		return e.outside.Rename(oldpath, newpath)
+	case oldinside != newinside:
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: unix.EXDEV}
+	}
+	if err := e.flush(oldrel); err != nil {
+		return err
+	}
+	err := e.each("rename", oldpath, oldrel, false, func(i int, path string) error {
+		if _, err := os.Lstat(path); err != nil {
+			return err
+		}
+		return os.Rename(path, e.disk(i, newrel))
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err.(*os.PathError).Err}
+	}
+	e.moveWriters(newrel, "")
+	e.moveWriters(oldrel, newrel)
+	return nil
+}
+
+func (e *Erasure) Symlink(oldname, newname string) error {
+	rel, inside := e.rel(newname)
+	if !inside {
+		return e.outside.Symlink(oldname, newname)
+	}
+	err := e.each("symlink", newname, rel, false, func(_ int, path string) error {
+		return os.Symlink(oldname, path)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err.(*os.PathError).Err}
+	}
+	return nil
+}
+
+func (e *Erasure) Readlink(name string) (string, error) {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.Readlink(name)
+	}
+	var first error
+	for i := range e.disks {
+		target, err := os.Readlink(e.disk(i, rel))
+		if err == nil {
+			return target, nil
+		}
+		if first == nil || os.IsNotExist(first) {
+			first = err
+		}
+	}
+	return "", backendError("readlink", name, first)
+}
+
+func (e *Erasure) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	rel, inside := e.rel(name)
+	if !inside {
+		return e.outside.Chtimes(name, atime, mtime)
+	}
+	return e.each("chtimes", name, rel, false, func(_ int, path string) error {
+		return os.Chtimes(path, atime, mtime)
+	})
+}
+
+// Metadata returns a store keeping the metadata of files below the root on
+// every disk holding them.
+func (e *Erasure) Metadata() MetadataStore {
+	return erasureMetadata{e}
+}
+
+type erasureInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i erasureInfo) Name() string { return i.name }
+func (i erasureInfo) Size() int64  { return i.size }
+
+// erasureEntry is a directory entry whose information is read on demand, as
+// the size of a file is kept in its shards.
+type erasureEntry struct {
+	e    *Erasure
+	name string
+	rel  string
+	typ  os.FileMode
+}
+
+func (d erasureEntry) Name() string               { return filepath.Base(d.name) }
+func (d erasureEntry) IsDir() bool                { return d.typ.IsDir() }
+func (d erasureEntry) Type() os.FileMode          { return d.typ }
+func (d erasureEntry) Info() (os.FileInfo, error) { return d.e.lstat(d.name, d.rel) }
+
+type erasureMetadata struct {
+	e *Erasure
+}
+
+func (s erasureMetadata) Set(path, key, value string) error {
+	rel, inside := s.e.rel(path)
+	if !inside {
+		return s.e.store.Set(path, key, value)
+	}
+	return s.e.each("setxattr", path, rel, false, func(_ int, path string) error {
+		return s.e.store.Set(path, key, value)
+	})
+}
+
+func (s erasureMetadata) Get(path, key string) (string, error) {
+	rel, inside := s.e.rel(path)
+	if !inside {
+		return s.e.store.Get(path, key)
+	}
+	var first error
+	for i := range s.e.disks {
+		value, err := s.e.store.Get(s.e.disk(i, rel), key)
+		if err == nil || !os.IsNotExist(err) {
+			return value, err
+		}
+		if first == nil {
+			first = backendError("getxattr", path, err)
+		}
+	}
+	return "", first
+}
+
+func (s erasureMetadata) Remove(path, key string) error {
+	rel, inside := s.e.rel(path)
+	if !inside {
+		return s.e.store.Remove(path, key)
+	}
+	missing := 0
+	err := s.e.each("removexattr", path, rel, false, func(_ int, path string) error {
+		err := s.e.store.Remove(path, key)
+		if err == unix.ENODATA {
+			missing++
+			return nil
+		}
+		return err
+	})
+	if err == nil && missing == len(s.e.disks) {
+		return unix.ENODATA
+	}
+	return err
+}
+
+func (s erasureMetadata) List(path string) ([]string, error) {
+	rel, inside := s.e.rel(path)
+	if !inside {
+		return s.e.store.List(path)
+	}
+	var first error
+	for i := range s.e.disks {
+		keys, err := s.e.store.List(s.e.disk(i, rel))
+		if err == nil || !os.IsNotExist(err) {
+			return keys, err
+		}
+		if first == nil {
+			first = backendError("listxattr", path, err)
+		}
+	}
+	return nil, first
+}
+
+func (s erasureMetadata) Rename(oldpath, newpath string) error {
+	oldrel, oldinside := s.e.rel(oldpath)
+	newrel, newinside := s.e.rel(newpath)
+	if !oldinside || !newinside {
+		return s.e.store.Rename(oldpath, newpath)
+	}
+	for i := range s.e.disks {
+		if err := s.e.store.Rename(s.e.disk(i, oldrel), s.e.disk(i, newrel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s erasureMetadata) Delete(path string) error {
+	rel, inside := s.e.rel(path)
+	if !inside {
+		return s.e.store.Delete(path)
+	}
+	for i := range s.e.disks {
+		if err := s.e.store.Delete(s.e.disk(i, rel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
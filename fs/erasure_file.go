@@ -0,0 +1,554 @@
+package fs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// A shard file starts with a header and continues with one block of every
+// stripe followed by its CRC-32C. A stripe holds erasureBlock bytes of the
+// file, split across the data shards and padded with zeros.
+const (
+	erasureBlock    = 1 << 20
+	shardHeaderSize = 32
+	shardVersion    = 1
+)
+
+var shardMagic = [4]byte{'T', 'R', 'E', 'C'}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// shardHeader describes a shard. All shards written together share the
+// generation, which tells stale shards of a disk that missed a write apart.
+type shardHeader struct {
+	data, parity, index int
+	block               int
+	size                int64
+	generation          [8]byte
+}
+
+func (h shardHeader) marshal() []byte {
+	b := make([]byte, shardHeaderSize)
+	copy(b, shardMagic[:])
+	b[4], b[5], b[6], b[7] = shardVersion, byte(h.data), byte(h.parity), byte(h.index)
+	binary.LittleEndian.PutUint32(b[8:], uint32(h.block))
+	binary.LittleEndian.PutUint64(b[12:], uint64(h.size))
+	copy(b[20:], h.generation[:])
+	binary.LittleEndian.PutUint32(b[28:], crc32.Checksum(b[:28], castagnoli))
+	return b
+}
+
+func parseShardHeader(b []byte) (shardHeader, bool) {
+	if len(b) < shardHeaderSize || [4]byte(b[:4]) != shardMagic || b[4] != shardVersion ||
+		binary.LittleEndian.Uint32(b[28:]) != crc32.Checksum(b[:28], castagnoli) {
+		return shardHeader{}, false
+	}
+	h := shardHeader{
+		data:   int(b[5]),
+		parity: int(b[6]),
+		index:  int(b[7]),
+		block:  int(binary.LittleEndian.Uint32(b[8:])),
+		size:   int64(binary.LittleEndian.Uint64(b[12:])),
+	}
+	copy(h.generation[:], b[20:28])
+	return h, true
+}
+
+func readShardHeader(path string) (shardHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return shardHeader{}, err
+	}
+	defer file.Close()
+	b := make([]byte, shardHeaderSize)
+	if _, err := io.ReadFull(file, b); err != nil {
+		return shardHeader{}, unix.EIO
+	}
+	h, ok := parseShardHeader(b)
+	if !ok {
+		return shardHeader{}, unix.EIO
+	}
+	return h, nil
+}
+
+func (e *Erasure) validHeader(h shardHeader, disk int) bool {
+	return h.data == e.rs.data && h.parity == e.rs.parity && h.index == disk && h.block > 0
+}
+
+func (h shardHeader) stripes() int64 {
+	return (h.size + int64(h.block) - 1) / int64(h.block)
+}
+
+// stripe returns the length of the data of stripe s, the length of its
+// shard blocks and their offset in the shard files.
+func (h shardHeader) stripe(s int64) (int, int, int64) {
+	length := min(int64(h.block), h.size-s*int64(h.block))
+	full := (h.block + h.data - 1) / h.data
+	return int(length), (int(length) + h.data - 1) / h.data, shardHeaderSize + s*int64(full+crc32.Size)
+}
+
+// shardReader reads a file from the shards of the generation held by most
+// disks, reconstructing blocks that are missing or corrupt.
+type shardReader struct {
+	e      *Erasure
+	header shardHeader
+	info   os.FileInfo
+	files  []*os.File
+	shards [][]byte
+	// cached is the stripe whose data is in data, -1 for none.
+	cached int64
+	data   []byte
+	// damaged counts the shard blocks that failed to read.
+	damaged int
+}
+
+func (e *Erasure) openShards(name, rel string) (*shardReader, error) {
+	files := make([]*os.File, len(e.disks))
+	headers := make([]shardHeader, len(e.disks))
+	votes := map[[8]byte]int{}
+	for i := range e.disks {
+		file, err := os.Open(e.disk(i, rel))
+		if err != nil {
+			continue
+		}
+		b := make([]byte, shardHeaderSize)
+		h, ok := shardHeader{}, false
+		if _, err := io.ReadFull(file, b); err == nil {
+			h, ok = parseShardHeader(b)
+		}
+		if !ok || !e.validHeader(h, i) {
+			file.Close()
+			continue
+		}
+		files[i], headers[i] = file, h
+		votes[h.generation]++
+	}
+
+	best, count := [8]byte{}, 0
+	for generation, n := range votes {
+		if n > count {
+			best, count = generation, n
+		}
+	}
+	r := &shardReader{e: e, files: files, cached: -1}
+	for i, file := range files {
+		if file == nil {
+			continue
+		}
+		if headers[i].generation != best {
+			file.Close()
+			files[i] = nil
+			continue
+		}
+		r.header = headers[i]
+		if r.info == nil {
+			r.info, _ = file.Stat()
+		}
+	}
+	if count < e.quorum() {
+		r.Close()
+		if count == 0 && len(votes) == 0 {
+			if _, err := e.lstat(name, rel); os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		return nil, backendError("open", name, unix.EIO)
+	}
+	return r, nil
+}
+
+func (r *shardReader) size() int64 {
+	return r.header.size
+}
+
+// load reads stripe s into r.data.
+func (r *shardReader) load(s int64) error {
+	if r.cached == s {
+		return nil
+	}
+	r.cached = -1
+	length, size, offset := r.header.stripe(s)
+	if r.shards == nil {
+		_, full, _ := r.header.stripe(0)
+		buf := make([]byte, len(r.files)*(full+crc32.Size))
+		for i := range r.files {
+			r.shards = append(r.shards, buf[i*(full+crc32.Size):(i+1)*(full+crc32.Size)])
+		}
+	}
+
+	shards := make([][]byte, len(r.files))
+	present := make([]bool, len(r.files))
+	readShard := func(i int) {
+		if r.files[i] == nil {
+			return
+		}
+		block := r.shards[i][:size+crc32.Size]
+		if _, err := r.files[i].ReadAt(block, offset); err != nil ||
+			binary.LittleEndian.Uint32(block[size:]) != crc32.Checksum(block[:size], castagnoli) {
+			r.damaged++
+			return
+		}
+		shards[i], present[i] = block[:size], true
+	}
+
+	complete := true
+	for i := 0; i < r.header.data; i++ {
+		readShard(i)
+		complete = complete && present[i]
+	}
+	if !complete {
+		for i := r.header.data; i < len(r.files); i++ {
+			readShard(i)
+		}
+		for i := range shards {
+			if !present[i] {
+				shards[i] = r.shards[i][:size]
+			}
+		}
+		if err := r.e.rs.reconstruct(shards, present); err != nil {
+			return unix.EIO
+		}
+	}
+
+	r.data = r.data[:0]
+	for i := 0; i < r.header.data; i++ {
+		r.data = append(r.data, shards[i]...)
+	}
+	r.data = r.data[:length]
+	r.cached = s
+	return nil
+}
+
+func (r *shardReader) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		if off >= r.header.size {
+			return n, io.EOF
+		}
+		s := off / int64(r.header.block)
+		if err := r.load(s); err != nil {
+			return n, err
+		}
+		c := copy(b[n:], r.data[off-s*int64(r.header.block):])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r *shardReader) Close() error {
+	for _, file := range r.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	return nil
+}
+
+// encodeShards writes the data of src as shards of a new generation to the
+// given disks, or all disks when nil, and returns the disks that failed.
+func (e *Erasure) encodeShards(rel string, src io.ReaderAt, size int64, perm os.FileMode, generation [8]byte, disks []bool) []bool {
+	failed := make([]bool, len(e.disks))
+	files := make([]*os.File, len(e.disks))
+	writers := make([]*bufio.Writer, len(e.disks))
+	for i := range e.disks {
+		if disks != nil && !disks[i] {
+			continue
+		}
+		path := e.disk(i, rel)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			failed[i] = true
+			continue
+		}
+		header := shardHeader{data: e.rs.data, parity: e.rs.parity, index: i, block: erasureBlock, size: size, generation: generation}
+		files[i], writers[i] = file, bufio.NewWriterSize(file, 1<<16)
+		writers[i].Write(header.marshal())
+	}
+
+	h := shardHeader{data: e.rs.data, block: erasureBlock, size: size}
+	_, full, _ := h.stripe(0)
+	buf := make([]byte, len(e.disks)*full)
+	shards := make([][]byte, len(e.disks))
+	var sum [crc32.Size]byte
+	for s := int64(0); s < h.stripes(); s++ {
+		length, size, _ := h.stripe(s)
+		clear(buf)
+		for i := range shards {
+			shards[i] = buf[i*size : (i+1)*size]
+		}
+		if _, err := src.ReadAt(buf[:length], s*erasureBlock); err != nil && err != io.EOF {
+			for i := range failed {
+				failed[i] = true
+			}
+			break
+		}
+		e.rs.encode(shards)
+		for i, w := range writers {
+			if w == nil {
+				continue
+			}
+			binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(shards[i], castagnoli))
+			w.Write(shards[i])
+			w.Write(sum[:])
+		}
+	}
+
+	for i, file := range files {
+		if file == nil {
+			continue
+		}
+		if err := writers[i].Flush(); err != nil {
+			failed[i] = true
+		}
+		if err := file.Close(); err != nil {
+			failed[i] = true
+		}
+	}
+	return failed
+}
+
+func newGeneration() [8]byte {
+	var g [8]byte
+	rand.Read(g[:])
+	return g
+}
+
+// erasureFile is a file below the root of an Erasure backend. Files open for
+// writing keep their data in a spool file and are encoded when closed or
+// synced, files open for reading decode their shards on demand.
+type erasureFile struct {
+	mu     sync.Mutex
+	e      *Erasure
+	name   string
+	rel    string
+	flag   int
+	perm   os.FileMode
+	spool  *os.File
+	dirty  bool
+	reader *shardReader
+	offset int64
+	closed bool
+}
+
+// load fills the spool with the current data of the file.
+func (f *erasureFile) load() error {
+	r, err := f.e.openShards(f.name, f.rel)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(f.spool, io.NewSectionReader(r, 0, r.size())); err != nil {
+		return backendError("open", f.name, err)
+	}
+	_, err = f.spool.Seek(0, io.SeekStart)
+	return err
+}
+
+// commit encodes the spool into shards on all disks, unless the file was
+// removed while open.
+func (f *erasureFile) commit() error {
+	if len(f.rel) == 0 {
+		f.dirty = false
+		return nil
+	}
+	info, err := f.spool.Stat()
+	if err != nil {
+		return err
+	}
+	perm := f.perm
+	if perm == 0 {
+		perm = 0644
+	}
+	failed := f.e.encodeShards(f.rel, f.spool, info.Size(), perm, newGeneration(), nil)
+	written := 0
+	for _, fail := range failed {
+		if !fail {
+			written++
+		}
+	}
+	if written < f.e.quorum() {
+		return backendError("write", f.name, unix.EIO)
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *erasureFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return backendError(op, f.name, os.ErrClosed)
+	case write && f.spool == nil:
+		return backendError(op, f.name, unix.EBADF)
+	case !write && f.flag&os.O_WRONLY != 0:
+		return backendError(op, f.name, unix.EBADF)
+	}
+	return nil
+}
+
+func (f *erasureFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.spool != nil {
+		return f.spool.Read(b)
+	}
+	n, err := f.reader.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *erasureFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.spool != nil {
+		return f.spool.ReadAt(b, off)
+	}
+	return f.reader.ReadAt(b, off)
+}
+
+func (f *erasureFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		if _, err := f.spool.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	f.dirty = true
+	return f.spool.Write(b)
+}
+
+func (f *erasureFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.spool.WriteAt(b, off)
+}
+
+func (f *erasureFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, backendError("seek", f.name, os.ErrClosed)
+	}
+	if f.spool != nil {
+		return f.spool.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.reader.size()
+	}
+	if offset < 0 {
+		return 0, backendError("seek", f.name, unix.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *erasureFile) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return backendError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	if f.reader != nil {
+		f.mu.Unlock()
+		return f.reader.Close()
+	}
+	var err error
+	if f.dirty {
+		err = f.commit()
+	}
+	f.spool.Close()
+	f.mu.Unlock()
+
+	f.e.mu.Lock()
+	defer f.e.mu.Unlock()
+	for rel, w := range f.e.writers {
+		if w == f {
+			delete(f.e.writers, rel)
+		}
+	}
+	return err
+}
+
+func (f *erasureFile) Name() string {
+	return f.name
+}
+
+func (f *erasureFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, backendError("stat", f.name, os.ErrClosed)
+	}
+	if f.reader != nil {
+		return erasureInfo{f.reader.info, filepath.Base(f.name), f.reader.size()}, nil
+	}
+	spool, err := f.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return erasureInfo{spool, filepath.Base(f.name), spool.Size()}, nil
+}
+
+func (f *erasureFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("sync", true); err != nil {
+		return err
+	}
+	if f.dirty {
+		return f.commit()
+	}
+	return nil
+}
+
+func (f *erasureFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	f.dirty = true
+	return f.spool.Truncate(size)
+}
+
+func (f *erasureFile) Chmod(mode os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return backendError("chmod", f.name, os.ErrClosed)
+	}
+	f.perm = mode
+	return f.e.each("chmod", f.name, f.rel, false, func(_ int, path string) error {
+		return os.Chmod(path, mode)
+	})
+}
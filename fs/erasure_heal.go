@@ -0,0 +1,197 @@
+package fs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// HealResult tells what Heal checked and repaired.
+type HealResult struct {
+	Files  int
+	Healed int
+	// Lost lists the files with fewer intact shards than data shards.
+	Lost []string
+}
+
+// Heal rewrites the shards that are missing, corrupt or left from an older
+// generation, and copies the directories, symlinks and metadata missing on
+// some disks, as after a disk was replaced. Files that can not be read back
+// are left alone and reported.
+func (e *Erasure) Heal() (HealResult, error) {
+	result := HealResult{Lost: []string{}}
+	err := e.healDir(".", &result)
+	return result, err
+}
+
+func (e *Erasure) healDir(rel string, result *HealResult) error {
+	types := map[string]os.FileMode{}
+	present := map[string][]bool{}
+	for i := range e.disks {
+		entries, err := os.ReadDir(e.disk(i, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if _, ok := types[entry.Name()]; !ok {
+				types[entry.Name()] = entry.Type()
+				present[entry.Name()] = make([]bool, len(e.disks))
+			}
+			present[entry.Name()][i] = true
+		}
+	}
+
+	names := []string{}
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := filepath.Join(rel, name)
+		switch typ := types[name]; {
+		case typ.IsDir():
+			ref := -1
+			for i, ok := range present[name] {
+				if !ok {
+					if err := os.MkdirAll(e.disk(i, child), os.ModePerm); err != nil {
+						return err
+					}
+				} else if ref < 0 {
+					ref = i
+				}
+			}
+			changed, err := e.healMetadata(child, ref)
+			if err != nil {
+				return err
+			}
+			if changed || count(present[name]) < len(e.disks) {
+				result.Healed++
+			}
+			if err := e.healDir(child, result); err != nil {
+				return err
+			}
+		case typ&os.ModeSymlink != 0:
+			target := ""
+			for i, ok := range present[name] {
+				if ok {
+					target, _ = os.Readlink(e.disk(i, child))
+					break
+				}
+			}
+			healed := false
+			for i, ok := range present[name] {
+				if !ok {
+					if err := os.Symlink(target, e.disk(i, child)); err != nil {
+						return err
+					}
+					healed = true
+				}
+			}
+			if healed {
+				result.Healed++
+			}
+		case typ.IsRegular():
+			if err := e.healFile(child, result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func count(values []bool) int {
+	n := 0
+	for _, v := range values {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *Erasure) healFile(rel string, result *HealResult) error {
+	result.Files++
+	name := filepath.Join(e.root, rel)
+	r, err := e.openShards(name, rel)
+	if err != nil {
+		result.Lost = append(result.Lost, name)
+		return nil
+	}
+	defer r.Close()
+
+	bad := make([]bool, len(e.disks))
+	ref := -1
+	for i := range e.disks {
+		bad[i] = !r.verify(i)
+		if !bad[i] && ref < 0 {
+			ref = i
+		}
+	}
+	if ref < 0 {
+		result.Lost = append(result.Lost, name)
+		return nil
+	}
+
+	healed := false
+	if count(bad) > 0 {
+		info, err := os.Stat(e.disk(ref, rel))
+		if err != nil {
+			return err
+		}
+		if failed := e.encodeShards(rel, r, r.size(), info.Mode().Perm(), r.header.generation, bad); count(failed) > 0 {
+			return backendError("heal", name, unix.EIO)
+		}
+		healed = true
+	}
+
+	changed, err := e.healMetadata(rel, ref)
+	if err != nil {
+		return err
+	}
+	if healed || changed {
+		result.Healed++
+	}
+	return nil
+}
+
+// verify reads every block of the shard on disk i.
+func (r *shardReader) verify(i int) bool {
+	if r.files[i] == nil {
+		return false
+	}
+	_, full, _ := r.header.stripe(0)
+	block := make([]byte, full+crc32.Size)
+	for s := int64(0); s < r.header.stripes(); s++ {
+		_, size, offset := r.header.stripe(s)
+		if _, err := r.files[i].ReadAt(block[:size+crc32.Size], offset); err != nil ||
+			binary.LittleEndian.Uint32(block[size:size+crc32.Size]) != crc32.Checksum(block[:size], castagnoli) {
+			return false
+		}
+	}
+	return true
+}
+
+// healMetadata makes the metadata of rel on every disk match that on disk ref.
+func (e *Erasure) healMetadata(rel string, ref int) (bool, error) {
+	want, err := metadataOf(e.store, e.disk(ref, rel))
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for i := range e.disks {
+		if i == ref {
+			continue
+		}
+		healed, err := matchMetadata(e.store, e.disk(i, rel), want)
+		changed = changed || healed
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
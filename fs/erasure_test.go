@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 100)
+		if i < 4 {
+			rand.Read(shards[i])
+		}
+	}
+	rs.encode(shards)
+
+	for _, lost := range [][]int{{0, 1}, {1, 4}, {4, 5}, {3}} {
+		damaged := make([][]byte, len(shards))
+		present := make([]bool, len(shards))
+		for i := range shards {
+			damaged[i], present[i] = bytes.Clone(shards[i]), true
+		}
+		for _, i := range lost {
+			damaged[i], present[i] = make([]byte, 100), false
+		}
+		if err := rs.reconstruct(damaged, present); err != nil {
+			t.Fatal(err)
+		}
+		for i := range shards {
+			if !bytes.Equal(damaged[i], shards[i]) {
+				t.Errorf("shard %d differs after losing %v", i, lost)
+			}
+		}
+	}
+
+	present := []bool{true, false, false, false, true, true}
+	if err := rs.reconstruct(shards, present); err != errTooFewShards {
+		t.Errorf("reconstructed from too few shards: %v", err)
+	}
+}
+
+func TestErasure(t *testing.T) {
+	dir := t.TempDir()
+	disks := []string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		disks = append(disks, filepath.Join(dir, name))
+	}
+	root := filepath.Join(dir, "mount")
+	e, err := NewErasure(root, disks, 2, Xattrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := e.Metadata()
+
+	data := make([]byte, 2*erasureBlock+12345)
+	rand.Read(data)
+	path := filepath.Join(root, "bucket", "key")
+	if err := e.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	file, err := e.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.Set(path, "etag", "1"); err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+	if info, err := e.Stat(path); err != nil || info.Size() != int64(len(data)) {
+		t.Fatalf("unexpected size %v %v", info, err)
+	}
+
+	read := func() []byte {
+		t.Helper()
+		file, err := e.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		b, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// Lose a disk and corrupt a block of another.
+	if err := os.RemoveAll(disks[1]); err != nil {
+		t.Fatal(err)
+	}
+	shard, err := os.OpenFile(filepath.Join(disks[3], ErasureData, "bucket", "key"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard.WriteAt([]byte("bitrot"), shardHeaderSize+100)
+	shard.Close()
+	if !bytes.Equal(read(), data) {
+		t.Fatal("data not reconstructed")
+	}
+
+	// Replace the disk and heal.
+	e, err = NewErasure(root, disks, 2, Xattrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta = e.Metadata()
+	result, err := e.Heal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 1 || result.Healed < 2 || len(result.Lost) != 0 {
+		t.Errorf("unexpected heal result %+v", result)
+	}
+	if value, err := (Xattrs{}).Get(filepath.Join(disks[1], ErasureData, "bucket", "key"), "etag"); err != nil || value != "1" {
+		t.Errorf("metadata not healed: %q %v", value, err)
+	}
+
+	// The healed shards alone are enough.
+	os.RemoveAll(filepath.Join(disks[0], ErasureData))
+	os.RemoveAll(filepath.Join(disks[2], ErasureData))
+	if !bytes.Equal(read(), data) {
+		t.Fatal("healed shards do not hold the data")
+	}
+	if value, err := meta.Get(path, "etag"); err != nil || value != "1" {
+		t.Errorf("metadata lost: %q %v", value, err)
+	}
+}
@@ -0,0 +1,138 @@
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The functions below mirror those of package os on the selected backend.
+
+func Open(name string) (File, error) {
+	return backend.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func Create(name string) (File, error) {
+	return backend.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return backend.OpenFile(name, flag, perm)
+}
+
+func CreateTemp(dir, pattern string) (File, error) {
+	return backend.CreateTemp(dir, pattern)
+}
+
+func Stat(name string) (os.FileInfo, error) {
+	return backend.Stat(name)
+}
+
+func Lstat(name string) (os.FileInfo, error) {
+	return backend.Lstat(name)
+}
+
+func ReadDir(name string) ([]os.DirEntry, error) {
+	return backend.ReadDir(name)
+}
+
+func Mkdir(name string, perm os.FileMode) error {
+	return backend.Mkdir(name, perm)
+}
+
+func MkdirAll(path string, perm os.FileMode) error {
+	return backend.MkdirAll(path, perm)
+}
+
+// Remove removes a file or an empty directory. Use RemoveFile for files
+// carrying metadata.
+func Remove(name string) error {
+	return backend.Remove(name)
+}
+
+func Symlink(oldname, newname string) error {
+	return backend.Symlink(oldname, newname)
+}
+
+func Readlink(name string) (string, error) {
+	return backend.Readlink(name)
+}
+
+func Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return backend.Chtimes(name, atime, mtime)
+}
+
+func Truncate(name string, size int64) error {
+	file, err := backend.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Truncate(size)
+}
+
+func ReadFile(name string) ([]byte, error) {
+	file, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func WriteFile(name string, data []byte, perm os.FileMode) error {
+	file, err := backend.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WalkDir walks the tree at root like filepath.WalkDir, in lexical order and
+// without following symlinks.
+func WalkDir(root string, fn iofs.WalkDirFunc) error {
+	info, err := Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(root, iofs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkDir(path string, entry os.DirEntry, fn iofs.WalkDirFunc) error {
+	if err := fn(path, entry, nil); err != nil || !entry.IsDir() {
+		if err == filepath.SkipDir && entry.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := ReadDir(path)
+	if err != nil {
+		if err := fn(path, entry, err); err != nil {
+			if err == filepath.SkipDir && entry.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, child := range entries {
+		if err := walkDir(filepath.Join(path, child.Name()), child, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
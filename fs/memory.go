@@ -0,0 +1,596 @@
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxSymlinks = 40
+
+// Memory keeps files, directories, symlinks and their metadata in memory, for
+// tests and embedding on any filesystem. Paths are made absolute relative to
+// the working directory, which does not need to exist.
+type Memory struct {
+	mu   sync.Mutex
+	root *memNode
+	temp atomic.Uint64
+}
+
+type memNode struct {
+	mode     os.FileMode
+	data     []byte
+	target   string
+	modTime  time.Time
+	children map[string]*memNode
+	meta     map[string]string
+}
+
+func NewMemory() *Memory {
+	return &Memory{root: newMemDir(os.ModePerm)}
+}
+
+func newMemDir(perm os.FileMode) *memNode {
+	return &memNode{mode: os.ModeDir | perm.Perm(), modTime: time.Now(), children: map[string]*memNode{}, meta: map[string]string{}}
+}
+
+func memError(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+func memSplit(name string) []string {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = filepath.Join(string(filepath.Separator), name)
+	}
+	parts := []string{}
+	for _, part := range strings.Split(abs, string(filepath.Separator)) {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// lookup returns the directory containing name, the final component and the
+// node it names, which is nil when it does not exist. Symlinks are followed
+// in the directories and, when follow is set, in the final component.
+func (m *Memory) lookup(name string, follow bool) (*memNode, string, *memNode, error) {
+	return m.walk(memSplit(name), follow, 0)
+}
+
+func (m *Memory) walk(parts []string, follow bool, hops int) (*memNode, string, *memNode, error) {
+	if len(parts) == 0 {
+		return nil, "", m.root, nil
+	}
+	dir := m.root
+	path := string(filepath.Separator)
+	for i, part := range parts {
+		if !dir.mode.IsDir() {
+			return nil, "", nil, unix.ENOTDIR
+		}
+		node := dir.children[part]
+		last := i == len(parts)-1
+		if node == nil || node.mode&os.ModeSymlink == 0 || (last && !follow) {
+			if last {
+				return dir, part, node, nil
+			}
+			if node == nil {
+				return nil, "", nil, unix.ENOENT
+			}
+			dir, path = node, filepath.Join(path, part)
+			continue
+		}
+
+		if hops++; hops > maxSymlinks {
+			return nil, "", nil, unix.ELOOP
+		}
+		target := node.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(path, target)
+		}
+		parent, base, resolved, err := m.walk(memSplit(target), true, hops)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if last {
+			return parent, base, resolved, nil
+		}
+		if resolved == nil {
+			return nil, "", nil, unix.ENOENT
+		}
+		dir, path = resolved, target
+	}
+	return nil, "", nil, unix.ENOENT
+}
+
+func (m *Memory) find(op, name string, follow bool) (*memNode, error) {
+	_, _, node, err := m.lookup(name, follow)
+	if err == nil && node == nil {
+		err = unix.ENOENT
+	}
+	if err != nil {
+		return nil, memError(op, name, err)
+	}
+	return node, nil
+}
+
+func (m *Memory) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.lookup(name, true)
+	if err != nil {
+		return nil, memError("open", name, err)
+	}
+	switch {
+	case node == nil && flag&os.O_CREATE == 0:
+		return nil, memError("open", name, unix.ENOENT)
+	case node == nil:
+		node = &memNode{mode: perm.Perm(), modTime: time.Now(), meta: map[string]string{}}
+		dir.children[base] = node
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, memError("open", name, unix.EEXIST)
+	case node.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, memError("open", name, unix.EISDIR)
+	case flag&os.O_TRUNC != 0:
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{m: m, node: node, name: name, flag: flag}, nil
+}
+
+func (m *Memory) CreateTemp(dir, pattern string) (File, error) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(m.temp.Add(1), 10)+suffix)
+		file, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+}
+
+func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.find("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (m *Memory) Lstat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.find("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+func (m *Memory) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.find("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, memError("readdir", name, unix.ENOTDIR)
+	}
+	entries := []os.DirEntry{}
+	for base, child := range node.children {
+		entries = append(entries, iofs.FileInfoToDirEntry(child.info(base)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *Memory) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.lookup(name, false)
+	if err == nil && node != nil {
+		err = unix.EEXIST
+	}
+	if err != nil {
+		return memError("mkdir", name, err)
+	}
+	dir.children[base] = newMemDir(perm)
+	return nil
+}
+
+func (m *Memory) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parts := memSplit(path)
+	for i := range parts {
+		dir, base, node, err := m.lookup(filepath.Join(append([]string{string(filepath.Separator)}, parts[:i+1]...)...), true)
+		if err != nil {
+			return memError("mkdir", path, err)
+		}
+		if node == nil {
+			dir.children[base] = newMemDir(perm)
+		} else if !node.mode.IsDir() {
+			return memError("mkdir", path, unix.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.lookup(name, false)
+	if err == nil && node == nil {
+		err = unix.ENOENT
+	}
+	if err == nil && node.mode.IsDir() && len(node.children) > 0 {
+		err = unix.ENOTEMPTY
+	}
+	if err == nil && dir == nil {
+		err = unix.EBUSY
+	}
+	if err != nil {
+		return memError("remove", name, err)
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+func (m *Memory) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.lookup(path, false)
+	if err != nil || node == nil {
+		return nil
+	}
+	if dir == nil {
+		m.root = newMemDir(os.ModePerm)
+		return nil
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+func (m *Memory) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	olddir, oldbase, node, err := m.lookup(oldpath, false)
+	if err == nil && (node == nil || olddir == nil) {
+		err = unix.ENOENT
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	newdir, newbase, existing, err := m.lookup(newpath, false)
+	switch {
+	case err != nil:
+	case newdir == nil:
+		err = unix.EBUSY
+	case existing == node:
+		return nil
+	case existing == nil:
+	case existing.mode.IsDir() && !node.mode.IsDir():
+		err = unix.EISDIR
+	case !existing.mode.IsDir() && node.mode.IsDir():
+		err = unix.ENOTDIR
+	case existing.mode.IsDir() && len(existing.children) > 0:
+		err = unix.ENOTEMPTY
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	delete(olddir.children, oldbase)
+	newdir.children[newbase] = node
+	return nil
+}
+
+func (m *Memory) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, base, node, err := m.lookup(newname, false)
+	if err == nil && node != nil {
+		err = unix.EEXIST
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	dir.children[base] = &memNode{mode: os.ModeSymlink | os.ModePerm, target: oldname, modTime: time.Now(), meta: map[string]string{}}
+	return nil
+}
+
+func (m *Memory) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.find("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", memError("readlink", name, unix.EINVAL)
+	}
+	return node.target, nil
+}
+
+func (m *Memory) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.find("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// Metadata returns a store keeping the metadata with the nodes, so that it
+// follows them through renames and goes away with them.
+func (m *Memory) Metadata() MetadataStore {
+	return memMetadata{m}
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return memInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+type memFile struct {
+	m      *Memory
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return memError(op, f.name, os.ErrClosed)
+	case f.node.mode.IsDir():
+		return memError(op, f.name, unix.EISDIR)
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return memError(op, f.name, unix.EBADF)
+	case !write && f.flag&os.O_WRONLY != 0:
+		return memError(op, f.name, unix.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) readAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) writeAt(b []byte, off int64) int {
+	if end := off + int64(len(b)); end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, end*2)
+			copy(data, f.node.data)
+			f.node.data = data
+		}
+		f.node.data = f.node.data[:end]
+	}
+	f.node.modTime = time.Now()
+	return copy(f.node.data[off:], b)
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(b, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memError("readat", f.name, unix.EINVAL)
+	}
+	return f.readAt(b, off)
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	n := f.writeAt(b, f.offset)
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, memError("writeat", f.name, unix.EINVAL)
+	}
+	return f.writeAt(b, off), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return 0, memError("seek", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, memError("seek", f.name, unix.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if f.closed {
+		return memError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return memError("truncate", f.name, unix.EINVAL)
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+		f.node.modTime = time.Now()
+		return nil
+	}
+	f.writeAt(make([]byte, size-int64(len(f.node.data))), int64(len(f.node.data)))
+	return nil
+}
+
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+	f.node.mode = f.node.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+type memMetadata struct {
+	m *Memory
+}
+
+func (s memMetadata) Set(path, key, value string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	node, err := s.m.find("setxattr", path, true)
+	if err != nil {
+		return err
+	}
+	node.meta[key] = value
+	return nil
+}
+
+func (s memMetadata) Get(path, key string) (string, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	node, err := s.m.find("getxattr", path, true)
+	if err != nil {
+		return "", err
+	}
+	value, ok := node.meta[key]
+	if !ok {
+		return "", unix.ENODATA
+	}
+	return value, nil
+}
+
+func (s memMetadata) Remove(path, key string) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	node, err := s.m.find("removexattr", path, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := node.meta[key]; !ok {
+		return unix.ENODATA
+	}
+	delete(node.meta, key)
+	return nil
+}
+
+func (s memMetadata) List(path string) ([]string, error) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	node, err := s.m.find("listxattr", path, true)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range node.meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (memMetadata) Rename(oldpath, newpath string) error { return nil }
+func (memMetadata) Delete(path string) error             { return nil }
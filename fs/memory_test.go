@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	meta := m.Metadata()
+
+	if err := m.MkdirAll("/root/bucket", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	file, err := m.OpenFile("/root/bucket/a", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("hello world"))
+	file.WriteAt([]byte("HELLO"), 0)
+	file.Close()
+	if err := meta.Set("/root/bucket/a", "etag", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Symlink("/root/bucket/a", "/root/link"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := meta.Get("/root/link", "etag"); err != nil || value != "1" {
+		t.Errorf("symlink does not resolve to its target: %q %v", value, err)
+	}
+	if err := m.Rename("/root/bucket/a", "/root/bucket/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("/root/link"); !os.IsNotExist(err) {
+		t.Errorf("dangling symlink resolves: %v", err)
+	}
+	if value, err := meta.Get("/root/bucket/b", "etag"); err != nil || value != "1" {
+		t.Errorf("metadata does not follow the rename: %q %v", value, err)
+	}
+
+	file, err = m.OpenFile("/root/bucket/b", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || string(data) != "HELLO world" {
+		t.Errorf("unexpected content %q %v", data, err)
+	}
+	if _, err := file.Write(data); err == nil {
+		t.Error("write to a read only file")
+	}
+	file.Close()
+
+	if err := m.Remove("/root/bucket"); err == nil {
+		t.Error("removed a directory that is not empty")
+	}
+	if entries, err := m.ReadDir("/root"); err != nil || len(entries) != 2 || entries[0].Name() != "bucket" || entries[1].Type() != os.ModeSymlink {
+		t.Errorf("unexpected entries %v %v", entries, err)
+	}
+	if err := m.RemoveAll("/root/bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.OpenFile("/root/bucket/b", os.O_RDONLY, 0); !os.IsNotExist(err) {
+		t.Errorf("removed file still exists: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package fs
+
+// MetadataStore keeps string values under keys for files and directories.
+// Rename and Delete are called after a file was renamed and before it is
+// removed, so that stores not attached to the inode can follow it.
+type MetadataStore interface {
+	Set(path, key, value string) error
+	Get(path, key string) (string, error)
+	Remove(path, key string) error
+	List(path string) ([]string, error)
+	Rename(oldpath, newpath string) error
+	Delete(path string) error
+}
+
+var store MetadataStore = Xattrs{}
+
+func Setxattr(file, key, value string) error {
+	return store.Set(file, key, value)
+}
+
+func Getxattr(file, key string) (string, error) {
+	return store.Get(file, key)
+}
+
+func Removexattr(file, key string) error {
+	return store.Remove(file, key)
+}
+
+func Listxattr(file string) ([]string, error) {
+	return store.List(file)
+}
+
+func CopyXattrs(dst, src string) error {
+	return CopyMetadata(store, dst, store, src)
+}
+
+// CopyMetadata copies all keys of src in one store to dst in another.
+func CopyMetadata(to MetadataStore, dst string, from MetadataStore, src string) error {
+	keys, err := from.List(src)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := from.Get(src, key)
+		if err != nil {
+			return err
+		}
+		if err := to.Set(dst, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func metadataOf(store MetadataStore, path string) (map[string]string, error) {
+	keys, err := store.List(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, key := range keys {
+		if values[key], err = store.Get(path, key); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// matchMetadata sets and removes keys of path until its metadata equals want
+// and tells whether anything changed.
+func matchMetadata(store MetadataStore, path string, want map[string]string) (bool, error) {
+	have, err := metadataOf(store, path)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for key, value := range want {
+		if current, ok := have[key]; !ok || current != value {
+			if err := store.Set(path, key, value); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	for key := range have {
+		if _, ok := want[key]; !ok {
+			if err := store.Remove(path, key); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// Rename renames a file or directory together with its metadata.
+func Rename(oldpath, newpath string) error {
+	if err := backend.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return store.Rename(oldpath, newpath)
+}
+
+// RemoveAll removes path and everything below it together with the metadata.
+func RemoveAll(path string) error {
+	if err := store.Delete(path); err != nil {
+		return err
+	}
+	return backend.RemoveAll(path)
+}
@@ -0,0 +1,712 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const mirrorState = "mirror.json"
+
+// mirrorStateFile records which mounts have fallen behind. Every change
+// raises the epoch and is written to all mounts that can be reached, so a
+// mount that missed a change is recognized by its older epoch.
+type mirrorStateFile struct {
+	Epoch uint64 `json:"epoch"`
+	Stale []int  `json:"stale"`
+}
+
+// MirrorConfig describes a mount kept as full copies on several directories.
+type MirrorConfig struct {
+	// Mounts are the directories holding a copy, the first one is the path
+	// the files are addressed by.
+	Mounts []string
+	// Quorum is the number of copies a write must reach, 0 for a majority.
+	Quorum int
+	// Store keeps the metadata of every copy.
+	Store MetadataStore
+	// VersionKey names the metadata compared to find copies that diverged.
+	VersionKey string
+	// State is the directory relative to the mounts holding the state of the
+	// mirror and the files of a resync in progress.
+	State string
+	// Skip lists directories relative to the mounts every copy manages on
+	// its own, which are not resynced.
+	Skip []string
+}
+
+// Mirror keeps a full copy of the files below the first mount, together with
+// their metadata, on every mount. Writes go to all copies and succeed once a
+// quorum of them did; reads are served by the first healthy copy and fail
+// over to the next one. A mount that fails a write is stale until Resync
+// copied what it missed. Paths outside the first mount are passed to a Posix
+// backend.
+type Mirror struct {
+	root    string
+	mounts  []string
+	quorum  int
+	store   MetadataStore
+	outside Backend
+	version string
+	state   string
+	skip    []string
+
+	mu      sync.Mutex
+	epoch   uint64
+	stale   []bool
+	pinned  map[string]int
+	pending map[string]bool
+	changed chan struct{}
+}
+
+// NewMirror returns the backend for the mounts of c. Mounts whose state is
+// missing or older than that of the others are stale, on first use all but
+// the first one.
+func NewMirror(c MirrorConfig) (*Mirror, error) {
+	n := len(c.Mounts)
+	if n < 2 {
+		return nil, fmt.Errorf("mirroring needs at least 2 mounts")
+	}
+	quorum := c.Quorum
+	if quorum == 0 {
+		quorum = n/2 + 1
+	}
+	if quorum < 1 || quorum > n {
+		return nil, fmt.Errorf("write quorum must be between 1 and %d for %d mounts", n, n)
+	}
+	m := &Mirror{
+		quorum:  quorum,
+		store:   c.Store,
+		outside: Posix{Store: c.Store},
+		version: c.VersionKey,
+		state:   filepath.Clean(c.State),
+		stale:   make([]bool, n),
+		pinned:  map[string]int{},
+		pending: map[string]bool{},
+		changed: make(chan struct{}, 1),
+	}
+	for _, dir := range c.Skip {
+		m.skip = append(m.skip, filepath.Clean(dir))
+	}
+
+	states := make([]*mirrorStateFile, n)
+	latest := &mirrorStateFile{}
+	for i, mount := range c.Mounts {
+		mount, err := filepath.Abs(mount)
+		if err != nil {
+			return nil, err
+		}
+		m.mounts = append(m.mounts, mount)
+		if err := os.MkdirAll(m.path(i, m.state), os.ModePerm); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(m.path(i, filepath.Join(m.state, mirrorState)))
+		if err != nil {
+			continue
+		}
+		state := &mirrorStateFile{}
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("%s: %w", mount, err)
+		}
+		states[i] = state
+		if state.Epoch > latest.Epoch {
+			latest = state
+		}
+	}
+	m.root = m.mounts[0]
+
+	for i, state := range states {
+		m.stale[i] = state == nil || state.Epoch < latest.Epoch || slices.Contains(latest.Stale, i)
+	}
+	if !slices.Contains(m.stale, false) {
+		// Nothing has been mirrored yet, the first mount holds the files.
+		m.stale[0] = false
+	}
+	m.epoch = latest.Epoch
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.save()
+	return m, nil
+}
+
+// rel returns the path of name relative to the root, if it is below it.
+func (m *Mirror) rel(name string) (string, bool) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	if abs == m.root {
+		return ".", true
+	}
+	rel, found := strings.CutPrefix(abs, m.root+string(filepath.Separator))
+	return rel, found
+}
+
+func (m *Mirror) path(i int, rel string) string {
+	return filepath.Join(m.mounts[i], rel)
+}
+
+// save writes the state to every mount, under m.mu. A mount it can not be
+// written to is found stale by its older epoch when the mirror is opened.
+func (m *Mirror) save() {
+	m.epoch++
+	state := mirrorStateFile{Epoch: m.epoch, Stale: []int{}}
+	for i, stale := range m.stale {
+		if stale {
+			state.Stale = append(state.Stale, i)
+		}
+	}
+	data, _ := json.Marshal(state)
+	for i := range m.mounts {
+		path := m.path(i, filepath.Join(m.state, mirrorState))
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			continue
+		}
+		os.Rename(tmp, path)
+	}
+}
+
+// Stale returns the mounts that are behind the others.
+func (m *Mirror) Stale() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stale := []string{}
+	for i, s := range m.stale {
+		if s {
+			stale = append(stale, m.mounts[i])
+		}
+	}
+	return stale
+}
+
+// Changed receives when a mount fell behind or a copy was found to diverge.
+func (m *Mirror) Changed() <-chan struct{} {
+	return m.changed
+}
+
+func (m *Mirror) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// markStale takes mount i out of reads until it is resynced. The last
+// healthy mount is kept, there would be nothing left to resync from.
+func (m *Mirror) markStale(i int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	healthy := 0
+	for _, stale := range m.stale {
+		if !stale {
+			healthy++
+		}
+	}
+	if m.stale[i] || healthy == 1 {
+		return
+	}
+	m.stale[i] = true
+	m.save()
+	m.notify()
+}
+
+func (m *Mirror) markHealthy(i int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stale[i] {
+		m.stale[i] = false
+		m.save()
+	}
+}
+
+// queue schedules rel for a resync from mount from, which serves its reads
+// until then.
+func (m *Mirror) queue(rel string, from int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[rel] = true
+	if _, ok := m.pinned[rel]; !ok {
+		m.pinned[rel] = from
+	}
+	m.notify()
+}
+
+// order returns the healthy mounts in the order they serve reads of rel.
+func (m *Mirror) order(rel string) []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	order := []int{}
+	pinned, ok := m.pinned[rel]
+	if ok && !m.stale[pinned] {
+		order = append(order, pinned)
+	}
+	for i, stale := range m.stale {
+		if !stale && (!ok || i != pinned) {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (m *Mirror) isStale(i int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stale[i]
+}
+
+func (m *Mirror) alive(i int) bool {
+	info, err := os.Stat(m.mounts[i])
+	return err == nil && info.IsDir()
+}
+
+// failed tells whether err of an operation on mount i means the mount is in
+// trouble rather than the operation not applying to the path.
+func (m *Mirror) failed(i int, err error) bool {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return !errors.Is(err, os.ErrClosed)
+	}
+	switch errno {
+	case unix.ENOENT:
+		return !m.alive(i)
+	case unix.EEXIST, unix.ENOTEMPTY, unix.ENOTDIR, unix.EISDIR, unix.EINVAL, unix.ENODATA,
+		unix.ELOOP, unix.ENAMETOOLONG, unix.EXDEV, unix.EBADF:
+		return false
+	}
+	return true
+}
+
+func sameOutcome(a, b error) bool {
+	var errnoA, errnoB unix.Errno
+	errors.As(a, &errnoA)
+	errors.As(b, &errnoB)
+	return (a == nil) == (b == nil) && errnoA == errnoB
+}
+
+// read applies f to the copies of rel in the order they serve reads until one
+// answers. Mounts failing otherwise than by the path being absent are marked
+// stale.
+func (m *Mirror) read(rel string, f func(i int, path string) error) error {
+	var first error
+	for _, i := range m.order(rel) {
+		err := f(i, m.path(i, rel))
+		if err == nil || !m.failed(i, err) {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+		m.markStale(i)
+	}
+	if first == nil {
+		first = unix.EIO
+	}
+	return first
+}
+
+// each applies f to the copies of rel on every mount. The first healthy mount
+// that answers decides the outcome; mounts that failed are marked stale and
+// healthy ones that answered otherwise get the path resynced. A success
+// needs the quorum of mounts to have succeeded.
+func (m *Mirror) each(rel string, f func(i int, path string) error) error {
+	errs := make([]error, len(m.mounts))
+	for i := range m.mounts {
+		if !m.alive(i) {
+			// Never recreate the tree of a mount that went away.
+			errs[i] = &os.PathError{Op: "stat", Path: m.mounts[i], Err: unix.ENOENT}
+			continue
+		}
+		errs[i] = f(i, m.path(i, rel))
+	}
+
+	decided := -1
+	for _, i := range m.order(rel) {
+		if errs[i] == nil || !m.failed(i, errs[i]) {
+			decided = i
+			break
+		}
+	}
+	if decided < 0 {
+		for i, err := range errs {
+			if err != nil && m.failed(i, err) {
+				m.markStale(i)
+			}
+		}
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		return unix.EIO
+	}
+
+	ok := 0
+	for i, err := range errs {
+		switch {
+		case sameOutcome(err, errs[decided]):
+			if err == nil {
+				ok++
+			}
+		case err != nil && m.failed(i, err):
+			m.markStale(i)
+		case !m.isStale(i):
+			m.queue(rel, decided)
+		}
+	}
+	if errs[decided] != nil {
+		return errs[decided]
+	}
+	if ok < m.quorum {
+		return unix.EIO
+	}
+	return nil
+}
+
+// apply is each for an operation on name, reporting errors by name.
+func (m *Mirror) apply(op, name, rel string, f func(i int, path string) error) error {
+	if err := m.each(rel, f); err != nil {
+		return backendError(op, name, err)
+	}
+	return nil
+}
+
+// check compares the version of rel on the healthy mounts. When they
+// disagree, reads of rel are pinned to a copy most of them agree on and the
+// others are resynced from it.
+func (m *Mirror) check(rel string) {
+	if len(m.version) == 0 {
+		return
+	}
+	m.mu.Lock()
+	_, pinned := m.pinned[rel]
+	m.mu.Unlock()
+	order := m.order(rel)
+	if pinned || len(order) < 2 {
+		return
+	}
+
+	votes := map[string][]int{}
+	for _, i := range order {
+		value, err := m.store.Get(m.path(i, rel), m.version)
+		switch {
+		case err != nil && m.failed(i, err):
+			m.markStale(i)
+			continue
+		case os.IsNotExist(err):
+			value = "\x00missing"
+		}
+		votes[value] = append(votes[value], i)
+	}
+	if len(votes) < 2 {
+		return
+	}
+	best := []int{}
+	for _, mounts := range votes {
+		if len(mounts) > len(best) || (len(mounts) == len(best) && mounts[0] < best[0]) {
+			best = mounts
+		}
+	}
+	m.queue(rel, best[0])
+}
+
+func (m *Mirror) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.OpenFile(name, flag, perm)
+	}
+
+	file := &mirrorFile{m: m, name: name, rel: rel, flag: flag, files: make([]*os.File, len(m.mounts)), tried: make([]bool, len(m.mounts))}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		m.check(rel)
+		err := m.read(rel, func(i int, path string) error {
+			f, err := os.OpenFile(path, flag, perm)
+			if err == nil {
+				file.files[i], file.tried[i] = f, true
+			}
+			return err
+		})
+		if err != nil {
+			return nil, backendError("open", name, err)
+		}
+		return file, nil
+	}
+
+	err := m.each(rel, func(i int, path string) error {
+		f, err := os.OpenFile(path, flag&^os.O_APPEND, perm)
+		if err == nil {
+			file.files[i] = f
+		}
+		return err
+	})
+	if err != nil {
+		file.closeAll()
+		return nil, backendError("open", name, err)
+	}
+	return file, nil
+}
+
+func (m *Mirror) CreateTemp(dir, pattern string) (File, error) {
+	if _, inside := m.rel(dir); !inside {
+		return m.outside.CreateTemp(dir, pattern)
+	}
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(time.Now().UnixNano()), 36)+randomHex(4)+suffix)
+		file, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+}
+
+func (m *Mirror) Stat(name string) (os.FileInfo, error) {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.Stat(name)
+	}
+	var info os.FileInfo
+	err := m.read(rel, func(_ int, path string) (err error) {
+		info, err = os.Stat(path)
+		return err
+	})
+	if err != nil {
+		return nil, backendError("stat", name, err)
+	}
+	return info, nil
+}
+
+func (m *Mirror) Lstat(name string) (os.FileInfo, error) {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.Lstat(name)
+	}
+	var info os.FileInfo
+	err := m.read(rel, func(_ int, path string) (err error) {
+		info, err = os.Lstat(path)
+		return err
+	})
+	if err != nil {
+		return nil, backendError("lstat", name, err)
+	}
+	return info, nil
+}
+
+func (m *Mirror) ReadDir(name string) ([]os.DirEntry, error) {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.ReadDir(name)
+	}
+	var entries []os.DirEntry
+	err := m.read(rel, func(_ int, path string) (err error) {
+		entries, err = os.ReadDir(path)
+		return err
+	})
+	if err != nil {
+		return nil, backendError("readdir", name, err)
+	}
+	return entries, nil
+}
+
+func (m *Mirror) Mkdir(name string, perm os.FileMode) error {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.Mkdir(name, perm)
+	}
+	return m.apply("mkdir", name, rel, func(_ int, path string) error {
+		return os.Mkdir(path, perm)
+	})
+}
+
+func (m *Mirror) MkdirAll(path string, perm os.FileMode) error {
+	rel, inside := m.rel(path)
+	if !inside {
+		return m.outside.MkdirAll(path, perm)
+	}
+	return m.apply("mkdir", path, rel, func(_ int, path string) error {
+		return os.MkdirAll(path, perm)
+	})
+}
+
+func (m *Mirror) Remove(name string) error {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.Remove(name)
+	}
+	return m.apply("remove", name, rel, func(_ int, path string) error {
+		return os.Remove(path)
+	})
+}
+
+func (m *Mirror) RemoveAll(path string) error {
+	rel, inside := m.rel(path)
+	if !inside {
+		return m.outside.RemoveAll(path)
+	}
+	return m.apply("remove", path, rel, func(_ int, path string) error {
+		return os.RemoveAll(path)
+	})
+}
+
+func (m *Mirror) Rename(oldpath, newpath string) error {
+	oldrel, oldinside := m.rel(oldpath)
+	newrel, newinside := m.rel(newpath)
+	switch {
+	case !oldinside && !newinside:
+		return m.outside.Rename(oldpath, newpath)
+	case oldinside != newinside:
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: unix.EXDEV}
+	}
+	err := m.each(oldrel, func(i int, path string) error {
+		return os.Rename(path, m.path(i, newrel))
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: pathCause(err)}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pinned, newrel)
+	if from, ok := m.pinned[oldrel]; ok {
+		delete(m.pinned, oldrel)
+		m.pinned[newrel] = from
+		m.pending[newrel] = true
+	}
+	return nil
+}
+
+func (m *Mirror) Symlink(oldname, newname string) error {
+	rel, inside := m.rel(newname)
+	if !inside {
+		return m.outside.Symlink(oldname, newname)
+	}
+	err := m.each(rel, func(_ int, path string) error {
+		return os.Symlink(oldname, path)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: pathCause(err)}
+	}
+	return nil
+}
+
+func (m *Mirror) Readlink(name string) (string, error) {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.Readlink(name)
+	}
+	var target string
+	err := m.read(rel, func(_ int, path string) (err error) {
+		target, err = os.Readlink(path)
+		return err
+	})
+	if err != nil {
+		return "", backendError("readlink", name, err)
+	}
+	return target, nil
+}
+
+func (m *Mirror) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	rel, inside := m.rel(name)
+	if !inside {
+		return m.outside.Chtimes(name, atime, mtime)
+	}
+	return m.apply("chtimes", name, rel, func(_ int, path string) error {
+		return os.Chtimes(path, atime, mtime)
+	})
+}
+
+// Metadata returns a store keeping the metadata of files below the root on
+// every copy.
+func (m *Mirror) Metadata() MetadataStore {
+	return mirrorMetadata{m}
+}
+
+type mirrorMetadata struct {
+	m *Mirror
+}
+
+func (s mirrorMetadata) Set(path, key, value string) error {
+	rel, inside := s.m.rel(path)
+	if !inside {
+		return s.m.store.Set(path, key, value)
+	}
+	return s.m.each(rel, func(_ int, path string) error {
+		return s.m.store.Set(path, key, value)
+	})
+}
+
+func (s mirrorMetadata) Get(path, key string) (string, error) {
+	rel, inside := s.m.rel(path)
+	if !inside {
+		return s.m.store.Get(path, key)
+	}
+	if key == s.m.version {
+		s.m.check(rel)
+	}
+	var value string
+	err := s.m.read(rel, func(_ int, path string) (err error) {
+		value, err = s.m.store.Get(path, key)
+		return err
+	})
+	return value, err
+}
+
+func (s mirrorMetadata) Remove(path, key string) error {
+	rel, inside := s.m.rel(path)
+	if !inside {
+		return s.m.store.Remove(path, key)
+	}
+	return s.m.each(rel, func(_ int, path string) error {
+		return s.m.store.Remove(path, key)
+	})
+}
+
+func (s mirrorMetadata) List(path string) ([]string, error) {
+	rel, inside := s.m.rel(path)
+	if !inside {
+		return s.m.store.List(path)
+	}
+	var keys []string
+	err := s.m.read(rel, func(_ int, path string) (err error) {
+		keys, err = s.m.store.List(path)
+		return err
+	})
+	return keys, err
+}
+
+func (s mirrorMetadata) Rename(oldpath, newpath string) error {
+	oldrel, oldinside := s.m.rel(oldpath)
+	newrel, newinside := s.m.rel(newpath)
+	if !oldinside || !newinside {
+		return s.m.store.Rename(oldpath, newpath)
+	}
+	for i := range s.m.mounts {
+		if err := s.m.store.Rename(s.m.path(i, oldrel), s.m.path(i, newrel)); err != nil && !os.IsNotExist(err) && !s.m.isStale(i) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s mirrorMetadata) Delete(path string) error {
+	rel, inside := s.m.rel(path)
+	if !inside {
+		return s.m.store.Delete(path)
+	}
+	for i := range s.m.mounts {
+		if err := s.m.store.Delete(s.m.path(i, rel)); err != nil && !os.IsNotExist(err) && !s.m.isStale(i) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// mirrorFile is a file open on the mounts of a mirror. A file open for
+// writing holds every copy and writes to all of them at its own offset; a
+// file open for reading holds one copy and opens the next healthy one when
+// reading it fails.
+type mirrorFile struct {
+	m    *Mirror
+	name string
+	rel  string
+	flag int
+
+	mu     sync.Mutex
+	files  []*os.File
+	tried  []bool
+	offset int64
+	closed bool
+}
+
+func (f *mirrorFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// current returns the copy reads are served from, opening another one of a
+// read-only file when none is left.
+func (f *mirrorFile) current() (int, error) {
+	order := f.m.order(f.rel)
+	for _, i := range order {
+		if f.files[i] != nil {
+			return i, nil
+		}
+	}
+	if f.writable() {
+		for i, file := range f.files {
+			if file != nil {
+				return i, nil
+			}
+		}
+	} else {
+		for _, i := range order {
+			if f.tried[i] {
+				continue
+			}
+			f.tried[i] = true
+			file, err := os.OpenFile(f.m.path(i, f.rel), f.flag, 0)
+			if err != nil {
+				continue
+			}
+			f.files[i] = file
+			return i, nil
+		}
+	}
+	return -1, backendError("read", f.name, unix.EIO)
+}
+
+// drop closes copy i after it failed, taking its mount out of reads.
+func (f *mirrorFile) drop(i int) {
+	f.files[i].Close()
+	f.files[i] = nil
+	f.m.markStale(i)
+}
+
+// all applies op to every copy and fails when fewer than the quorum succeed.
+func (f *mirrorFile) all(name string, op func(file *os.File) error) error {
+	ok := 0
+	var first error
+	for i, file := range f.files {
+		if file == nil {
+			continue
+		}
+		err := op(file)
+		switch {
+		case err == nil:
+			ok++
+		case f.m.failed(i, err):
+			f.drop(i)
+		default:
+			return backendError(name, f.name, err)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if ok < f.m.quorum {
+		if first == nil {
+			first = unix.EIO
+		}
+		return backendError(name, f.name, first)
+	}
+	return nil
+}
+
+func (f *mirrorFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return backendError(op, f.name, os.ErrClosed)
+	case write && !f.writable():
+		return backendError(op, f.name, unix.EBADF)
+	case !write && f.flag&os.O_WRONLY != 0:
+		return backendError(op, f.name, unix.EBADF)
+	}
+	return nil
+}
+
+func (f *mirrorFile) readAt(b []byte, off int64) (int, error) {
+	for {
+		i, err := f.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := f.files[i].ReadAt(b, off)
+		if err == nil || err == io.EOF || !f.m.failed(i, err) {
+			return n, err
+		}
+		f.drop(i)
+	}
+}
+
+func (f *mirrorFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(b, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *mirrorFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	return f.readAt(b, off)
+}
+
+func (f *mirrorFile) size() (int64, error) {
+	i, err := f.current()
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.files[i].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (f *mirrorFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		f.offset = size
+	}
+	if err := f.all("write", func(file *os.File) error {
+		_, err := file.WriteAt(b, f.offset)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	f.offset += int64(len(b))
+	return len(b), nil
+}
+
+func (f *mirrorFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if err := f.all("write", func(file *os.File) error {
+		_, err := file.WriteAt(b, off)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (f *mirrorFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, backendError("seek", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, backendError("seek", f.name, unix.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *mirrorFile) closeAll() error {
+	var first error
+	for i, file := range f.files {
+		if file == nil {
+			continue
+		}
+		if err := file.Close(); err != nil && first == nil {
+			first = err
+		}
+		f.files[i] = nil
+	}
+	return first
+}
+
+func (f *mirrorFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return backendError("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return f.closeAll()
+}
+
+func (f *mirrorFile) Name() string {
+	return f.name
+}
+
+func (f *mirrorFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, backendError("stat", f.name, os.ErrClosed)
+	}
+	i, err := f.current()
+	if err != nil {
+		return nil, err
+	}
+	return f.files[i].Stat()
+}
+
+func (f *mirrorFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return backendError("sync", f.name, os.ErrClosed)
+	}
+	if !f.writable() {
+		return nil
+	}
+	return f.all("sync", (*os.File).Sync)
+}
+
+func (f *mirrorFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	return f.all("truncate", func(file *os.File) error {
+		return file.Truncate(size)
+	})
+}
+
+func (f *mirrorFile) Chmod(mode os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return backendError("chmod", f.name, os.ErrClosed)
+	}
+	if f.writable() {
+		return f.all("chmod", func(file *os.File) error {
+			return file.Chmod(mode)
+		})
+	}
+	i, err := f.current()
+	if err != nil {
+		return err
+	}
+	return f.files[i].Chmod(mode)
+}
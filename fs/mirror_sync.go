@@ -0,0 +1,291 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Resync copies to the healthy mounts the paths found divergent, from the
+// copy serving their reads, and to the stale mounts that can be reached what
+// they missed, from the first healthy mount. It returns how many files and
+// directories it changed. A stale mount is healthy again once it was resynced
+// without errors.
+func (m *Mirror) Resync() (int, error) {
+	changed := 0
+	var errs []error
+
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = map[string]bool{}
+	m.mu.Unlock()
+	for rel := range pending {
+		order := m.order(rel)
+		failed := false
+		for i := range m.mounts {
+			if i == order[0] || m.isStale(i) || !m.alive(i) {
+				continue
+			}
+			n, err := m.syncPath(order[0], i, rel)
+			changed += n
+			if err != nil {
+				errs = append(errs, err)
+				failed = true
+			}
+		}
+		m.mu.Lock()
+		if failed {
+			m.pending[rel] = true
+		} else if !m.pending[rel] {
+			delete(m.pinned, rel)
+		}
+		m.mu.Unlock()
+	}
+
+	for i := range m.mounts {
+		if !m.isStale(i) || !m.alive(i) {
+			continue
+		}
+		n, err := m.syncPath(m.order(".")[0], i, ".")
+		changed += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.mounts[i], err))
+			continue
+		}
+		m.markHealthy(i)
+	}
+	return changed, errors.Join(errs...)
+}
+
+func (m *Mirror) skipped(rel string) bool {
+	for _, dir := range append([]string{m.state}, m.skip...) {
+		if rel == dir || strings.HasPrefix(rel, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncPath makes rel and everything below it on mount to a copy of that on
+// mount from.
+func (m *Mirror) syncPath(from, to int, rel string) (int, error) {
+	if m.skipped(rel) {
+		return 0, nil
+	}
+	src, dst := m.path(from, rel), m.path(to, rel)
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err := m.store.Delete(dst); err != nil {
+			return 0, err
+		}
+		return 1, os.RemoveAll(dst)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	current, err := os.Lstat(dst)
+	switch {
+	case err == nil && current.Mode().Type() != info.Mode().Type():
+		if err := m.store.Delete(dst); err != nil {
+			return 0, err
+		}
+		if err := os.RemoveAll(dst); err != nil {
+			return 0, err
+		}
+		current = nil
+	case os.IsNotExist(err):
+		current = nil
+	case err != nil:
+		return 0, err
+	}
+
+	switch {
+	case info.IsDir():
+		return m.syncDir(from, to, rel, info, current != nil)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return 0, err
+		}
+		if current != nil {
+			if have, err := os.Readlink(dst); err == nil && have == target {
+				return 0, nil
+			}
+			if err := os.Remove(dst); err != nil {
+				return 0, err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return 0, err
+		}
+		return 1, os.Symlink(target, dst)
+	}
+
+	if current != nil {
+		same, err := m.sameFile(src, dst, info, current)
+		if err != nil {
+			return 0, err
+		}
+		if same {
+			return m.syncMetadata(src, dst)
+		}
+	}
+	return 1, m.copyFile(from, to, rel, info)
+}
+
+func (m *Mirror) syncDir(from, to int, rel string, info os.FileInfo, exists bool) (int, error) {
+	src, dst := m.path(from, rel), m.path(to, rel)
+	changed := 0
+	if !exists {
+		if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	n, err := m.syncMetadata(src, dst)
+	changed += n
+	if err != nil {
+		return changed, err
+	}
+
+	names := map[string]bool{}
+	for _, dir := range []string{src, dst} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return changed, err
+		}
+		for _, entry := range entries {
+			names[entry.Name()] = true
+		}
+	}
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var first error
+	for _, name := range sorted {
+		n, err := m.syncPath(from, to, filepath.Join(rel, name))
+		changed += n
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return changed, first
+}
+
+func (m *Mirror) syncMetadata(src, dst string) (int, error) {
+	want, err := metadataOf(m.store, src)
+	if err != nil {
+		return 0, err
+	}
+	changed, err := matchMetadata(m.store, dst, want)
+	if changed {
+		return 1, err
+	}
+	return 0, err
+}
+
+// sameFile tells whether dst holds the data of src, by their versions when
+// both have one and by their contents otherwise.
+func (m *Mirror) sameFile(src, dst string, info, current os.FileInfo) (bool, error) {
+	if info.Size() != current.Size() {
+		return false, nil
+	}
+	if len(m.version) > 0 {
+		want, err := m.store.Get(src, m.version)
+		have, err2 := m.store.Get(dst, m.version)
+		if err == nil && err2 == nil {
+			return want == have, nil
+		}
+	}
+
+	a, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+	b, err := os.Open(dst)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n, err := io.ReadFull(a, bufA)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if _, err := io.ReadFull(b, bufB[:n]); err != nil {
+			return false, nil
+		}
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+		if n < len(bufA) {
+			return true, nil
+		}
+	}
+}
+
+// copyFile copies rel with its metadata from mount from to mount to, through
+// a temporary file in the state directory renamed into place.
+func (m *Mirror) copyFile(from, to int, rel string, info os.FileInfo) error {
+	src, dst := m.path(from, rel), m.path(to, rel)
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(m.path(to, m.state), "resync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := CopyMetadata(m.store, tmp.Name(), m.store, src); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	if err := m.store.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+
+	// A write to the file while it was copied is resynced once more.
+	if after, err := os.Lstat(src); err != nil || !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size() {
+		m.queue(rel, from)
+	}
+	return nil
+}
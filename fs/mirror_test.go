@@ -0,0 +1,135 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	dir := t.TempDir()
+	mounts := []string{}
+	for _, name := range []string{"a", "b", "c"} {
+		mounts = append(mounts, filepath.Join(dir, name))
+	}
+	config := MirrorConfig{Mounts: mounts, Store: Xattrs{}, VersionKey: "etag", State: ".state"}
+	m, err := NewMirror(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale := m.Stale(); !slices.Equal(stale, mounts[1:]) {
+		t.Fatalf("stale mounts of a new mirror are %v", stale)
+	}
+	if _, err := m.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	if stale := m.Stale(); len(stale) > 0 {
+		t.Fatalf("stale mounts after resync are %v", stale)
+	}
+
+	write := func(name, data, etag string) {
+		t.Helper()
+		file, err := m.OpenFile(filepath.Join(mounts[0], name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		if err := m.Metadata().Set(filepath.Join(mounts[0], name), "etag", etag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(name string) (string, string) {
+		t.Helper()
+		etag, err := m.Metadata().Get(filepath.Join(mounts[0], name), "etag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := m.OpenFile(filepath.Join(mounts[0], name), os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		info, _ := file.Stat()
+		data := make([]byte, info.Size())
+		if _, err := file.ReadAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		return string(data), etag
+	}
+
+	if err := m.MkdirAll(filepath.Join(mounts[0], "bucket"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	write("bucket/key", "hello", "1")
+	for _, mount := range mounts {
+		data, err := os.ReadFile(filepath.Join(mount, "bucket", "key"))
+		etag, _ := Xattrs{}.Get(filepath.Join(mount, "bucket", "key"), "etag")
+		if err != nil || string(data) != "hello" || etag != "1" {
+			t.Errorf("copy on %s holds %q with etag %q: %v", mount, data, etag, err)
+		}
+	}
+
+	// A copy that diverged is not served and is resynced.
+	os.WriteFile(filepath.Join(mounts[0], "bucket", "key"), []byte("stale"), 0644)
+	Xattrs{}.Set(filepath.Join(mounts[0], "bucket", "key"), "etag", "0")
+	if data, etag := read("bucket/key"); data != "hello" || etag != "1" {
+		t.Errorf("read %q with etag %q from diverged copies", data, etag)
+	}
+	if n, err := m.Resync(); err != nil || n != 1 {
+		t.Errorf("resynced %d paths: %v", n, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(mounts[0], "bucket", "key")); string(data) != "hello" {
+		t.Errorf("diverged copy holds %q after resync", data)
+	}
+
+	// A mount that went away misses writes and is stale until resynced.
+	write("bucket/old", "old", "2")
+	away := mounts[2] + ".away"
+	if err := os.Rename(mounts[2], away); err != nil {
+		t.Fatal(err)
+	}
+	write("bucket/new", "new", "3")
+	if err := m.Remove(filepath.Join(mounts[0], "bucket", "old")); err != nil {
+		t.Fatal(err)
+	}
+	if stale := m.Stale(); !slices.Equal(stale, mounts[2:]) {
+		t.Fatalf("stale mounts after losing one are %v", stale)
+	}
+	if err := os.Rename(away, mounts[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewMirror(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale := reopened.Stale(); !slices.Equal(stale, mounts[2:]) {
+		t.Fatalf("stale mounts after reopening are %v", stale)
+	}
+	if _, err := reopened.Resync(); err != nil {
+		t.Fatal(err)
+	}
+	if stale := reopened.Stale(); len(stale) > 0 {
+		t.Fatalf("stale mounts after resync are %v", stale)
+	}
+	if _, err := os.Stat(filepath.Join(mounts[2], "bucket", "old")); !os.IsNotExist(err) {
+		t.Errorf("removed file left on the stale mount: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(mounts[2], "bucket", "new")); string(data) != "new" {
+		t.Errorf("stale mount holds %q after resync", data)
+	}
+
+	// Reads fail over to the next copy.
+	m = reopened
+	os.RemoveAll(mounts[0])
+	if data, _ := read("bucket/new"); data != "new" {
+		t.Errorf("read %q after losing the first mount", data)
+	}
+	if stale := m.Stale(); !slices.Equal(stale, mounts[:1]) {
+		t.Errorf("stale mounts after losing the first one are %v", stale)
+	}
+}
@@ -1,22 +1,42 @@
 package fs
 
 import (
+	"io"
 	"os"
 	"path/filepath"
 )
 
 func CleanupEmptyDirs(path string, root string) {
 	dir := filepath.Dir(path)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
+	if _, err := Stat(dir); os.IsNotExist(err) {
 		return
 	}
 	for {
 		if dir == root {
 			break
 		}
-		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
-			os.Remove(dir)
+		if entries, err := ReadDir(dir); err == nil && len(entries) == 0 {
+			Remove(dir)
 		}
 		dir = filepath.Dir(dir)
 	}
 }
+
+func copyFallback(dst File, src File, offset int64) (int64, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(io.NewOffsetWriter(dst, offset), src)
+}
+
+// RemoveFile removes the file at path together with its metadata. A symlink
+// is removed itself, the file it points to is left alone.
+func RemoveFile(path string) error {
+	if err := store.Delete(path); err != nil {
+		return err
+	}
+	if err := Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
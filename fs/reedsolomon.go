@@ -0,0 +1,181 @@
+package fs
+
+import "errors"
+
+var errTooFewShards = errors.New("too few shards to reconstruct")
+
+// gfExp and gfLog are the exponent and logarithm tables of GF(2^8) with the
+// polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times in to out.
+func gfMulAdd(c byte, in, out []byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range in {
+			out[i] ^= b
+		}
+		return
+	}
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(c, byte(i))
+	}
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+// reedSolomon is a systematic Reed-Solomon code of data and parity shards.
+// The parity rows form a Cauchy matrix, so any data rows of the generator
+// matrix are invertible.
+type reedSolomon struct {
+	data, parity int
+	matrix       [][]byte
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data < 1 || parity < 0 || data+parity > 256 {
+		return nil, errors.New("invalid number of data and parity shards")
+	}
+	rs := &reedSolomon{data: data, parity: parity}
+	for r := 0; r < data+parity; r++ {
+		row := make([]byte, data)
+		if r < data {
+			row[r] = 1
+		} else {
+			for c := range row {
+				row[c] = gfInv(byte(r) ^ byte(c))
+			}
+		}
+		rs.matrix = append(rs.matrix, row)
+	}
+	return rs, nil
+}
+
+// encode computes the parity shards from the data shards, all of equal size.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p := rs.data; p < rs.data+rs.parity; p++ {
+		clear(shards[p])
+		for d := 0; d < rs.data; d++ {
+			gfMulAdd(rs.matrix[p][d], shards[d], shards[p])
+		}
+	}
+}
+
+// reconstruct recomputes the shards that are not present from any data of
+// the present ones. Missing shards must have the size of the others.
+func (rs *reedSolomon) reconstruct(shards [][]byte, present []bool) error {
+	rows := []int{}
+	for i := range shards {
+		if present[i] && len(rows) < rs.data {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < rs.data {
+		return errTooFewShards
+	}
+
+	missingData := false
+	for d := 0; d < rs.data; d++ {
+		missingData = missingData || !present[d]
+	}
+	if missingData {
+		inverse, err := gfInvert(rs.selectRows(rows))
+		if err != nil {
+			return err
+		}
+		for d := 0; d < rs.data; d++ {
+			if present[d] {
+				continue
+			}
+			clear(shards[d])
+			for i, r := range rows {
+				gfMulAdd(inverse[d][i], shards[r], shards[d])
+			}
+		}
+	}
+
+	for p := rs.data; p < rs.data+rs.parity; p++ {
+		if present[p] {
+			continue
+		}
+		clear(shards[p])
+		for d := 0; d < rs.data; d++ {
+			gfMulAdd(rs.matrix[p][d], shards[d], shards[p])
+		}
+	}
+	return nil
+}
+
+func (rs *reedSolomon) selectRows(rows []int) [][]byte {
+	m := make([][]byte, len(rows))
+	for i, r := range rows {
+		m[i] = append([]byte(nil), rs.matrix[r]...)
+	}
+	return m
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && m[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		m[c], m[pivot] = m[pivot], m[c]
+		inv[c], inv[pivot] = inv[pivot], inv[c]
+
+		scale := gfInv(m[c][c])
+		for j := 0; j < n; j++ {
+			m[c][j] = gfMul(m[c][j], scale)
+			inv[c][j] = gfMul(inv[c][j], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || m[r][c] == 0 {
+				continue
+			}
+			f := m[r][c]
+			for j := 0; j < n; j++ {
+				m[r][j] ^= gfMul(f, m[c][j])
+				inv[r][j] ^= gfMul(f, inv[c][j])
+			}
+		}
+	}
+	return inv, nil
+}
@@ -0,0 +1,241 @@
+package fs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const sidecarFile = "@"
+
+// Sidecars keeps metadata in JSON files of a tree parallel to the data, for
+// filesystems without user extended attributes. Every path component is
+// prefixed with an underscore in the tree, so the file holding the metadata
+// of a path never collides with the entries below it.
+type Sidecars struct {
+	roots map[string]string
+	mu    sync.Mutex
+}
+
+// NewSidecars returns a store for files below the given roots, each mapped to
+// the directory holding its sidecar tree.
+func NewSidecars(roots map[string]string) (*Sidecars, error) {
+	s := &Sidecars{roots: map[string]string{}}
+	for root, dir := range roots {
+		real, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, err
+		}
+		if real, err = filepath.Abs(real); err != nil {
+			return nil, err
+		}
+		if dir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+		s.roots[real] = dir
+	}
+	return s, nil
+}
+
+// locate returns the sidecar directory of path, resolving a final symlink
+// when follow is set.
+func (s *Sidecars) locate(path string, follow bool) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var real string
+	if follow {
+		real, err = filepath.EvalSymlinks(abs)
+	} else {
+		real, err = filepath.EvalSymlinks(filepath.Dir(abs))
+		real = filepath.Join(real, filepath.Base(abs))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	best := ""
+	for root := range s.roots {
+		if (real == root || strings.HasPrefix(real, root+string(filepath.Separator))) && len(root) > len(best) {
+			best = root
+		}
+	}
+	if len(best) == 0 {
+		return "", &os.PathError{Op: "sidecar", Path: path, Err: unix.ENOTSUP}
+	}
+
+	dir := s.roots[best]
+	rel, _ := filepath.Rel(best, real)
+	if rel == "." {
+		return dir, nil
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, "_"+part)
+	}
+	return dir, nil
+}
+
+func readSidecar(dir string) (map[string]string, error) {
+	values := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(dir, sidecarFile))
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return values, json.Unmarshal(data, &values)
+}
+
+func writeSidecar(dir string, values map[string]string) error {
+	path := filepath.Join(dir, sidecarFile)
+	if len(values) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *Sidecars) update(path string, change func(map[string]string) error) error {
+	dir, err := s.locate(path, true)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values, err := readSidecar(dir)
+	if err != nil {
+		return err
+	}
+	if err := change(values); err != nil {
+		return err
+	}
+	return writeSidecar(dir, values)
+}
+
+func (s *Sidecars) Set(path, key, value string) error {
+	return s.update(path, func(values map[string]string) error {
+		values[key] = value
+		return nil
+	})
+}
+
+func (s *Sidecars) Get(path, key string) (string, error) {
+	dir, err := s.locate(path, true)
+	if err != nil {
+		return "", err
+	}
+	values, err := readSidecar(dir)
+	if err != nil {
+		return "", err
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", unix.ENODATA
+	}
+	return value, nil
+}
+
+func (s *Sidecars) Remove(path, key string) error {
+	return s.update(path, func(values map[string]string) error {
+		if _, ok := values[key]; !ok {
+			return unix.ENODATA
+		}
+		delete(values, key)
+		return nil
+	})
+}
+
+func (s *Sidecars) List(path string) ([]string, error) {
+	dir, err := s.locate(path, true)
+	if err != nil {
+		return nil, err
+	}
+	values, err := readSidecar(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Rename moves the sidecars of oldpath and everything below it to newpath,
+// dropping those of the file newpath replaced. A renamed symlink has no
+// metadata of its own.
+func (s *Sidecars) Rename(oldpath, newpath string) error {
+	newdir, err := s.locate(newpath, false)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.RemoveAll(newdir); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(newpath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	olddir, err := s.locate(oldpath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(olddir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(newdir), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(olddir, newdir)
+}
+
+// Delete drops the sidecars of path and everything below it.
+func (s *Sidecars) Delete(path string) error {
+	dir, err := s.locate(path, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecars(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewSidecars(map[string]string{root: filepath.Join(root, ".tri", "sidecar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := filepath.Join(root, "bucket", "a")
+	b := filepath.Join(root, "bucket", "b")
+	os.MkdirAll(filepath.Dir(a), os.ModePerm)
+	for _, path := range []string{a, b} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Get(filepath.Join(root, "missing"), "etag"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+	if err := store.Set(a, "etag", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(b, "etag", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(root, "bucket", "link")
+	if err := os.Symlink(a, link); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get(link, "etag"); err != nil || value != "1" {
+		t.Errorf("symlink does not resolve to its target: %q %v", value, err)
+	}
+
+	if err := os.Rename(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Rename(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get(b, "etag"); err != nil || value != "1" {
+		t.Errorf("metadata does not follow the rename: %q %v", value, err)
+	}
+
+	if err := os.WriteFile(a, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := store.List(a); err != nil || len(keys) != 0 {
+		t.Errorf("new file inherits metadata: %v %v", keys, err)
+	}
+
+	if err := store.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(b)
+	os.WriteFile(b, nil, 0644)
+	if _, err := store.Get(b, "etag"); err == nil {
+		t.Error("metadata survives the removed file")
+	}
+}
@@ -2,15 +2,19 @@ package fs
 
 import (
 	"fmt"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
-func Setxattr(file, key, value string) error {
+// Xattrs keeps metadata in user extended attributes of the files themselves.
+type Xattrs struct{}
+
+func (Xattrs) Set(file, key, value string) error {
 	return unix.Setxattr(file, fmt.Sprintf("user.%s", key), []byte(value), 0)
 }
 
-func Getxattr(file, key string) (string, error) {
+func (Xattrs) Get(file, key string) (string, error) {
 	size, err := unix.Getxattr(file, fmt.Sprintf("user.%s", key), nil)
 	if err != nil {
 		return "", err
@@ -24,3 +28,37 @@ func Getxattr(file, key string) (string, error) {
 
 	return string(buf), nil
 }
+
+func (Xattrs) Remove(file, key string) error {
+	return unix.Removexattr(file, fmt.Sprintf("user.%s", key))
+}
+
+func (Xattrs) List(file string) ([]string, error) {
+	size, err := unix.Listxattr(file, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(file, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if key, found := strings.CutPrefix(name, "user."); found {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Rename and Delete have nothing to do, extended attributes belong to the inode.
+func (Xattrs) Rename(oldpath, newpath string) error {
+	return nil
+}
+
+func (Xattrs) Delete(path string) error {
+	return nil
+}
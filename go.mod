@@ -2,4 +2,7 @@ module github.com/autovia/tri
 
 go 1.25
 
-require golang.org/x/sys v0.39.0
+require (
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/sys v0.39.0
+)
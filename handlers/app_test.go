@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+type doFunc func(handler func(http.ResponseWriter, *http.Request) error, method, target, body string, header ...string) *httptest.ResponseRecorder
+
+// newTestApp returns an app serving the mount from the backend in use and a
+// function running a request through a handler of it. Headers are given as name and value pairs.
+// The test is skipped when the mount does not support extended attributes.
+func newTestApp(t *testing.T, mount string) (*S.App, doFunc) {
+	t.Helper()
+	region, bypass, dedup, verify := "us-east-1", false, false, false
+	app := &S.App{Mount: &mount, Region: &region, Tiers: S.Tiers{}, GovernanceBypass: &bypass, Dedup: &dedup, VerifyReads: &verify}
+	if err := fs.MkdirAll(filepath.Join(mount, Metadata), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Setxattr(filepath.Join(mount, Metadata), "test", "test"); err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+
+	do := func(handler func(http.ResponseWriter, *http.Request) error, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		r, err := app.ParseRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if err := handler(w, r); err != nil {
+			t.Fatalf("%s %s: %s", method, target, err)
+		}
+		return w
+	}
+	return app, do
+}
@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+// paxMetadata prefixes the PAX records holding object metadata. It is the
+// record GNU tar keeps extended attributes in, so an archive extracted with
+// tar --xattrs into a mount keeping metadata in xattrs is served as is.
+const paxMetadata = "SCHILY.xattr.user."
+
+// archivedMetadata are the metadata keys of objects, versions and
+// directories that are archived, and the only ones a restore accepts. The
+// blob reference in particular is left out, it would hand the object data
+// it does not own.
+var archivedMetadata = map[string]bool{
+	"etag": true, "size": true, "parts": true, "content-type": true, "storage-class": true,
+	"compression": true, "scrubbed": true, "tagging": true,
+	"checksum-algorithm": true, "checksum-type": true, "checksum": true,
+	"sse": true, "sse-key": true, "sse-context": true, "sse-customer": true, "sse-fingerprint": true, "sse-kms-key-id": true,
+	"retention-mode": true, "retain-until": true, "legal-hold": true,
+	"key": true, "version-id": true, "delete-marker": true,
+}
+
+// ArchiveResult counts what was exported or restored. Locked counts the
+// objects and versions a restore left alone as they are under object lock.
+type ArchiveResult struct {
+	Objects  int
+	Versions int
+	Configs  int
+	Keys     int
+	Locked   int
+	Bytes    int64
+}
+
+// archiveRecords returns the metadata of the file at path as PAX records.
+// Deduplicated data is archived with the object, so its blob reference is
+// left out, a part layout kept in a blob is archived in its place, and the
+// stamp is recorded anew on restore.
+func archiveRecords(mount string, path string) (map[string]string, error) {
+	keys, err := fs.Listxattr(path)
+	if err != nil {
+		return nil, err
+	}
+	_, deduplicated := blobDigest(path)
+	records := map[string]string{}
+	for _, key := range keys {
+		if key == "parts-blob" {
+			layout, err := readPartLayout(mount, path)
+			if err != nil {
+				return nil, err
+			}
+			records[paxMetadata+"parts"] = layout
+			continue
+		}
+		if !archivedMetadata[key] || deduplicated && key == "size" {
+			continue
+		}
+		value, err := fs.Getxattr(path, key)
+		if err != nil {
+			return nil, err
+		}
+		records[paxMetadata+key] = value
+	}
+	return records, nil
+}
+
+// exportFile writes the file at path to the archive under name, with its data
+// as stored and its metadata.
+func exportFile(tw *tar.Writer, mount string, name string, path string) (int64, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	records, err := archiveRecords(mount, path)
+	if err != nil {
+		return 0, err
+	}
+	data, err := fs.Open(objectDataPath(mount, path))
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+	stored, err := data.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       stored.Size(),
+		Mode:       int64(info.Mode().Perm()),
+		ModTime:    info.ModTime(),
+		PAXRecords: records,
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(tw, data)
+}
+
+// Export writes the objects of the bucket whose keys start with prefix to an
+// archive, with their versions and, for the whole bucket, its configuration.
+// Names in the archive are those below the mount, and data is archived as it
+// is stored, so objects encrypted with the master key can only be read after
+// a restore into a mount with the same key. The keys of the local key
+// management service the objects are encrypted with are archived as well.
+func Export(s3 S.Request, prefix string, w io.Writer) (ArchiveResult, error) {
+	result := ArchiveResult{}
+	kmsKeys := map[string]bool{}
+	bucket := filepath.Join(s3.Mount, s3.Bucket)
+	if info, err := fs.Stat(bucket); err != nil || !info.IsDir() {
+		return result, fmt.Errorf("no bucket %s", s3.Bucket)
+	}
+	tw := tar.NewWriter(w)
+
+	err := fs.WalkDir(bucket, func(p string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		key, _ := filepath.Rel(bucket, p)
+		key = filepath.ToSlash(key)
+		name := path.Join(s3.Bucket, key)
+		if entry.IsDir() {
+			if p == bucket || !strings.HasPrefix(key+"/", prefix) {
+				return nil
+			}
+			records, err := archiveRecords(s3.Mount, p)
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return tw.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeDir,
+				Name:       name + "/",
+				Mode:       int64(info.Mode().Perm()),
+				ModTime:    info.ModTime(),
+				PAXRecords: records,
+				Format:     tar.FormatPAX,
+			})
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		n, err := exportFile(tw, s3.Mount, name, p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if ref, err := fs.Getxattr(p, "sse-kms-key-id"); err == nil {
+			kmsKeys[ref] = true
+		}
+		result.Objects++
+		result.Bytes += n
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	versions := filepath.Join(s3.Mount, Metadata, versionsDir, s3.Bucket)
+	dirs, err := fs.ReadDir(versions)
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	for _, dir := range dirs {
+		stored, err := storedVersions(filepath.Join(versions, dir.Name()))
+		if err != nil {
+			return result, err
+		}
+		for _, v := range stored {
+			if !strings.HasPrefix(v.Key, prefix) {
+				continue
+			}
+			name := path.Join(Metadata, versionsDir, s3.Bucket, dir.Name(), v.ID)
+			n, err := exportFile(tw, s3.Mount, name, v.Path)
+			if err != nil {
+				return result, fmt.Errorf("%s: %w", v.Path, err)
+			}
+			if ref, err := fs.Getxattr(v.Path, "sse-kms-key-id"); err == nil {
+				kmsKeys[ref] = true
+			}
+			result.Versions++
+			result.Bytes += n
+		}
+	}
+
+	if len(prefix) == 0 {
+		configs, err := fs.ReadDir(filepath.Join(s3.Mount, Metadata, bucketConfigs, s3.Bucket))
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		for _, config := range configs {
+			if config.IsDir() || filepath.Ext(config.Name()) != ".xml" {
+				continue
+			}
+			data, err := fs.ReadFile(filepath.Join(s3.Mount, Metadata, bucketConfigs, s3.Bucket, config.Name()))
+			if err != nil {
+				return result, err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join(Metadata, bucketConfigs, s3.Bucket, config.Name()),
+				Size:     int64(len(data)),
+				Mode:     0644,
+				Format:   tar.FormatPAX,
+			})
+			if err != nil {
+				return result, err
+			}
+			if _, err := tw.Write(data); err != nil {
+				return result, err
+			}
+			result.Configs++
+		}
+	}
+
+	exported := map[string]bool{}
+	for ref := range kmsKeys {
+		key, err := readKMSKey(s3, ref)
+		if err != nil {
+			return result, fmt.Errorf("kms key %s: %w", ref, err)
+		}
+		if exported[key.KeyID] {
+			continue
+		}
+		exported[key.KeyID] = true
+		data, err := fs.ReadFile(kmsKeyPath(s3.Mount, key.KeyID))
+		if err != nil {
+			return result, err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(Metadata, kmsDir, key.KeyID+".xml"),
+			Size:     int64(len(data)),
+			Mode:     int64(masterKeyFileMode),
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return result, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return result, err
+		}
+		result.Keys++
+	}
+	return result, tw.Close()
+}
+
+// restoreMetadata returns the metadata keys and values of the PAX records of
+// an archived file, refusing the keys Export does not write.
+func restoreMetadata(hdr *tar.Header) (map[string]string, error) {
+	metadata := map[string]string{}
+	for record, value := range hdr.PAXRecords {
+		key, ok := strings.CutPrefix(record, paxMetadata)
+		if !ok {
+			continue
+		}
+		if !archivedMetadata[key] {
+			return nil, fmt.Errorf("metadata %s is not restored", key)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// restoreKMSKey restores an archived key of the local key management
+// service. A key the mount has already is kept unless the archive holds more
+// versions of it, and the alias is dropped when another key has it.
+func restoreKMSKey(s3 S.Request, file string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var key S.KMSKey
+	if err := xml.Unmarshal(data, &key); err != nil || key.KeyID+".xml" != file || len(key.KeyID) != kmsKeyIDLength || strings.ContainsAny(key.KeyID, "/.") {
+		return fmt.Errorf("invalid kms key %s", file)
+	}
+
+	unlock := lockKey(filepath.Join(s3.Mount, Metadata, kmsDir))
+	defer unlock()
+
+	existing, err := readKMSKey(s3, key.KeyID)
+	if err == nil && len(existing.Versions) >= len(key.Versions) {
+		return nil
+	}
+	if err != nil && err != errKMSNotFound {
+		return err
+	}
+	if len(key.Alias) > 0 {
+		if other, err := readKMSKey(s3, key.Alias); err == nil && other.KeyID != key.KeyID {
+			key.Alias = ""
+		}
+	}
+	return writeKMSKey(s3.Mount, key)
+}
+
+// restoreFile places the data and metadata of an archived object at path,
+// replacing the object there unless it is under object lock.
+func restoreFile(s3 S.Request, path string, hdr *tar.Header, data io.Reader) (int64, error) {
+	metadata, err := restoreMetadata(hdr)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkObjectLock(path, s3.BypassGovernance); err != nil {
+		return 0, err
+	}
+
+	class := standardClass
+	if value, ok := hdr.PAXRecords[paxMetadata+"storage-class"]; ok {
+		class = value
+	}
+	tmp, err := createTemp(s3, class)
+	if err != nil {
+		return 0, err
+	}
+	defer discardTemp(s3, tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, data)
+	if err != nil {
+		return n, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return n, err
+	}
+	if err := tmp.Chmod(os.FileMode(hdr.Mode).Perm()); err != nil {
+		return n, err
+	}
+	for key, value := range metadata {
+		switch key {
+		case "parts":
+			if err := writePartLayout(s3.Mount, tmp.Name(), value); err != nil {
+				return n, err
+			}
+		default:
+			if err := fs.Setxattr(tmp.Name(), key, value); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := fs.Chtimes(tmp.Name(), hdr.ModTime, hdr.ModTime); err != nil {
+		return n, err
+	}
+
+	placed, err := placeObject(s3, tmp.Name())
+	if err != nil {
+		return n, err
+	}
+	if err := fs.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return n, err
+	}
+	if err := replaceFile(s3, placed, path); err != nil {
+		removeObjectFile(s3, placed)
+		return n, err
+	}
+	return n, nil
+}
+
+// Restore reads an archive written by Export into the mount, replacing the
+// objects, versions and configuration it holds. The objects are restored into
+// the bucket they were exported from, or into s3.Bucket when it is set.
+func Restore(s3 S.Request, r io.Reader) (ArchiveResult, error) {
+	result := ArchiveResult{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return result, fmt.Errorf("invalid name %s in archive", hdr.Name)
+		}
+		parts := strings.Split(name, "/")
+		bucket := 0
+		kind := ""
+		if parts[0] == Metadata {
+			switch {
+			case len(parts) == 3 && parts[1] == kmsDir:
+				kind = kmsDir
+			case len(parts) >= 4 && (parts[1] == versionsDir || parts[1] == bucketConfigs):
+				bucket, kind = 2, parts[1]
+			default:
+				log.Printf("#Restore: skipped %s", hdr.Name)
+				continue
+			}
+		}
+		if kind != kmsDir {
+			if len(s3.Bucket) > 0 {
+				parts[bucket] = s3.Bucket
+			}
+			if parts[bucket] == Metadata || parts[bucket] == "." {
+				return result, fmt.Errorf("invalid name %s in archive", hdr.Name)
+			}
+		}
+		target := filepath.Join(s3.Mount, filepath.Join(parts...))
+
+		switch {
+		case hdr.Typeflag == tar.TypeDir && len(kind) == 0:
+			metadata, err := restoreMetadata(hdr)
+			if err != nil {
+				return result, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if err := fs.MkdirAll(target, os.ModePerm); err != nil {
+				return result, err
+			}
+			for key, value := range metadata {
+				if err := fs.Setxattr(target, key, value); err != nil {
+					return result, err
+				}
+			}
+		case hdr.Typeflag != tar.TypeReg:
+			log.Printf("#Restore: skipped %s", hdr.Name)
+		case kind == kmsDir:
+			if err := restoreKMSKey(s3, parts[2], tr); err != nil {
+				return result, err
+			}
+			result.Keys++
+		case kind == bucketConfigs:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return result, err
+			}
+			if err := fs.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return result, err
+			}
+			if err := fs.WriteFile(target+".tmp", data, 0644); err != nil {
+				return result, err
+			}
+			if err := fs.Rename(target+".tmp", target); err != nil {
+				return result, err
+			}
+			result.Configs++
+		default:
+			n, err := restoreFile(s3, target, hdr, tr)
+			if err == errObjectLocked {
+				log.Printf("#Restore: skipped %s, the object is locked", hdr.Name)
+				result.Locked++
+				continue
+			}
+			if err != nil {
+				return result, fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			result.Bytes += n
+			if kind == versionsDir {
+				result.Versions++
+			} else {
+				result.Objects++
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func TestExportRestore(t *testing.T) {
+	fs.UseBackend(fs.NewMemory())
+	defer fs.UseBackend(fs.Posix{})
+
+	srcApp, src := newTestApp(t, "/src")
+	*srcApp.Dedup = true
+	src(Put, "PUT", "/bucket", "")
+	src(Put, "PUT", "/bucket?versioning", `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+	src(Put, "PUT", "/bucket/docs/a", "first")
+	src(Put, "PUT", "/bucket/docs/a", "second")
+	src(Put, "PUT", "/bucket/docs/b", "second")
+	src(Put, "PUT", "/bucket/docs/b?tagging", `<Tagging><TagSet><Tag><Key>k</Key><Value>v</Value></Tag></TagSet></Tagging>`)
+	src(Put, "PUT", "/bucket/other", "other")
+	etag := src(Head, "HEAD", "/bucket/docs/b", "").Header().Get("ETag")
+
+	var archive bytes.Buffer
+	result, err := Export(S.Request{Mount: "/src", Bucket: "bucket"}, "", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Objects != 3 || result.Versions != 1 || result.Configs != 1 {
+		t.Fatalf("unexpected export result %+v", result)
+	}
+	data := archive.Bytes()
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name == "bucket/docs/b" && hdr.PAXRecords[paxMetadata+"blob"] != "" {
+			t.Errorf("blob reference archived: %v", hdr.PAXRecords)
+		}
+	}
+
+	restored, err := Restore(S.Request{Mount: "/dst", Bucket: "copy"}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != result {
+		t.Errorf("restored %+v of %+v", restored, result)
+	}
+
+	dstApp, dst := newTestApp(t, "/dst")
+	*dstApp.Dedup = true
+	if w := dst(Get, "GET", "/copy/docs/b", ""); w.Body.String() != "second" || w.Header().Get("ETag") != etag || w.Header().Get("x-amz-tagging-count") != "1" {
+		t.Errorf("restored object: %q %v", w.Body, w.Header())
+	}
+	if w := dst(Get, "GET", "/copy?versions", ""); strings.Count(w.Body.String(), "<Version>") != 4 {
+		t.Errorf("restored versions: %s", w.Body)
+	}
+	if w := dst(Get, "GET", "/copy?versioning", ""); !strings.Contains(w.Body.String(), "Enabled") {
+		t.Errorf("restored versioning: %s", w.Body)
+	}
+
+	archive.Reset()
+	if result, err := Export(S.Request{Mount: "/src", Bucket: "bucket"}, "docs/", &archive); err != nil || result.Objects != 2 || result.Versions != 1 || result.Configs != 0 {
+		t.Errorf("export of a prefix: %+v %v", result, err)
+	}
+}
+
+func TestExportRestoreKMS(t *testing.T) {
+	fs.UseBackend(fs.NewMemory())
+	defer fs.UseBackend(fs.Posix{})
+
+	masterKey := &[sseKeySize]byte{1, 2, 3}
+	srcApp, src := newTestApp(t, "/src")
+	srcApp.MasterKey = masterKey
+	src(Put, "PUT", "/bucket", "")
+	if w := src(Put, "PUT", "/bucket/key", "secret", "X-Amz-Server-Side-Encryption", sseKMS); w.Code != 200 {
+		t.Fatalf("PUT with SSE-KMS: %d %s", w.Code, w.Body)
+	}
+
+	var archive bytes.Buffer
+	result, err := Export(S.Request{Mount: "/src", Bucket: "bucket"}, "", &archive)
+	if err != nil || result.Keys != 1 {
+		t.Fatalf("export: %+v %v", result, err)
+	}
+
+	// The mount restored into has a default key of its own.
+	dstApp, dst := newTestApp(t, "/dst")
+	dstApp.MasterKey = masterKey
+	dst(Put, "PUT", "/other", "")
+	dst(Put, "PUT", "/other/key", "data", "X-Amz-Server-Side-Encryption", sseKMS)
+	restored, err := Restore(S.Request{Mount: "/dst"}, bytes.NewReader(archive.Bytes()))
+	if err != nil || restored.Keys != 1 {
+		t.Fatalf("restore: %+v %v", restored, err)
+	}
+	if w := dst(Get, "GET", "/bucket/key", ""); w.Body.String() != "secret" {
+		t.Errorf("restored SSE-KMS object: %d %s", w.Code, w.Body)
+	}
+	if w := dst(Get, "GET", "/other/key", ""); w.Body.String() != "data" {
+		t.Errorf("object of the default key of the mount: %d %s", w.Code, w.Body)
+	}
+	keys, _ := listKMSKeys(S.Request{Mount: "/dst"})
+	aliases := 0
+	for _, key := range keys {
+		if key.Alias == kmsDefaultAlias {
+			aliases++
+		}
+	}
+	if len(keys) != 2 || aliases != 1 {
+		t.Errorf("%d keys, %d with the default alias", len(keys), aliases)
+	}
+}
+
+func TestRestoreRefused(t *testing.T) {
+	fs.UseBackend(fs.NewMemory())
+	defer fs.UseBackend(fs.Posix{})
+
+	_, do := newTestApp(t, "/dst")
+	do(Put, "PUT", "/bucket", "")
+	do(Put, "PUT", "/bucket/locked", "kept")
+	if err := fs.Setxattr("/dst/bucket/locked", "legal-hold", "ON"); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := func(name string, records map[string]string, typeflag byte) []byte {
+		data := []byte{}
+		if typeflag == tar.TypeReg {
+			data = []byte("data")
+		}
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		tw.WriteHeader(&tar.Header{Typeflag: typeflag, Name: name, Size: int64(len(data)), Mode: 0644, PAXRecords: records, Format: tar.FormatPAX})
+		tw.Write(data)
+		tw.Close()
+		return b.Bytes()
+	}
+	for _, c := range []struct {
+		name     string
+		typeflag byte
+		records  map[string]string
+	}{
+		{"bucket/key", tar.TypeReg, map[string]string{paxMetadata + "blob": "0123"}},
+		{"bucket/key", tar.TypeReg, map[string]string{paxMetadata + "etag": "x", paxMetadata + "refcount": "1"}},
+		{"bucket/dir/", tar.TypeDir, map[string]string{paxMetadata + "blob": "0123"}},
+	} {
+		if _, err := Restore(S.Request{Mount: "/dst"}, bytes.NewReader(archive(c.name, c.records, c.typeflag))); err == nil {
+			t.Errorf("%s restored with %v", c.name, c.records)
+		}
+	}
+
+	result, err := Restore(S.Request{Mount: "/dst"}, bytes.NewReader(archive("bucket/locked", map[string]string{paxMetadata + "etag": "x"}, tar.TypeReg)))
+	if err != nil || result.Locked != 1 || result.Objects != 0 {
+		t.Errorf("restore over a locked object: %+v %v", result, err)
+	}
+	if w := do(Get, "GET", "/bucket/locked", ""); w.Body.String() != "kept" {
+		t.Errorf("locked object replaced: %q", w.Body)
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func GetObjectAttributes(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetObjectAttributes: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	attributes := make(map[string]bool)
+	for _, a := range strings.Split(r.Header.Get("X-Amz-Object-Attributes"), ",") {
+		a = strings.TrimSpace(a)
+		switch a {
+		case "ETag", "Checksum", "ObjectParts", "StorageClass", "ObjectSize":
+			attributes[a] = true
+		case "":
+		default:
+			return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", errors.New("invalid object attribute "+a), s3.Key)
+		}
+	}
+	if len(attributes) == 0 {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", errors.New("x-amz-object-attributes is required"), s3.Key)
+	}
+
+	maxParts := 1000
+	if value := r.Header.Get("X-Amz-Max-Parts"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+		}
+		maxParts = min(n, 1000)
+	}
+	marker := 0
+	if value := r.Header.Get("X-Amz-Part-Number-Marker"); len(value) > 0 {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+		}
+		marker = n
+	}
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	key, err := customerKey(r.Header, "X-Amz-Server-Side-Encryption-Customer-")
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+	}
+	if code, awscode, err := checkCustomerKey(path, key); err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	stat, err := fs.Stat(path)
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+	etag, err := fs.Getxattr(path, "etag")
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	result := S.GetObjectAttributesResponse{}
+	if attributes["ETag"] {
+		result.ETag = etag
+	}
+	if attributes["ObjectSize"] {
+		size := objectSize(path, stat)
+		result.ObjectSize = &size
+	}
+	if attributes["StorageClass"] {
+		result.StorageClass = objectStorageClass(path)
+	}
+	if c, ok := readChecksum(path); ok && attributes["Checksum"] {
+		result.Checksum = &S.ObjectChecksum{ChecksumType: c.Type}
+		result.Checksum.Set(c.Algorithm, c.Value)
+	}
+	if _, count, found := strings.Cut(etag, "-"); found && attributes["ObjectParts"] {
+		result.ObjectParts = objectParts(s3.Mount, path, count, marker, maxParts)
+	}
+
+	w.Header().Set("Last-Modified", stat.ModTime().Format(RFC822Format))
+	return S.RespondXML(w, http.StatusOK, result)
+}
+
+// maxInlineLayout is the longest part layout kept in the parts attribute of
+// an object. Longer ones, which would not fit next to the other attributes on
+// file systems such as ext4, are stored as a blob named by parts-blob.
+const maxInlineLayout = 1024
+
+// partLayoutDigest returns the digest of the blob holding the part layout of
+// the object at path, if it is stored as one.
+func partLayoutDigest(path string) (string, bool) {
+	digest, err := fs.Getxattr(path, "parts-blob")
+	if err != nil || len(digest) != sha256.Size*2 {
+		return "", false
+	}
+	return digest, true
+}
+
+// writePartLayout records the part layout of the multipart object at path.
+func writePartLayout(mount string, path string, layout string) error {
+	if len(layout) <= maxInlineLayout {
+		return fs.Setxattr(path, "parts", layout)
+	}
+	sum := sha256.Sum256([]byte(layout))
+	digest := hex.EncodeToString(sum[:])
+	if err := storeBlobData(mount, digest, []byte(layout)); err != nil {
+		return err
+	}
+	if err := fs.Setxattr(path, "parts-blob", digest); err != nil {
+		releaseBlob(mount, digest)
+		return err
+	}
+	return nil
+}
+
+// readPartLayout returns the part layout recorded for the multipart object
+// at path.
+func readPartLayout(mount string, path string) (string, error) {
+	if digest, ok := partLayoutDigest(path); ok {
+		layout, err := fs.ReadFile(blobPath(mount, digest))
+		return string(layout), err
+	}
+	return fs.Getxattr(path, "parts")
+}
+
+// objectParts pages through the part layout recorded when a multipart upload
+// was assembled. Objects without a recorded layout only report their count.
+func objectParts(mount string, path string, count string, marker int, maxParts int) *S.ObjectParts {
+	result := &S.ObjectParts{
+		MaxParts:         maxParts,
+		PartNumberMarker: marker,
+		Parts:            []S.ObjectPart{},
+	}
+	result.PartsCount, _ = strconv.Atoi(count)
+
+	algorithm, _ := fs.Getxattr(path, "checksum-algorithm")
+	layout, err := readPartLayout(mount, path)
+	if err != nil {
+		return result
+	}
+
+	for _, entry := range strings.Split(layout, ",") {
+		fields := strings.Split(entry, ":")
+		number, _ := strconv.Atoi(fields[0])
+		if number <= marker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		part := S.ObjectPart{PartNumber: number}
+		if len(fields) > 1 {
+			part.Size, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+		if len(fields) > 2 {
+			part.Set(algorithm, fields[2])
+		}
+		result.Parts = append(result.Parts, part)
+		result.NextPartNumberMarker = number
+	}
+
+	return result
+}
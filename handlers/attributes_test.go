@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func TestObjectPartsPaging(t *testing.T) {
+	mount := t.TempDir()
+	_, do := newTestApp(t, mount)
+	do(Put, "PUT", "/bucket", "")
+
+	initiated := S.InitiateMultipartUploadResponse{}
+	if err := xml.Unmarshal(do(Post, "POST", "/bucket/big?uploads", "").Body.Bytes(), &initiated); err != nil {
+		t.Fatal(err)
+	}
+	const count = 1234
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for n := 1; n <= count; n++ {
+		w := do(Put, "PUT", fmt.Sprintf("/bucket/big?partNumber=%d&uploadId=%s", n, initiated.UploadID), strings.Repeat("x", n%7+1))
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", n, w.Header().Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	if w := do(Post, "POST", "/bucket/big?uploadId="+initiated.UploadID, complete.String()); w.Code != 200 {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	if _, err := fs.Getxattr(filepath.Join(mount, "bucket", "big"), "parts"); err == nil {
+		t.Error("long part layout kept in an attribute")
+	}
+
+	for _, maxParts := range []string{"", "10"} {
+		marker, seen, pages := 0, 0, 0
+		for {
+			w := do(Get, "GET", "/bucket/big?attributes", "",
+				"X-Amz-Object-Attributes", "ObjectParts",
+				"X-Amz-Max-Parts", maxParts,
+				"X-Amz-Part-Number-Marker", fmt.Sprint(marker))
+			result := S.GetObjectAttributesResponse{}
+			if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || result.ObjectParts == nil {
+				t.Fatalf("attributes: %v %s", err, w.Body)
+			}
+			pages++
+			parts := result.ObjectParts
+			if parts.PartsCount != count {
+				t.Errorf("parts count %d", parts.PartsCount)
+			}
+			for _, part := range parts.Parts {
+				seen++
+				if part.PartNumber != seen || part.Size != int64(seen%7+1) {
+					t.Fatalf("part %d: %+v", seen, part)
+				}
+			}
+			if !parts.IsTruncated {
+				break
+			}
+			marker = parts.NextPartNumberMarker
+		}
+		if want := map[string]int{"": 2, "10": 124}[maxParts]; seen != count || pages != want {
+			t.Errorf("max parts %q: paged through %d parts in %d pages", maxParts, seen, pages)
+		}
+	}
+
+	do(Delete, "DELETE", "/bucket/big", "")
+	blobs := 0
+	fs.WalkDir(filepath.Join(mount, Metadata, blobsDir), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			blobs++
+		}
+		return nil
+	})
+	if blobs != 0 {
+		t.Errorf("%d blobs left after the object was deleted", blobs)
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	fs.UseBackend(fs.NewMemory())
+	defer fs.UseBackend(fs.Posix{})
+
+	mount := "/memory"
+	_, do := newTestApp(t, mount)
+
+	if w := do(Put, "PUT", "/bucket", ""); w.Code != http.StatusOK {
+		t.Fatalf("create bucket: %d %s", w.Code, w.Body)
+	}
+	if w := do(Put, "PUT", "/bucket/key", "in memory"); w.Code != http.StatusOK || len(w.Header().Get("ETag")) == 0 {
+		t.Fatalf("put object: %d %s", w.Code, w.Body)
+	}
+	if w := do(Get, "GET", "/bucket/key", ""); w.Code != http.StatusOK || w.Body.String() != "in memory" {
+		t.Errorf("get object: %d %q", w.Code, w.Body)
+	}
+	if w := do(Get, "GET", "/bucket?list-type=2", ""); !strings.Contains(w.Body.String(), "<Key>key</Key>") {
+		t.Errorf("object not listed: %s", w.Body)
+	}
+	if w := do(Delete, "DELETE", "/bucket/key", ""); w.Code != http.StatusOK {
+		t.Errorf("delete object: %d %s", w.Code, w.Body)
+	}
+	if w := do(Delete, "DELETE", "/bucket", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete bucket: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(mount); !os.IsNotExist(err) {
+		t.Errorf("memory backend touched the filesystem: %v", err)
+	}
+}
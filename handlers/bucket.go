@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
+	"github.com/autovia/tri/fs"
 	S "github.com/autovia/tri/structs"
 )
 
@@ -12,7 +18,7 @@ func ListBuckets(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#ListBuckets %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	files, err := os.ReadDir(s3.Mount)
+	files, err := fs.ReadDir(s3.Mount)
 	if err != nil {
 		return S.RespondError(w, 500, "InternalError", err, "")
 	}
@@ -37,55 +43,96 @@ func CreateBucket(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#CreateBucket: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); !os.IsNotExist(err) {
+	if _, err := fs.Stat(s3.Path); !os.IsNotExist(err) {
 		return S.RespondError(w, 409, "BucketAlreadyOwnedByYou", err, s3.Bucket)
 	}
 
-	if err := os.Mkdir(s3.Path, os.ModePerm); err != nil {
+	body, _ := io.ReadAll(r.Body)
+	if len(bytes.TrimSpace(body)) > 0 {
+		var config S.CreateBucketConfiguration
+		if err := xml.Unmarshal(body, &config); err != nil {
+			return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Bucket)
+		}
+		if len(config.LocationConstraint) > 0 && config.LocationConstraint != locationConstraint(s3.Region) {
+			return S.RespondError(w, http.StatusBadRequest, "IllegalLocationConstraintException", errors.New("location constraint does not match region "+s3.Region), s3.Bucket)
+		}
+	}
+
+	if err := fs.Mkdir(s3.Path, os.ModePerm); err != nil {
 		return S.RespondError(w, 500, "InternalError", err, s3.Bucket)
 	}
 
+	if strings.EqualFold(r.Header.Get("X-Amz-Bucket-Object-Lock-Enabled"), "true") {
+		if err := writeBucketConfig(s3.Mount, s3.Bucket, versioningConfig, S.VersioningConfiguration{Status: "Enabled"}); err != nil {
+			return S.RespondError(w, 500, "InternalError", err, s3.Bucket)
+		}
+		if err := writeBucketConfig(s3.Mount, s3.Bucket, objectLockConfig, S.ObjectLockConfiguration{ObjectLockEnabled: "Enabled"}); err != nil {
+			return S.RespondError(w, 500, "InternalError", err, s3.Bucket)
+		}
+	}
+
 	w.Header().Set("Location", s3.Key)
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set("Server", "AmazonS3")
 	return S.Respond(w, http.StatusOK, nil, nil)
 }
 
+func GetBucketLocation(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetBucketLocation: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	return S.RespondXML(w, http.StatusOK, S.LocationConstraint{Location: locationConstraint(s3.Region)})
+}
+
+// locationConstraint maps a region to its location constraint, which is empty for us-east-1.
+func locationConstraint(region string) string {
+	if region == "us-east-1" {
+		return ""
+	}
+	return region
+}
+
 func HeadBucket(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#HeadBucket: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
 		return S.RespondError(w, 400, "NoSuchBucket", err, s3.Bucket)
 	}
 
 	return S.Respond(w, http.StatusOK, nil, nil)
 }
 
-func GetBucketVersioning(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("#GetBucketVersioning: %v\n", r)
-
-	return S.RespondXML(w, http.StatusOK, S.VersioningConfiguration{Status: "Suspended"})
-}
-
 func DeleteBucket(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#DeleteBucket: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
 	}
 
-	contents, err := os.ReadDir(s3.Path)
+	contents, err := fs.ReadDir(s3.Path)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
 	}
 
-	if len(contents) > 0 {
+	if len(contents) > 0 || hasStoredVersions(s3.Mount, s3.Bucket) {
 		return S.RespondError(w, http.StatusConflict, "BucketNotEmpty", err, s3.Bucket)
 	}
 
-	if err := os.Remove(s3.Path); err != nil {
+	if err := fs.Remove(s3.Path); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	if err := deleteVersionStore(s3.Mount, s3.Bucket); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	if err := deleteBucketConfigs(s3.Mount, s3.Bucket); err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
 	}
 
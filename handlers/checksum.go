@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const (
+	checksumFullObject = "FULL_OBJECT"
+	checksumComposite  = "COMPOSITE"
+)
+
+const crc64NVMEPoly = 0x9a6c9329ac4bc9b5
+
+var checksumAlgorithms = []string{"CRC32", "CRC32C", "SHA1", "SHA256", "CRC64NVME"}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+var crc64NVMETable = crc64.MakeTable(crc64NVMEPoly)
+
+var errBadDigest = errors.New("checksum does not match the uploaded data")
+var errInvalidDigest = errors.New("Content-MD5 is not a valid base64 md5 digest")
+var errMissingDigest = errors.New("missing required header Content-MD5 or x-amz-checksum-*")
+var errInvalidChecksum = errors.New("invalid checksum algorithm or type")
+
+type checksum struct {
+	Algorithm string
+	Type      string
+	Value     string
+}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "CRC32":
+		return crc32.NewIEEE()
+	case "CRC32C":
+		return crc32.New(crc32cTable)
+	case "SHA1":
+		return sha1.New()
+	case "SHA256":
+		return sha256.New()
+	case "CRC64NVME":
+		return crc64.New(crc64NVMETable)
+	}
+	return nil
+}
+
+func checksumHeader(algorithm string) string {
+	return "x-amz-checksum-" + strings.ToLower(algorithm)
+}
+
+// requestedChecksum returns the checksum algorithm of an upload, taken from an
+// x-amz-checksum-* header, the announced trailer or the SDK algorithm header.
+func requestedChecksum(r *http.Request, fallback string) (string, error) {
+	algorithm := strings.ToUpper(r.Header.Get("X-Amz-Sdk-Checksum-Algorithm"))
+	for _, a := range checksumAlgorithms {
+		if len(r.Header.Get(checksumHeader(a))) > 0 {
+			if len(algorithm) > 0 && algorithm != a {
+				return "", errInvalidChecksum
+			}
+			algorithm = a
+		}
+	}
+	if trailer := strings.ToLower(r.Header.Get("X-Amz-Trailer")); strings.HasPrefix(trailer, "x-amz-checksum-") {
+		a := strings.ToUpper(strings.TrimPrefix(trailer, "x-amz-checksum-"))
+		if len(algorithm) > 0 && algorithm != a {
+			return "", errInvalidChecksum
+		}
+		algorithm = a
+	}
+
+	if len(algorithm) == 0 {
+		return fallback, nil
+	}
+	if newChecksumHash(algorithm) == nil || (len(fallback) > 0 && fallback != algorithm) {
+		return "", errInvalidChecksum
+	}
+	return algorithm, nil
+}
+
+// contentMD5 decodes the Content-MD5 header, returning nil when it is absent.
+func contentMD5(r *http.Request) ([]byte, error) {
+	value := r.Header.Get("Content-Md5")
+	if len(value) == 0 {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(sum) != md5.Size {
+		return nil, errInvalidDigest
+	}
+	return sum, nil
+}
+
+// receiveBody streams the request body into dst and returns its md5 etag and
+// the checksum of the requested algorithm, verified against the sent values.
+func receiveBody(r *http.Request, dst io.Writer, algorithm string) (string, string, error) {
+	digest, err := contentMD5(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	h := md5.New()
+	writers := []io.Writer{dst, h}
+	c := newChecksumHash(algorithm)
+	if c != nil {
+		writers = append(writers, c)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r.Body); err != nil {
+		return "", "", err
+	}
+	if digest != nil && !bytes.Equal(digest, h.Sum(nil)) {
+		return "", "", errBadDigest
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+	if c == nil {
+		return etag, "", nil
+	}
+
+	sum := base64.StdEncoding.EncodeToString(c.Sum(nil))
+	expected := r.Header.Get(checksumHeader(algorithm))
+	if len(expected) == 0 && r.Trailer != nil {
+		expected = r.Trailer.Get(checksumHeader(algorithm))
+	}
+	if len(expected) > 0 && expected != sum {
+		return "", "", errBadDigest
+	}
+	return etag, sum, nil
+}
+
+// verifyBody checks an in-memory request body against Content-MD5 and any
+// x-amz-checksum-* header, one of which must be present.
+func verifyBody(r *http.Request, body []byte) error {
+	digest, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+	algorithm, err := requestedChecksum(r, "")
+	if err != nil {
+		return err
+	}
+	expected := r.Header.Get(checksumHeader(algorithm))
+	if len(expected) == 0 && r.Trailer != nil {
+		expected = r.Trailer.Get(checksumHeader(algorithm))
+	}
+	if digest == nil && len(expected) == 0 {
+		return errMissingDigest
+	}
+
+	if sum := md5.Sum(body); digest != nil && !bytes.Equal(digest, sum[:]) {
+		return errBadDigest
+	}
+	if len(expected) > 0 {
+		h := newChecksumHash(algorithm)
+		h.Write(body)
+		if expected != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+			return errBadDigest
+		}
+	}
+	return nil
+}
+
+func validChecksumType(algorithm string, typ string) bool {
+	switch typ {
+	case checksumFullObject:
+		return algorithm != "SHA1" && algorithm != "SHA256"
+	case checksumComposite:
+		return algorithm != "CRC64NVME"
+	}
+	return false
+}
+
+func defaultChecksumType(algorithm string) string {
+	if algorithm == "CRC64NVME" {
+		return checksumFullObject
+	}
+	return checksumComposite
+}
+
+func readChecksum(path string) (checksum, bool) {
+	algorithm, err := fs.Getxattr(path, "checksum-algorithm")
+	if err != nil {
+		return checksum{}, false
+	}
+	value, err := fs.Getxattr(path, "checksum")
+	if err != nil {
+		return checksum{}, false
+	}
+	typ, err := fs.Getxattr(path, "checksum-type")
+	if err != nil {
+		typ = checksumFullObject
+	}
+	return checksum{Algorithm: algorithm, Type: typ, Value: value}, true
+}
+
+func (c checksum) write(path string) error {
+	if len(c.Algorithm) == 0 {
+		return nil
+	}
+	for k, v := range map[string]string{
+		"checksum-algorithm": c.Algorithm,
+		"checksum-type":      c.Type,
+		"checksum":           c.Value,
+	} {
+		if err := fs.Setxattr(path, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c checksum) headers(headers map[string]string) {
+	if len(c.Algorithm) == 0 {
+		return
+	}
+	headers[checksumHeader(c.Algorithm)] = c.Value
+	headers["x-amz-checksum-type"] = c.Type
+}
+
+func checksumResponseHeaders(r *http.Request, path string, headers map[string]string) {
+	if !strings.EqualFold(r.Header.Get("X-Amz-Checksum-Mode"), "ENABLED") {
+		return
+	}
+	if c, ok := readChecksum(path); ok {
+		c.headers(headers)
+	}
+}
+
+// fileChecksum computes the full object checksum of the object data at path.
+func fileChecksum(s3 S.Request, path string, key []byte, algorithm string) (checksum, error) {
+	h := newChecksumHash(algorithm)
+	if h == nil {
+		return checksum{}, errInvalidChecksum
+	}
+	file, _, err := openObject(s3, path, key)
+	if err != nil {
+		return checksum{}, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return checksum{}, err
+	}
+	return checksum{
+		Algorithm: algorithm,
+		Type:      checksumFullObject,
+		Value:     base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// combineChecksums derives the checksum of a multipart object from the
+// checksums and sizes of its parts without reading the data again.
+func combineChecksums(algorithm string, typ string, sums []string, sizes []int64) (string, error) {
+	if typ == checksumComposite {
+		h := newChecksumHash(algorithm)
+		for _, sum := range sums {
+			raw, err := base64.StdEncoding.DecodeString(sum)
+			if err != nil {
+				return "", err
+			}
+			h.Write(raw)
+		}
+		return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(h.Sum(nil)), len(sums)), nil
+	}
+
+	var poly uint64
+	var width uint
+	switch algorithm {
+	case "CRC32":
+		poly, width = crc32.IEEE, 32
+	case "CRC32C":
+		poly, width = crc32.Castagnoli, 32
+	case "CRC64NVME":
+		poly, width = crc64NVMEPoly, 64
+	default:
+		return "", errInvalidChecksum
+	}
+
+	var crc uint64
+	for i, sum := range sums {
+		raw, err := base64.StdEncoding.DecodeString(sum)
+		if err != nil || len(raw) != int(width/8) {
+			return "", errInvalidChecksum
+		}
+		part := binary.BigEndian.Uint64(append(make([]byte, 8-len(raw)), raw...))
+		if i == 0 {
+			crc = part
+		} else {
+			crc = crcCombine(crc, part, sizes[i], poly, width)
+		}
+	}
+
+	raw := binary.BigEndian.AppendUint64(nil, crc)
+	return base64.StdEncoding.EncodeToString(raw[8-width/8:]), nil
+}
+
+// crcCombine returns the crc of A+B from crc(A), crc(B) and the length of B
+// for reflected polynomials.
+func crcCombine(crc1 uint64, crc2 uint64, len2 int64, poly uint64, width uint) uint64 {
+	top := uint64(1) << (width - 1)
+	p := top
+	xn := top >> 1
+	for n := uint64(len2) * 8; n != 0; n >>= 1 {
+		if n&1 != 0 {
+			p = crcMultiply(xn, p, poly, top)
+		}
+		xn = crcMultiply(xn, xn, poly, top)
+	}
+	return crcMultiply(p, crc1, poly, top) ^ crc2
+}
+
+func crcMultiply(a uint64, b uint64, poly uint64, top uint64) uint64 {
+	var p uint64
+	for m := top; m != 0; m >>= 1 {
+		if a&m != 0 {
+			p ^= b
+		}
+		if b&1 != 0 {
+			b = b>>1 ^ poly
+		} else {
+			b >>= 1
+		}
+	}
+	return p
+}
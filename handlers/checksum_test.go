@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestChecksumCheckValues(t *testing.T) {
+	expected := map[string]string{
+		"CRC32":     "cbf43926",
+		"CRC32C":    "e3069283",
+		"CRC64NVME": "ae8b14860a799888",
+	}
+
+	for algorithm, value := range expected {
+		h := newChecksumHash(algorithm)
+		h.Write([]byte("123456789"))
+		if result := hex.EncodeToString(h.Sum(nil)); result != value {
+			t.Errorf("%s: expected %s, got %s", algorithm, value, result)
+		}
+	}
+}
+
+func TestCombineChecksums(t *testing.T) {
+	parts := []string{"hello ", strings.Repeat("tri", 1000), "", "world"}
+
+	for _, algorithm := range []string{"CRC32", "CRC32C", "CRC64NVME"} {
+		sums := []string{}
+		sizes := []int64{}
+		for _, part := range parts {
+			h := newChecksumHash(algorithm)
+			h.Write([]byte(part))
+			sums = append(sums, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+			sizes = append(sizes, int64(len(part)))
+		}
+
+		h := newChecksumHash(algorithm)
+		h.Write([]byte(strings.Join(parts, "")))
+		expected := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+		result, err := combineChecksums(algorithm, checksumFullObject, sums, sizes)
+		if err != nil || result != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", algorithm, expected, result, err)
+		}
+	}
+
+	result, err := combineChecksums("SHA256", checksumComposite, []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}, []int64{0})
+	if err != nil || !strings.HasSuffix(result, "-1") {
+		t.Errorf("composite: unexpected %s (%v)", result, err)
+	}
+}
+
+func TestContentMD5(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+	digest := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	for _, c := range []struct {
+		header string
+		code   string
+	}{
+		{digest("other data"), "BadDigest"},
+		{"not base64!", "InvalidDigest"},
+		{base64.StdEncoding.EncodeToString([]byte("short")), "InvalidDigest"},
+	} {
+		if w := do(Put, "PUT", "/bucket/key", "data", "Content-MD5", c.header); w.Code != 400 || !strings.Contains(w.Body.String(), c.code) {
+			t.Errorf("PUT with Content-MD5 %q: %d %s", c.header, w.Code, w.Body)
+		}
+		if w := do(Head, "HEAD", "/bucket/key", ""); w.Code != 404 {
+			t.Errorf("PUT with Content-MD5 %q stored the object: %d", c.header, w.Code)
+		}
+	}
+	if w := do(Put, "PUT", "/bucket/key", "data", "Content-MD5", digest("data")); w.Code != 200 {
+		t.Errorf("PUT with a matching Content-MD5: %d %s", w.Code, w.Body)
+	}
+
+	body := "<Delete><Object><Key>key</Key></Object></Delete>"
+	crc := newChecksumHash("CRC32")
+	crc.Write([]byte(body))
+	for _, c := range []struct {
+		header []string
+		status int
+		code   string
+	}{
+		{nil, 400, "InvalidRequest"},
+		{[]string{"Content-MD5", digest("other")}, 400, "BadDigest"},
+		{[]string{"Content-MD5", "not base64!"}, 400, "InvalidDigest"},
+		{[]string{"X-Amz-Checksum-Crc32", "AAAAAA=="}, 400, "BadDigest"},
+		{[]string{"X-Amz-Checksum-Crc32", base64.StdEncoding.EncodeToString(crc.Sum(nil))}, 200, "<Deleted>"},
+	} {
+		if w := do(Post, "POST", "/bucket?delete", body, c.header...); w.Code != c.status || !strings.Contains(w.Body.String(), c.code) {
+			t.Errorf("DeleteObjects with %v: %d %s", c.header, w.Code, w.Body)
+		}
+	}
+	if w := do(Head, "HEAD", "/bucket/key", ""); w.Code != 404 {
+		t.Errorf("object not deleted: %d", w.Code)
+	}
+}
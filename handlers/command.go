@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+// commands are run by the tri binary in place of the server when their name
+// is given as the first argument.
+var commands = map[string]func(args []string) error{
+	"migrate-metadata": migrateMetadataCommand,
+	"heal":             healCommand,
+	"scrub":            scrubCommand,
+	"fsck":             fsckCommand,
+	"import":           importCommand,
+	"export":           exportCommand,
+	"restore":          restoreCommand,
+}
+
+// backendFlags name the storage backend of the mount a command works on, with
+// the flags of the server.
+type backendFlags struct {
+	mount string
+	opts  BackendOptions
+}
+
+func addBackendFlags(flags *flag.FlagSet, mountUsage string) *backendFlags {
+	b := &backendFlags{opts: BackendOptions{Tiers: S.Tiers{}}}
+	flags.StringVar(&b.mount, "mount", "./mount", mountUsage+", followed by comma separated directories holding a mirror of it")
+	flags.IntVar(&b.opts.WriteQuorum, "write-quorum", 0, "number of mirrored directories a write must reach, 0 for a majority of them")
+	flags.Var(b.opts.Tiers, "tier", "storage class stored outside the mount as CLASS=dir, can be repeated")
+	flags.StringVar(&b.opts.Metadata, "metadata", "xattr", "metadata store of the mount, xattr or sidecar")
+	flags.StringVar(&b.opts.Backend, "backend", "posix", "storage backend of the mount, posix or erasure")
+	flags.Var(&b.opts.Disks, "disk", "directory of a disk the mount is erasure coded across with -backend erasure, in the order given to the server, can be repeated")
+	flags.IntVar(&b.opts.Parity, "parity", 0, "number of disks holding parity shards with -backend erasure, 0 for half of them")
+	return b
+}
+
+// use opens the backend named by the flags for the process once they are
+// parsed.
+func (b *backendFlags) use() error {
+	mounts := strings.Split(b.mount, ",")
+	b.opts.Mount, b.opts.Mirrors = mounts[0], mounts[1:]
+	backend, err := OpenBackend(b.opts)
+	if err != nil {
+		return err
+	}
+	fs.UseBackend(backend)
+	return nil
+}
+
+func RunCommand(name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+	return command(args)
+}
+
+func migrateMetadataCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate-metadata", flag.ExitOnError)
+	mount := flags.String("mount", "./mount", "root directory containing the buckets and files, the server must not be running")
+	tiers := S.Tiers{}
+	flags.Var(tiers, "tier", "storage class stored outside the mount as CLASS=dir, can be repeated")
+	from := flags.String("from", "xattr", "metadata store to read, xattr or sidecar")
+	to := flags.String("to", "sidecar", "metadata store to write, xattr or sidecar")
+	flags.Parse(args)
+
+	source, err := NewMetadataStore(*from, *mount, tiers)
+	if err != nil {
+		return err
+	}
+	target, err := NewMetadataStore(*to, *mount, tiers)
+	if err != nil {
+		return err
+	}
+
+	n, err := MigrateMetadata(*mount, tiers, source, target)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated metadata of %d files from %s to %s", n, *from, *to)
+	return nil
+}
+
+// MigrateMetadata copies the metadata of every file and directory below the
+// mount and the tier roots from one store to another and returns how many
+// carried metadata. Symlinks are skipped, their metadata belongs to the tier
+// data they point to.
+func MigrateMetadata(mount string, tiers S.Tiers, from fs.MetadataStore, to fs.MetadataStore) (int, error) {
+	roots := map[string]string{mount: filepath.Join(mount, Metadata, sidecarDir)}
+	for _, root := range tiers {
+		roots[root] = filepath.Join(root, sidecarDir)
+	}
+
+	migrated := 0
+	for root, sidecars := range roots {
+		err := fs.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == sidecars {
+				return filepath.SkipDir
+			}
+			if entry.Type()&os.ModeSymlink != 0 {
+				return nil
+			}
+
+			keys, err := from.List(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if len(keys) == 0 {
+				return nil
+			}
+			if err := fs.CopyMetadata(to, path, from, path); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			migrated++
+			return nil
+		})
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+func healCommand(args []string) error {
+	flags := flag.NewFlagSet("heal", flag.ExitOnError)
+	mount := flags.String("mount", "./mount", "mount the disks are serving, the server must not be running")
+	disks := S.Disks{}
+	flags.Var(&disks, "disk", "directory of a disk the mount is erasure coded across, in the order given to the server, can be repeated")
+	parity := flags.Int("parity", 0, "number of disks holding parity shards, 0 for half of them")
+	metadata := flags.String("metadata", "xattr", "metadata store of the disks, xattr or sidecar")
+	tiers := S.Tiers{}
+	flags.Var(tiers, "tier", "storage class stored outside the mount as CLASS=dir, can be repeated")
+	flags.Parse(args)
+
+	e, err := NewErasure(*metadata, *mount, disks, *parity, tiers)
+	if err != nil {
+		return err
+	}
+	result, err := e.Heal()
+	if err != nil {
+		return err
+	}
+	for _, path := range result.Lost {
+		log.Printf("Lost %s", path)
+	}
+	log.Printf("Checked %d files, healed %d files and directories", result.Files, result.Healed)
+	if len(result.Lost) > 0 {
+		return fmt.Errorf("%d files have too few intact shards", len(result.Lost))
+	}
+	return nil
+}
+
+func scrubCommand(args []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	backend := addBackendFlags(flags, "root directory containing the buckets and files")
+	keyFile := flags.String("key-file", "", "file holding the master key, to verify objects encrypted with it")
+	rate := flags.Int64("rate", 0, "MiB per second to read at most, 0 for no limit")
+	dryRun := flags.Bool("dry-run", false, "only report corrupt objects instead of moving them to the quarantine directory")
+	skipRecent := flags.Duration("skip-recent", 0, "skip objects verified within this duration, to resume an interrupted scrub")
+	flags.Parse(args)
+
+	err := backend.use()
+	if err != nil {
+		return err
+	}
+
+	s3 := S.Request{Mount: backend.opts.Mount, Tiers: &backend.opts.Tiers}
+	if len(*keyFile) > 0 {
+		if _, err := os.Stat(*keyFile); err != nil {
+			return err
+		}
+		if s3.MasterKey, err = LoadMasterKey(*keyFile); err != nil {
+			return err
+		}
+	}
+
+	result, err := Scrub(s3, *rate<<20, !*dryRun, time.Now().Add(-*skipRecent))
+	if err != nil {
+		return err
+	}
+	for _, path := range result.Corrupt {
+		if target, ok := result.Quarantined[path]; ok {
+			log.Printf("Corrupt %s, moved to %s", path, target)
+		} else {
+			log.Printf("Corrupt %s", path)
+		}
+	}
+	log.Printf("Verified %d objects (%d bytes), %d unverifiable, %d errors", result.Objects, result.Bytes, result.Skipped, result.Errors)
+	if len(result.Corrupt) > 0 {
+		return fmt.Errorf("%d objects are corrupt", len(result.Corrupt))
+	}
+	return nil
+}
+
+func fsckCommand(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	backend := addBackendFlags(flags, "root directory containing the buckets and files")
+	keyFile := flags.String("key-file", "", "file holding the master key, to check objects encrypted with it")
+	dryRun := flags.Bool("dry-run", false, "only report what would be repaired")
+	flags.Parse(args)
+
+	err := backend.use()
+	if err != nil {
+		return err
+	}
+
+	s3 := S.Request{Mount: backend.opts.Mount, Tiers: &backend.opts.Tiers}
+	if len(*keyFile) > 0 {
+		if _, err := os.Stat(*keyFile); err != nil {
+			return err
+		}
+		if s3.MasterKey, err = LoadMasterKey(*keyFile); err != nil {
+			return err
+		}
+	}
+
+	result, err := Fsck(s3, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, path := range result.Adopted {
+		log.Printf("Changed outside tri: %s", path)
+	}
+	for _, path := range result.Uploads {
+		log.Printf("Orphaned upload: %s", path)
+	}
+	for _, conflict := range result.Conflicts {
+		log.Printf("Conflict: %s", conflict)
+	}
+	log.Printf("Checked %d objects, %d changed outside tri, %d stamped, %d orphaned uploads, %d conflicts, %d errors",
+		result.Objects, len(result.Adopted), result.Stamped, len(result.Uploads), len(result.Conflicts), result.Errors)
+	if len(result.Conflicts) > 0 || result.Errors > 0 {
+		return fmt.Errorf("%d conflicts and %d errors need attention", len(result.Conflicts), result.Errors)
+	}
+	return nil
+}
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tri import [flags] DIR BUCKET")
+		flags.PrintDefaults()
+	}
+	backend := addBackendFlags(flags, "root directory containing the buckets and files, on the same file system as DIR")
+	link := flags.Bool("link", false, "hard link the files of DIR into the bucket instead of moving DIR, the links share their xattrs with the originals")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of files read in parallel")
+	progress := flags.Duration("progress", 10*time.Second, "interval progress is logged at, 0 to turn it off")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("import needs a directory and a bucket")
+	}
+	// The tree is moved or linked into the mount directory, so the files
+	// must end up where the posix backend of a single mount keeps them.
+	if backend.opts.Backend != "posix" || strings.Contains(backend.mount, ",") {
+		return fmt.Errorf("import needs the posix backend without mirrors, DIR is moved or linked into the mount directory")
+	}
+	if err := backend.use(); err != nil {
+		return err
+	}
+
+	mount := backend.opts.Mount
+	s3 := S.Request{Mount: mount, Tiers: &backend.opts.Tiers, Bucket: flags.Arg(1), Path: filepath.Join(mount, flags.Arg(1))}
+	result, err := Import(s3, flags.Arg(0), *link, *workers, *progress)
+	log.Printf("Imported %d files (%d bytes), %d read by this run, %d skipped, %d errors",
+		result.Files, result.Bytes, result.Adopted, len(result.Skipped), result.Errors)
+	if err != nil {
+		return err
+	}
+	if result.Errors > 0 {
+		return fmt.Errorf("%d files could not be imported, run the import again to retry them", result.Errors)
+	}
+	return nil
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tri export [flags] BUCKET[/PREFIX]")
+		flags.PrintDefaults()
+	}
+	backend := addBackendFlags(flags, "root directory containing the buckets and files")
+	file := flags.String("file", "-", "tar archive to write, - for the standard output")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("export needs a bucket")
+	}
+
+	if err := backend.use(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *file != "-" {
+		out, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+
+	bucket, prefix, _ := strings.Cut(flags.Arg(0), "/")
+	result, err := Export(S.Request{Mount: backend.opts.Mount, Tiers: &backend.opts.Tiers, Bucket: bucket}, prefix, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d objects, %d versions, %d configurations and %d kms keys (%d bytes)", result.Objects, result.Versions, result.Configs, result.Keys, result.Bytes)
+	return nil
+}
+
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tri restore [flags] [BUCKET]")
+		flags.PrintDefaults()
+	}
+	backend := addBackendFlags(flags, "root directory containing the buckets and files")
+	file := flags.String("file", "-", "tar archive to read, - for the standard input")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("restore takes at most one bucket")
+	}
+
+	if err := backend.use(); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		in, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		r = in
+	}
+
+	result, err := Restore(S.Request{Mount: backend.opts.Mount, Tiers: &backend.opts.Tiers, Bucket: flags.Arg(0)}, r)
+	log.Printf("Restored %d objects, %d versions, %d configurations and %d kms keys (%d bytes), skipped %d locked", result.Objects, result.Versions, result.Configs, result.Keys, result.Bytes, result.Locked)
+	return err
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func TestCommandBackends(t *testing.T) {
+	defer fs.UseBackend(fs.Posix{})
+
+	dir := t.TempDir()
+	disks := S.Disks{filepath.Join(dir, "disk1"), filepath.Join(dir, "disk2"), filepath.Join(dir, "disk3")}
+	for _, c := range []struct {
+		name string
+		opts BackendOptions
+		args []string
+	}{
+		{"mirror", BackendOptions{Backend: "posix", Metadata: "xattr", Mount: filepath.Join(dir, "a"), Mirrors: []string{filepath.Join(dir, "b")}},
+			[]string{"-mount", filepath.Join(dir, "a") + "," + filepath.Join(dir, "b")}},
+		{"erasure", BackendOptions{Backend: "erasure", Metadata: "xattr", Mount: filepath.Join(dir, "erasure"), Disks: disks},
+			[]string{"-mount", filepath.Join(dir, "erasure"), "-backend", "erasure", "-disk", disks[0], "-disk", disks[1], "-disk", disks[2]}},
+	} {
+		b, err := OpenBackend(c.opts)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		fs.UseBackend(b)
+		_, do := newTestApp(t, c.opts.Mount)
+		do(Put, "PUT", "/bucket", "")
+		do(Put, "PUT", "/bucket/key", "data")
+
+		// The command starts on the posix backend, like the tri binary, and
+		// must open the one named by its flags.
+		fs.UseBackend(fs.Posix{})
+		if err := scrubCommand(append(c.args, "-dry-run")); err != nil {
+			t.Errorf("%s: scrub: %s", c.name, err)
+		}
+		fs.UseBackend(fs.Posix{})
+		if err := fsckCommand(append(c.args, "-dry-run")); err != nil {
+			t.Errorf("%s: fsck: %s", c.name, err)
+		}
+		if err := importCommand(append(c.args, t.TempDir(), "imported")); err == nil || !strings.Contains(err.Error(), "posix backend without mirrors") {
+			t.Errorf("%s: import: %v", c.name, err)
+		}
+
+		archive := filepath.Join(t.TempDir(), "bucket.tar")
+		fs.UseBackend(fs.Posix{})
+		if err := exportCommand(append(c.args, "-file", archive, "bucket")); err != nil {
+			t.Fatalf("%s: export: %s", c.name, err)
+		}
+		fs.UseBackend(fs.Posix{})
+		if err := restoreCommand(append(c.args, "-file", archive, "restored")); err != nil {
+			t.Fatalf("%s: restore: %s", c.name, err)
+		}
+		if w := do(Get, "GET", "/restored/key", ""); w.Body.String() != "data" {
+			t.Errorf("%s: restored %d %q", c.name, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	bucketCompression    = "compression"
+	compressionGzip      = "gzip"
+	compressionZstd      = "zstd"
+	compressionBlockSize = 64 * 1024
+)
+
+var errInvalidCompression = errors.New("unsupported compression algorithm, only gzip and zstd are available")
+
+// blockCodec compresses the blocks of an object. Every block starts with
+// header and the length of the compressed data, so readers can skip from
+// block to block, and ends with trailer bytes checking the data.
+type blockCodec struct {
+	header  []byte
+	trailer int64
+	// encode appends the compressed block and its trailer to out.
+	encode func(out *bytes.Buffer, block []byte) error
+	// decode returns the block compressed in data, checked against trailer.
+	decode func(data []byte, trailer []byte) ([]byte, error)
+}
+
+var codecs = map[string]*blockCodec{
+	// Every block is a gzip member whose extra field holds the length, so
+	// the stored data is a valid gzip stream.
+	compressionGzip: {
+		header:  []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 8, 0, 'T', 'R', 4, 0},
+		trailer: 8,
+		encode:  encodeGzip,
+		decode:  decodeGzip,
+	},
+	// Every block is a zstd frame after a skippable frame holding the length,
+	// so the stored data is a valid zstd stream. The frame carries its own
+	// checksum.
+	compressionZstd: {
+		header: []byte{0x50, 0x2a, 0x4d, 0x18, 4, 0, 0, 0},
+		encode: encodeZstd,
+		decode: decodeZstd,
+	},
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(compressionBlockSize))
+)
+
+func encodeGzip(out *bytes.Buffer, block []byte) error {
+	deflate, err := flate.NewWriter(out, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := deflate.Write(block); err != nil {
+		return err
+	}
+	if err := deflate.Close(); err != nil {
+		return err
+	}
+	out.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(block)))
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(block))))
+	return nil
+}
+
+func decodeGzip(data []byte, trailer []byte) ([]byte, error) {
+	block, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil || binary.LittleEndian.Uint32(trailer) != crc32.ChecksumIEEE(block) || binary.LittleEndian.Uint32(trailer[4:]) != uint32(len(block)) {
+		return nil, errCorruptObject
+	}
+	return block, nil
+}
+
+func encodeZstd(out *bytes.Buffer, block []byte) error {
+	out.Write(zstdEncoder.EncodeAll(block, nil))
+	return nil
+}
+
+func decodeZstd(data []byte, _ []byte) ([]byte, error) {
+	block, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, errCorruptObject
+	}
+	return block, nil
+}
+
+func validCompressionConfiguration(_ S.Request, v any) error {
+	config := v.(*S.CompressionConfiguration)
+	if _, ok := codecs[config.Algorithm]; !ok {
+		return errInvalidCompression
+	}
+	if len(config.ContentTypes) == 0 && len(config.Extensions) == 0 {
+		return errors.New("compression configuration requires a content type or extension")
+	}
+	for _, t := range config.ContentTypes {
+		if !strings.Contains(t, "/") {
+			return errors.New("invalid content type " + t)
+		}
+	}
+	for _, ext := range config.Extensions {
+		if !strings.HasPrefix(ext, ".") || strings.Contains(ext, "/") {
+			return errors.New("invalid extension " + ext)
+		}
+	}
+	return nil
+}
+
+// requestedCompression returns the compression of a new object of the
+// bucket, chosen by the content type of the upload or the extension of key.
+func requestedCompression(s3 S.Request, key string, contentType string) string {
+	var config S.CompressionConfiguration
+	if err := readBucketConfig(s3.Mount, s3.Bucket, bucketCompression, &config); err != nil {
+		return ""
+	}
+
+	ext := path.Ext(key)
+	for _, e := range config.Extensions {
+		if len(ext) > 0 && strings.EqualFold(e, ext) {
+			return config.Algorithm
+		}
+	}
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for _, t := range config.ContentTypes {
+		if prefix, found := strings.CutSuffix(t, "/*"); found && strings.HasPrefix(mediatype, prefix+"/") || strings.EqualFold(t, mediatype) || t == "*/*" {
+			return config.Algorithm
+		}
+	}
+	return ""
+}
+
+// storedAsIs reports whether the file at path holds the object data without
+// encryption or compression.
+func storedAsIs(path string) bool {
+	if _, err := fs.Getxattr(path, "sse-key"); err == nil {
+		return false
+	}
+	_, err := fs.Getxattr(path, "compression")
+	return err != nil
+}
+
+// blockWriter compresses object data in blocks of compressionBlockSize, each
+// written by its codec. The blocks can be located without decompressing the
+// ones before.
+type blockWriter struct {
+	dst    io.WriteCloser
+	path   string
+	codec  *blockCodec
+	buf    []byte
+	out    bytes.Buffer
+	blocks int
+	size   int64
+}
+
+// compressFile returns a writer compressing data into dst, which stores the
+// object at path. Closing the writer closes dst and records the size of the
+// uncompressed data.
+func compressFile(dst io.WriteCloser, path string, algorithm string) (io.WriteCloser, error) {
+	if len(algorithm) == 0 {
+		return dst, nil
+	}
+	codec, ok := codecs[algorithm]
+	if !ok {
+		return nil, errInvalidCompression
+	}
+	if err := fs.Setxattr(path, "compression", algorithm); err != nil {
+		return nil, err
+	}
+	return &blockWriter{dst: dst, path: path, codec: codec, buf: make([]byte, 0, compressionBlockSize)}, nil
+}
+
+func (d *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(d.buf) == compressionBlockSize {
+			if err := d.flush(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(d.buf[len(d.buf):compressionBlockSize], p)
+		d.buf = d.buf[:len(d.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (d *blockWriter) flush() error {
+	d.out.Reset()
+	d.out.Write(d.codec.header)
+	d.out.Write(make([]byte, 4))
+	if err := d.codec.encode(&d.out, d.buf); err != nil {
+		return err
+	}
+
+	block := d.out.Bytes()
+	headerSize := len(d.codec.header) + 4
+	binary.LittleEndian.PutUint32(block[len(d.codec.header):], uint32(len(block)-headerSize-int(d.codec.trailer)))
+	if _, err := d.dst.Write(block); err != nil {
+		return err
+	}
+	d.size += int64(len(d.buf))
+	d.blocks++
+	d.buf = d.buf[:0]
+	return nil
+}
+
+func (d *blockWriter) Close() error {
+	if len(d.buf) > 0 || d.blocks == 0 {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+	if err := d.dst.Close(); err != nil {
+		return err
+	}
+	return fs.Setxattr(d.path, "size", strconv.FormatInt(d.size, 10))
+}
+
+// blockReader decompresses an object stored by blockWriter, remembering the
+// offsets of the blocks it has passed to seek back cheaply.
+type blockReader struct {
+	source  io.ReadSeekCloser
+	codec   *blockCodec
+	size    int64
+	offset  int64
+	offsets []int64
+	index   int64
+	block   []byte
+}
+
+func (z *blockReader) Read(p []byte) (int, error) {
+	if z.offset >= z.size {
+		return 0, io.EOF
+	}
+
+	index := z.offset / compressionBlockSize
+	if z.index != index {
+		if err := z.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	start := z.offset - index*compressionBlockSize
+	if start >= int64(len(z.block)) {
+		return 0, errCorruptObject
+	}
+	n := copy(p, z.block[start:])
+	z.offset += int64(n)
+	return n, nil
+}
+
+// readHeader returns the length of the compressed data of the block at
+// offset.
+func (z *blockReader) readHeader(offset int64) (int64, error) {
+	header := make([]byte, len(z.codec.header)+4)
+	if _, err := z.source.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(z.source, header); err != nil {
+		return 0, errCorruptObject
+	}
+	if !bytes.Equal(header[:len(z.codec.header)], z.codec.header) {
+		return 0, errCorruptObject
+	}
+	return int64(binary.LittleEndian.Uint32(header[len(z.codec.header):])), nil
+}
+
+func (z *blockReader) load(index int64) error {
+	if len(z.offsets) == 0 {
+		z.offsets = append(z.offsets, 0)
+	}
+	for int64(len(z.offsets)) <= index {
+		last := z.offsets[len(z.offsets)-1]
+		length, err := z.readHeader(last)
+		if err != nil {
+			return err
+		}
+		z.offsets = append(z.offsets, last+int64(len(z.codec.header))+4+length+z.codec.trailer)
+	}
+
+	length, err := z.readHeader(z.offsets[index])
+	if err != nil {
+		return err
+	}
+	data := make([]byte, length+z.codec.trailer)
+	if _, err := io.ReadFull(z.source, data); err != nil {
+		return errCorruptObject
+	}
+	block, err := z.codec.decode(data[:length], data[length:])
+	if err != nil {
+		return err
+	}
+
+	expected := min(z.size-index*compressionBlockSize, compressionBlockSize)
+	if int64(len(block)) != expected {
+		return errCorruptObject
+	}
+	z.block = block
+	z.index = index
+	return nil
+}
+
+func (z *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.offset
+	case io.SeekEnd:
+		offset += z.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	z.offset = offset
+	return offset, nil
+}
+
+func (z *blockReader) Close() error {
+	return z.source.Close()
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressTestObject(t *testing.T, s3 S.Request, e serverSideEncryption, algorithm string, data []byte) string {
+	file, err := os.Create(filepath.Join(t.TempDir(), "object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer, err := encryptFile(s3, file, e)
+	if err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+	writer, err = compressFile(writer, file.Name(), algorithm)
+	if err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestCompressedObject(t *testing.T) {
+	s3 := S.Request{MasterKey: &[sseKeySize]byte{1, 2, 3}}
+	line := "2026-10-19T06:22:01Z GET /bucket/key 200\n"
+
+	// stream decodes the stored data of an unencrypted object as a whole.
+	stream := map[string]func(io.Reader) ([]byte, error){
+		compressionGzip: func(r io.Reader) ([]byte, error) {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(gz)
+		},
+		compressionZstd: func(r io.Reader) ([]byte, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return io.ReadAll(zr)
+		},
+	}
+
+	for algorithm, decode := range stream {
+		for _, e := range []serverSideEncryption{{}, {Algorithm: sseAES256}} {
+			for _, size := range []int{0, 1, compressionBlockSize, 3*compressionBlockSize + 11} {
+				testCompressedObject(t, s3, e, algorithm, decode, []byte(strings.Repeat(line, size/len(line)+1)[:size]))
+			}
+		}
+	}
+}
+
+func testCompressedObject(t *testing.T, s3 S.Request, e serverSideEncryption, algorithm string, decode func(io.Reader) ([]byte, error), data []byte) {
+	t.Helper()
+	size := len(data)
+	path := compressTestObject(t, s3, e, algorithm, data)
+
+	if stat, _ := os.Stat(path); size > compressionBlockSize && stat.Size() >= int64(size)/2 {
+		t.Errorf("%s size %d: stored %d bytes", algorithm, size, stat.Size())
+	}
+	if len(e.Algorithm) == 0 {
+		file, _ := os.Open(path)
+		if plain, err := decode(file); err != nil || !bytes.Equal(plain, data) {
+			t.Errorf("%s size %d: stored data is not a %s stream: %v", algorithm, size, algorithm, err)
+		}
+		file.Close()
+	}
+
+	reader, n, err := openObject(s3, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(size) {
+		t.Errorf("%s size %d: reported size %d", algorithm, size, n)
+	}
+	plain, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(plain, data) {
+		t.Errorf("%s size %d: data does not round trip: %v", algorithm, size, err)
+	}
+
+	if size > 10 {
+		offset := int64(size - 10)
+		reader.Seek(offset, io.SeekStart)
+		part := make([]byte, 10)
+		if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, data[offset:]) {
+			t.Errorf("%s size %d: range read at %d failed: %v", algorithm, size, offset, err)
+		}
+	}
+	reader.Close()
+}
+
+func TestBucketCompression(t *testing.T) {
+	mount := t.TempDir()
+	_, do := newTestApp(t, mount)
+	do(Put, "PUT", "/bucket", "")
+
+	config := "<CompressionConfiguration><Algorithm>%s</Algorithm><Extension>.log</Extension></CompressionConfiguration>"
+	if w := do(Put, "PUT", "/bucket?compression", fmt.Sprintf(config, "lz4")); w.Code != 400 {
+		t.Errorf("lz4 compression: %d", w.Code)
+	}
+	for _, algorithm := range []string{compressionGzip, compressionZstd} {
+		if w := do(Put, "PUT", "/bucket?compression", fmt.Sprintf(config, algorithm)); w.Code != 200 {
+			t.Fatalf("%s compression: %d %s", algorithm, w.Code, w.Body)
+		}
+		data := strings.Repeat("2026-10-19T06:22:01Z GET /bucket/key 200\n", 5000)
+		key := "/bucket/" + algorithm + ".log"
+		do(Put, "PUT", key, data)
+		if stored, _ := fs.Getxattr(filepath.Join(mount, "bucket", algorithm+".log"), "compression"); stored != algorithm {
+			t.Errorf("%s: stored with compression %q", algorithm, stored)
+		}
+		if w := do(Get, "GET", key, ""); w.Body.String() != data || w.Header().Get("Content-Length") != fmt.Sprint(len(data)) {
+			t.Errorf("%s: GET returned %d bytes, Content-Length %s", algorithm, w.Body.Len(), w.Header().Get("Content-Length"))
+		}
+		if w := do(Get, "GET", key, "", "Range", "bytes=100000-100009"); w.Code != 206 || w.Body.String() != data[100000:100010] {
+			t.Errorf("%s: range read %d %q", algorithm, w.Code, w.Body)
+		}
+	}
+}
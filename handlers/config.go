@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+
+	"github.com/autovia/tri/fs"
+)
+
+const bucketConfigs = "buckets"
+
+func bucketConfigPath(mount string, bucket string, name string) string {
+	return filepath.Join(mount, Metadata, bucketConfigs, bucket, name+".xml")
+}
+
+func readBucketConfig(mount string, bucket string, name string, v any) error {
+	data, err := fs.ReadFile(bucketConfigPath(mount, bucket, name))
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func writeBucketConfig(mount string, bucket string, name string, v any) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	path := bucketConfigPath(mount, bucket, name)
+	if err := fs.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := fs.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, path)
+}
+
+func deleteBucketConfig(mount string, bucket string, name string) error {
+	err := fs.Remove(bucketConfigPath(mount, bucket, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func deleteBucketConfigs(mount string, bucket string) error {
+	return fs.RemoveAll(filepath.Join(mount, Metadata, bucketConfigs, bucket))
+}
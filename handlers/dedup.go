@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const blobsDir = "blobs"
+
+// blobLock serializes reference count updates. It is separate from the key
+// locks, which are held while objects are replaced.
+var blobLock sync.Mutex
+
+func blobPath(mount string, digest string) string {
+	return filepath.Join(mount, Metadata, blobsDir, digest[:2], digest)
+}
+
+// blobDigest returns the digest of the blob referenced by the object at
+// path, if it is deduplicated.
+func blobDigest(path string) (string, bool) {
+	digest, err := fs.Getxattr(path, "blob")
+	if err != nil || len(digest) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// objectDataPath returns the file holding the data of the object at path,
+// which is a blob for deduplicated objects.
+func objectDataPath(mount string, path string) string {
+	if digest, ok := blobDigest(path); ok {
+		return blobPath(mount, digest)
+	}
+	return path
+}
+
+func blobRefs(blob string) (int, error) {
+	if _, err := fs.Stat(blob); err != nil {
+		return 0, err
+	}
+	value, err := fs.Getxattr(blob, "refcount")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func setBlobRefs(blob string, refs int) error {
+	return fs.Setxattr(blob, "refcount", strconv.Itoa(refs))
+}
+
+// fileDigest returns the hex encoded SHA-256 digest of the file at path.
+func fileDigest(path string) (string, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// storeBlob moves the data of the temporary file at tmp, whose SHA-256 digest
+// is given, to the blob store and leaves an empty file referencing the blob
+// in its place. When the blob already exists it only gains a reference.
+func storeBlob(mount string, tmp string, digest string) error {
+	info, err := fs.Stat(tmp)
+	if err != nil {
+		return err
+	}
+
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	blob := blobPath(mount, digest)
+	refs, err := blobRefs(blob)
+	switch {
+	case os.IsNotExist(err):
+		if err := fs.MkdirAll(filepath.Dir(blob), os.ModePerm); err != nil {
+			return err
+		}
+		if err := fs.Rename(tmp, blob); err != nil {
+			return err
+		}
+		file, err := fs.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			fs.RemoveFile(blob)
+			return err
+		}
+		file.Close()
+	case err != nil:
+		return err
+	default:
+		if err := fs.Truncate(tmp, 0); err != nil {
+			return err
+		}
+	}
+
+	if err := setBlobRefs(blob, refs+1); err != nil {
+		return err
+	}
+	if err := fs.Setxattr(tmp, "blob", digest); err != nil {
+		return err
+	}
+	return fs.Setxattr(tmp, "size", strconv.FormatInt(info.Size(), 10))
+}
+
+// dedupFile stores the data of the temporary file at tmp in the blob store.
+func dedupFile(mount string, tmp string) error {
+	digest, err := fileDigest(tmp)
+	if err != nil {
+		return err
+	}
+	return storeBlob(mount, tmp, digest)
+}
+
+// storeBlobData adds a reference to the blob holding data, whose SHA-256
+// digest is given, and writes the blob when it does not exist yet.
+func storeBlobData(mount string, digest string, data []byte) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	blob := blobPath(mount, digest)
+	refs, err := blobRefs(blob)
+	switch {
+	case os.IsNotExist(err):
+		if err := fs.MkdirAll(filepath.Dir(blob), os.ModePerm); err != nil {
+			return err
+		}
+		tmp := blob + ".tmp"
+		if err := fs.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		if err := setBlobRefs(tmp, 1); err != nil {
+			fs.RemoveFile(tmp)
+			return err
+		}
+		return fs.Rename(tmp, blob)
+	case err != nil:
+		return err
+	}
+	return setBlobRefs(blob, refs+1)
+}
+
+// retainBlob adds a reference to an existing blob.
+func retainBlob(mount string, digest string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	blob := blobPath(mount, digest)
+	refs, err := blobRefs(blob)
+	if err != nil {
+		return err
+	}
+	return setBlobRefs(blob, refs+1)
+}
+
+// referenceBlob makes the empty target reference the blob of the
+// deduplicated object at path.
+func referenceBlob(mount string, path string, target string) error {
+	digest, _ := blobDigest(path)
+	size, err := fs.Getxattr(path, "size")
+	if err != nil {
+		return err
+	}
+	if err := retainBlob(mount, digest); err != nil {
+		return err
+	}
+	if err := fs.Setxattr(target, "blob", digest); err != nil {
+		return err
+	}
+	return fs.Setxattr(target, "size", size)
+}
+
+// releaseBlob drops a reference to a blob, removing it with the last one.
+func releaseBlob(mount string, digest string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+
+	blob := blobPath(mount, digest)
+	refs, err := blobRefs(blob)
+	if err != nil {
+		return err
+	}
+	if refs <= 1 {
+		return fs.RemoveFile(blob)
+	}
+	return setBlobRefs(blob, refs-1)
+}
+
+// removeObjectFile removes the file of an object version together with its
+// tier data, releasing the blobs it references.
+func removeObjectFile(s3 S.Request, path string) error {
+	digest, ok := blobDigest(path)
+	layout, stored := partLayoutDigest(path)
+	if data, tiered := tierData(s3, path); tiered {
+		if err := fs.RemoveFile(data); err != nil {
+			return err
+		}
+	}
+	if err := fs.RemoveFile(path); err != nil {
+		return err
+	}
+	if stored {
+		if err := releaseBlob(s3.Mount, layout); err != nil {
+			return err
+		}
+	}
+	if ok {
+		return releaseBlob(s3.Mount, digest)
+	}
+	return nil
+}
+
+// discardTemp removes a temporary file that was not committed.
+func discardTemp(s3 S.Request, tmp string) {
+	if _, err := fs.Lstat(tmp); err == nil {
+		removeObjectFile(s3, tmp)
+	}
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func TestBlobReferences(t *testing.T) {
+	mount := t.TempDir()
+	dir := filepath.Join(mount, Metadata, tmpDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("same payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := dedupFile(mount, path); err != nil {
+			t.Skipf("xattrs not supported: %s", err)
+		}
+		paths = append(paths, path)
+	}
+	copied := filepath.Join(dir, "c")
+	if err := os.WriteFile(copied, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := referenceBlob(mount, paths[0], copied); err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, copied)
+
+	digest, ok := blobDigest(paths[0])
+	if !ok {
+		t.Fatal("object does not reference a blob")
+	}
+	blob := blobPath(mount, digest)
+	if data, err := os.ReadFile(objectDataPath(mount, copied)); err != nil || string(data) != "same payload" {
+		t.Errorf("blob data not reachable: %q %v", data, err)
+	}
+
+	for i, path := range paths {
+		if refs, err := blobRefs(blob); err != nil || refs != len(paths)-i {
+			t.Errorf("expected %d references, got %d %v", len(paths)-i, refs, err)
+		}
+		if err := removeObjectFile(S.Request{Mount: mount}, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("unreferenced blob was not removed: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const maxKeyLength = 1024
+
+// dataMetadata are the metadata keys that describe how the data of an object
+// is stored. They no longer apply once the file was replaced outside tri.
+var dataMetadata = []string{
+	"etag", "size", "parts", "parts-blob", "blob", "compression", "scrubbed",
+	"checksum-algorithm", "checksum-type", "checksum",
+	"sse", "sse-key", "sse-context", "sse-customer", "sse-fingerprint", "sse-kms-key-id",
+}
+
+// FsckResult counts what a check of the mount found. Adopted lists the files
+// that were added or changed outside tri and got their metadata computed.
+type FsckResult struct {
+	Objects   int
+	Stamped   int
+	Adopted   []string
+	Uploads   []string
+	Conflicts []string
+	Errors    int
+}
+
+func stamp(info os.FileInfo) string {
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// stampObject records the size and modification time of the object file at
+// path, which tell later whether it was changed outside tri. The time is set
+// as well so the copies of a mirror agree on it.
+func stampObject(path string) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := fs.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return fs.Setxattr(path, "stamp", stamp(info))
+}
+
+// objectChanged tells whether the object file at path has no ETag or was
+// changed since tri stamped it. Objects written before stamps were recorded
+// count as unchanged as long as they have an ETag.
+func objectChanged(path string) bool {
+	if _, err := fs.Getxattr(path, "etag"); err != nil {
+		return true
+	}
+	recorded, err := fs.Getxattr(path, "stamp")
+	if err != nil {
+		return false
+	}
+	info, err := fs.Stat(path)
+	return err == nil && recorded != stamp(info)
+}
+
+// metadataValid tells whether the metadata of a changed object file still
+// describes its data, as after a copy that did not keep the modification
+// time. Data encrypted with a customer key can not be checked and is kept.
+func metadataValid(s3 S.Request, path string) bool {
+	if _, ok := blobDigest(path); ok {
+		if info, err := fs.Lstat(path); err != nil || info.Size() > 0 {
+			return false
+		}
+	}
+	_, err := verifyObject(s3, path, nil, nil)
+	return err == nil || err == errUnverifiable && !storedAsIs(path)
+}
+
+// adoptObject gives an object file that was added or changed outside tri the
+// metadata of a plain object holding its data, with the content type told by
+// its name or its first bytes, and returns its ETag. Metadata that does not
+// depend on the data, such as tags and the version ID, is kept.
+func adoptObject(s3 S.Request, path string) (string, error) {
+	unlock := lockKey(path)
+	defer unlock()
+
+	if !objectChanged(path) {
+		return fs.Getxattr(path, "etag")
+	}
+	if metadataValid(s3, path) {
+		if err := stampObject(path); err != nil {
+			return "", err
+		}
+		return fs.Getxattr(path, "etag")
+	}
+
+	file, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := md5.New()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	h.Write(head[:n])
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+
+	if digest, ok := blobDigest(path); ok {
+		if err := releaseBlob(s3.Mount, digest); err != nil {
+			return "", err
+		}
+	}
+	if digest, ok := partLayoutDigest(path); ok {
+		if err := releaseBlob(s3.Mount, digest); err != nil {
+			return "", err
+		}
+	}
+	for _, key := range dataMetadata {
+		fs.Removexattr(path, key)
+	}
+	if info, err := fs.Lstat(path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		fs.Removexattr(path, "storage-class")
+	}
+	if err := fs.Setxattr(path, "etag", etag); err != nil {
+		return "", err
+	}
+	if err := fs.Setxattr(path, "content-type", contentType(path, head[:n])); err != nil {
+		return "", err
+	}
+	if err := stampObject(path); err != nil {
+		return "", err
+	}
+	log.Printf("#adoptObject: %s changed outside tri, ETag %s", path, etag)
+	return etag, nil
+}
+
+// objectETag returns the ETag of the object at path, adopting it first when
+// it was added or changed outside tri.
+func objectETag(s3 S.Request, path string) (string, error) {
+	if objectChanged(path) {
+		return adoptObject(s3, path)
+	}
+	return fs.Getxattr(path, "etag")
+}
+
+// orphanedUpload tells why the multipart upload directory at path can no
+// longer be completed, if it can not.
+func orphanedUpload(mount string, path string) string {
+	bucket, err := fs.Getxattr(path, "bucket")
+	if err != nil || len(bucket) == 0 {
+		return "no bucket recorded"
+	}
+	if info, err := fs.Stat(filepath.Join(mount, bucket)); err != nil || !info.IsDir() {
+		return "bucket " + bucket + " is gone"
+	}
+	return ""
+}
+
+// versionConflict reports when the versions kept for a key can not become
+// current again because a directory is in the place of the key or an object
+// in the place of one of its prefixes.
+func versionConflict(mount string, bucket string, key string) string {
+	path := filepath.Join(mount, bucket, key)
+	if info, err := fs.Lstat(path); err == nil && info.IsDir() {
+		return fmt.Sprintf("%s: versions of key %s are shadowed by a directory", bucket, key)
+	}
+	for dir := filepath.Dir(key); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if info, err := fs.Lstat(filepath.Join(mount, bucket, dir)); err == nil && !info.IsDir() {
+			return fmt.Sprintf("%s: versions of key %s are shadowed by object %s", bucket, key, dir)
+		}
+	}
+	return ""
+}
+
+// Fsck checks the buckets below the mount. It adopts the files added or
+// changed outside tri, stamps the objects written before stamps were
+// recorded, removes the multipart uploads whose bucket is gone and reports
+// the files that can not be served as objects. With dryRun nothing is
+// changed.
+func Fsck(s3 S.Request, dryRun bool) (FsckResult, error) {
+	result := FsckResult{}
+	entries, err := fs.ReadDir(s3.Mount)
+	if err != nil {
+		return result, err
+	}
+
+	conflict := func(format string, args ...any) {
+		result.Conflicts = append(result.Conflicts, fmt.Sprintf(format, args...))
+	}
+	for _, entry := range entries {
+		if entry.Name() == Metadata {
+			continue
+		}
+		if !entry.IsDir() {
+			conflict("%s: file outside of a bucket", entry.Name())
+			continue
+		}
+
+		bucket := filepath.Join(s3.Mount, entry.Name())
+		err := fs.WalkDir(bucket, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == bucket {
+				return nil
+			}
+			key, _ := filepath.Rel(bucket, path)
+			if d.IsDir() {
+				return nil
+			}
+			if !utf8.ValidString(key) || len(key) > maxKeyLength {
+				conflict("%s: %q is not a valid key", entry.Name(), key)
+				return nil
+			}
+			switch {
+			case d.Type()&os.ModeSymlink != 0:
+				info, err := fs.Stat(path)
+				if err != nil {
+					conflict("%s: %s links to a missing file", entry.Name(), key)
+					return nil
+				}
+				if info.IsDir() {
+					conflict("%s: %s links to a directory", entry.Name(), key)
+					return nil
+				}
+			case !d.Type().IsRegular():
+				conflict("%s: %s is not a regular file", entry.Name(), key)
+				return nil
+			}
+
+			result.Objects++
+			if !objectChanged(path) {
+				if _, err := fs.Getxattr(path, "stamp"); err == nil || dryRun {
+					return nil
+				}
+				if err := stampObject(path); err != nil {
+					result.Errors++
+					log.Printf("#Fsck: %s: %s", path, err)
+					return nil
+				}
+				result.Stamped++
+				return nil
+			}
+			if !dryRun {
+				if _, err := adoptObject(s3, path); err != nil {
+					result.Errors++
+					log.Printf("#Fsck: %s: %s", path, err)
+					return nil
+				}
+			}
+			result.Adopted = append(result.Adopted, path)
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+
+		dirs, err := fs.ReadDir(filepath.Join(s3.Mount, Metadata, versionsDir, entry.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		for _, dir := range dirs {
+			versions, err := storedVersions(filepath.Join(s3.Mount, Metadata, versionsDir, entry.Name(), dir.Name()))
+			if err != nil {
+				result.Errors++
+				log.Printf("#Fsck: %s", err)
+				continue
+			}
+			if len(versions) == 0 || versions[0].DeleteMarker {
+				continue
+			}
+			if reason := versionConflict(s3.Mount, entry.Name(), versions[0].Key); len(reason) > 0 {
+				conflict("%s", reason)
+			}
+		}
+	}
+
+	uploads, err := fs.ReadDir(filepath.Join(s3.Mount, Metadata))
+	if err != nil && !os.IsNotExist(err) {
+		return result, err
+	}
+	for _, entry := range uploads {
+		if !entry.IsDir() || !validUploadID(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(s3.Mount, Metadata, entry.Name())
+		reason := orphanedUpload(s3.Mount, path)
+		if len(reason) == 0 {
+			continue
+		}
+		if !dryRun {
+			if err := fs.RemoveAll(path); err != nil {
+				result.Errors++
+				log.Printf("#Fsck: %s", err)
+				continue
+			}
+		}
+		log.Printf("#Fsck: orphaned upload %s, %s", entry.Name(), reason)
+		result.Uploads = append(result.Uploads, path)
+	}
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func TestFsck(t *testing.T) {
+	fs.UseBackend(fs.NewMemory())
+	defer fs.UseBackend(fs.Posix{})
+
+	mount := "/memory"
+	_, do := newTestApp(t, mount)
+	write := func(name, data string) {
+		t.Helper()
+		file, err := fs.Create(filepath.Join(mount, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(data))
+		file.Close()
+	}
+	etag := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return "\"" + hex.EncodeToString(sum[:]) + "\""
+	}
+
+	do(Put, "PUT", "/bucket", "")
+	do(Put, "PUT", "/bucket/tracked", "written by tri")
+	do(Put, "PUT", "/bucket/edited", "written by tri")
+	time.Sleep(10 * time.Millisecond)
+	write("bucket/dropped", "dropped by hand")
+	write("bucket/edited", "edited by hand")
+
+	w := do(Get, "GET", "/bucket?list-type=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list objects: %d %s", w.Code, w.Body)
+	}
+	for _, data := range []string{"written by tri", "dropped by hand", "edited by hand"} {
+		if !strings.Contains(w.Body.String(), strings.ReplaceAll(etag(data), "\"", "&#34;")) {
+			t.Errorf("ETag of %q not listed: %s", data, w.Body)
+		}
+	}
+	write("bucket/edited", "edited again")
+	if w := do(Get, "GET", "/bucket/edited", ""); w.Body.String() != "edited again" || w.Header().Get("ETag") != etag("edited again") {
+		t.Errorf("get changed object: %q %s", w.Body, w.Header().Get("ETag"))
+	}
+
+	write("bucket/later", "dropped later")
+	write("stray", "outside of a bucket")
+	upload := filepath.Join(mount, Metadata, generate(uploadIDLength))
+	if err := fs.MkdirAll(upload, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Fsck(S.Request{Mount: mount}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Objects != 4 || len(result.Adopted) != 1 || len(result.Uploads) != 1 || len(result.Conflicts) != 1 {
+		t.Fatalf("unexpected dry run result %+v", result)
+	}
+	if _, err := fs.Stat(upload); err != nil {
+		t.Errorf("dry run removed the upload: %v", err)
+	}
+	if _, err := Fsck(S.Request{Mount: mount}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fs.Getxattr(filepath.Join(mount, "bucket", "later"), "etag"); "\""+got+"\"" != etag("dropped later") {
+		t.Errorf("ETag of dropped file is %q", got)
+	}
+	if _, err := fs.Stat(upload); !os.IsNotExist(err) {
+		t.Errorf("orphaned upload left: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+// ImportResult counts what an import did. Files is the number of objects the
+// bucket holds afterwards, Adopted how many of them got their metadata
+// computed by this run. Skipped lists the files that can not be objects.
+// Symbolic links and special files among them are removed from a moved tree,
+// so that the bucket does not serve what they point to.
+type ImportResult struct {
+	Files   int
+	Adopted int
+	Bytes   int64
+	Skipped []string
+	Errors  int
+}
+
+// contentType tells the content type of an object by the extension of its
+// name and else by its first bytes.
+func contentType(path string, head []byte) string {
+	if typ := mime.TypeByExtension(filepath.Ext(path)); len(typ) > 0 {
+		return typ
+	}
+	return http.DetectContentType(head)
+}
+
+func contentTypeResponseHeaders(path string, headers map[string]string) {
+	if typ, err := fs.Getxattr(path, "content-type"); err == nil {
+		headers["Content-Type"] = typ
+	}
+}
+
+// importTree moves the directory tree at dir into the place of the bucket, or
+// hard links its files there with link. A tree that was moved before is left
+// where it is and links that exist already are kept, so an import can be
+// repeated.
+func importTree(dir string, bucket string, link bool, f func(path string, key string, info os.FileInfo)) error {
+	if !link {
+		_, err := os.Lstat(dir)
+		if info, statErr := os.Stat(bucket); os.IsNotExist(err) && statErr == nil && info.IsDir() {
+			log.Printf("#Import: %s was moved to %s already", dir, bucket)
+		} else if dir != bucket {
+			if _, err := os.Lstat(bucket); err == nil {
+				return fmt.Errorf("bucket %s exists already", bucket)
+			}
+			if err := os.Rename(dir, bucket); err != nil {
+				return err
+			}
+		}
+		dir = bucket
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		key, _ := filepath.Rel(dir, path)
+		target := filepath.Join(bucket, key)
+		if info.IsDir() {
+			if link {
+				return os.MkdirAll(target, os.ModePerm)
+			}
+			return nil
+		}
+		if link && info.Mode().IsRegular() {
+			err := os.Link(path, target)
+			if os.IsExist(err) {
+				if current, statErr := os.Lstat(target); statErr == nil && os.SameFile(info, current) {
+					err = nil
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		f(target, filepath.ToSlash(key), info)
+		return nil
+	})
+}
+
+// Import makes the directory tree at dir a bucket of the mount without
+// copying its data. The tree is moved into the mount, or with link its files
+// are hard linked there and share their metadata with the originals. Symbolic
+// links and special files are not imported. The ETag
+// and content type of the files are computed by workers in parallel, and
+// progress is logged every interval. Files that have them already are not
+// read again, so an interrupted import carries on where it stopped when it is
+// run again.
+func Import(s3 S.Request, dir string, link bool, workers int, interval time.Duration) (ImportResult, error) {
+	result := ImportResult{}
+	if len(s3.Bucket) == 0 || s3.Bucket == Metadata || strings.ContainsAny(s3.Bucket, `/\`) {
+		return result, fmt.Errorf("invalid bucket name %q", s3.Bucket)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return result, err
+	}
+	if err := fs.MkdirAll(filepath.Join(s3.Mount, Metadata), os.ModePerm); err != nil {
+		return result, err
+	}
+	bucket := filepath.Join(s3.Mount, s3.Bucket)
+	if dir == bucket && link {
+		return result, errors.New("the directory is the bucket already, it can not be linked")
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	paths := make(chan string, workers)
+	start := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				changed := objectChanged(path)
+				var err error
+				if changed {
+					_, err = adoptObject(s3, path)
+				}
+				info, statErr := fs.Stat(path)
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					result.Errors++
+					log.Printf("#Import: %s: %s", path, err)
+				case statErr == nil:
+					result.Files++
+					result.Bytes += info.Size()
+					if changed {
+						result.Adopted++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	done := make(chan bool)
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					mu.Lock()
+					elapsed := time.Since(start)
+					log.Printf("#Import: %d files (%d bytes) imported in %s, %.1f MiB/s, %d errors",
+						result.Files, result.Bytes, elapsed.Round(time.Second), float64(result.Bytes)/(1<<20)/elapsed.Seconds(), result.Errors)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	err = importTree(dir, bucket, link, func(path string, key string, info os.FileInfo) {
+		reason := ""
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			reason = "symbolic link"
+		case !info.Mode().IsRegular():
+			reason = "not a regular file"
+		case !utf8.ValidString(key) || len(key) > maxKeyLength:
+			reason = "not a valid key"
+		}
+		if len(reason) > 0 {
+			log.Printf("#Import: skipped %s, %s", path, reason)
+			if !link && !info.Mode().IsRegular() {
+				if err := os.Remove(path); err != nil {
+					log.Printf("#Import: %s: %s", path, err)
+				}
+			}
+			mu.Lock()
+			result.Skipped = append(result.Skipped, path)
+			mu.Unlock()
+			return
+		}
+		paths <- path
+	})
+	close(paths)
+	wg.Wait()
+	close(done)
+	return result, err
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func TestImport(t *testing.T) {
+	root := t.TempDir()
+	mount, dir := filepath.Join(root, "mount"), filepath.Join(root, "tree")
+	files := map[string]string{
+		"index.html":    "<html></html>",
+		"docs/readme":   "plain text",
+		"docs/a/b/data": "\x00\x01\x02",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("index.html", filepath.Join(dir, "link"))
+	if err := os.MkdirAll(mount, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Setxattr(mount, "probe", "1"); err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+
+	check := func(bucket string) {
+		t.Helper()
+		for name, data := range files {
+			path := filepath.Join(mount, bucket, name)
+			sum := md5.Sum([]byte(data))
+			if etag, _ := fs.Getxattr(path, "etag"); etag != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s has ETag %q", path, etag)
+			}
+		}
+		if typ, _ := fs.Getxattr(filepath.Join(mount, bucket, "index.html"), "content-type"); typ != "text/html; charset=utf-8" {
+			t.Errorf("content type %q", typ)
+		}
+		if typ, _ := fs.Getxattr(filepath.Join(mount, bucket, "docs/a/b/data"), "content-type"); typ != "application/octet-stream" {
+			t.Errorf("content type %q", typ)
+		}
+	}
+
+	linked := S.Request{Mount: mount, Bucket: "linked"}
+	result, err := Import(linked, dir, true, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 3 || result.Adopted != 3 || len(result.Skipped) != 1 || result.Errors != 0 {
+		t.Fatalf("unexpected import result %+v", result)
+	}
+	check("linked")
+	if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+		t.Errorf("linked tree changed: %v", err)
+	}
+	if result, err := Import(linked, dir, true, 2, 0); err != nil || result.Files != 3 || result.Adopted != 0 {
+		t.Errorf("repeated import read files again: %+v %v", result, err)
+	}
+
+	moved := S.Request{Mount: mount, Bucket: "moved"}
+	result, err = Import(moved, dir, false, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 3 || len(result.Skipped) != 1 || result.Errors != 0 {
+		t.Fatalf("unexpected import result %+v", result)
+	}
+	check("moved")
+	if _, err := os.Lstat(filepath.Join(mount, "moved", "link")); !os.IsNotExist(err) {
+		t.Errorf("symbolic link left in the bucket: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("tree left in place: %v", err)
+	}
+	if result, err := Import(moved, dir, false, 1, 0); err != nil || result.Files != 3 || result.Adopted != 0 || len(result.Skipped) != 0 {
+		t.Errorf("repeated import read files again: %+v %v", result, err)
+	}
+}
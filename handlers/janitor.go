@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+// Janitor aborts stale uploads and applies the lifecycle rules every janitor
+// interval until ctx is done.
+func Janitor(ctx context.Context, app *S.App) {
+	if *app.JanitorInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*app.JanitorInterval)
+	defer ticker.Stop()
+	for {
+		CleanupUploads(*app.Mount, *app.UploadMaxAge, time.Now())
+		ApplyLifecycle(*app.Mount, app.Tiers, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ResyncMirror resyncs the copies of a mirrored mount whenever one falls
+// behind or diverges, and every interval to pick up stale mounts that can be
+// reached again, until ctx is done.
+func ResyncMirror(ctx context.Context, m *fs.Mirror, interval time.Duration) {
+	for {
+		for _, mount := range m.Stale() {
+			log.Printf("#ResyncMirror: %s is stale", mount)
+		}
+		n, err := m.Resync()
+		if err != nil {
+			log.Printf("#ResyncMirror: %s", err)
+		}
+		if n > 0 {
+			log.Printf("#ResyncMirror: resynced %d files and directories", n)
+		}
+		select {
+		case <-m.Changed():
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func CleanupUploads(mount string, maxAge time.Duration, now time.Time) {
+	entries, err := fs.ReadDir(filepath.Join(mount, Metadata))
+	if err != nil {
+		log.Printf("#Janitor: %s", err)
+		return
+	}
+
+	lifecycles := make(map[string]*S.LifecycleConfiguration)
+	var uploads int
+	var reclaimed int64
+	for _, entry := range entries {
+		if !entry.IsDir() || !validUploadID(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(mount, Metadata, entry.Name())
+		bucket, key, initiated, err := uploadInfo(path)
+		if err != nil {
+			log.Printf("#Janitor: %s", err)
+			continue
+		}
+
+		if _, ok := lifecycles[bucket]; !ok && len(bucket) > 0 {
+			var config S.LifecycleConfiguration
+			if err := readBucketConfig(mount, bucket, lifecycleConfig, &config); err == nil {
+				lifecycles[bucket] = &config
+			} else {
+				lifecycles[bucket] = nil
+			}
+		}
+
+		reason := ""
+		if maxAge > 0 && now.Sub(initiated) > maxAge {
+			reason = "older than " + maxAge.String()
+		}
+		if config := lifecycles[bucket]; config != nil && len(reason) == 0 {
+			for _, rule := range config.Rules {
+				abort := rule.AbortIncompleteMultipartUpload
+				if abort == nil || !ruleMatches(rule, key) {
+					continue
+				}
+				if now.Sub(initiated) > time.Duration(abort.DaysAfterInitiation)*24*time.Hour {
+					reason = "lifecycle rule " + rule.ID
+					break
+				}
+			}
+		}
+		if len(reason) == 0 {
+			continue
+		}
+
+		size := dirSize(path)
+		if err := fs.RemoveAll(path); err != nil {
+			log.Printf("#Janitor: %s", err)
+			continue
+		}
+		uploads++
+		reclaimed += size
+		log.Printf("#Janitor: aborted upload %s of %s/%s (%s), reclaimed %d bytes", entry.Name(), bucket, key, reason, size)
+	}
+
+	if uploads > 0 {
+		log.Printf("#Janitor: aborted %d uploads, reclaimed %d bytes", uploads, reclaimed)
+	}
+}
+
+// ApplyLifecycle expires current and noncurrent object versions and orphaned
+// delete markers and moves objects between storage classes according to the
+// lifecycle configuration of each bucket.
+func ApplyLifecycle(mount string, tiers S.Tiers, now time.Time) {
+	entries, err := fs.ReadDir(mount)
+	if err != nil {
+		log.Printf("#Janitor: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == Metadata {
+			continue
+		}
+
+		var config S.LifecycleConfiguration
+		if err := readBucketConfig(mount, entry.Name(), lifecycleConfig, &config); err != nil {
+			continue
+		}
+
+		keys, err := versionedKeys(mount, entry.Name(), "")
+		if err != nil {
+			log.Printf("#Janitor: %s", err)
+			continue
+		}
+
+		var expired int
+		for _, key := range keys {
+			s3 := objectRequest(S.Request{Mount: mount, Bucket: entry.Name(), Tiers: &tiers}, key)
+			expired += applyLifecycleRules(s3, config, now)
+		}
+		if expired > 0 {
+			log.Printf("#Janitor: expired %d versions in bucket %s", expired, entry.Name())
+		}
+	}
+}
+
+func applyLifecycleRules(s3 S.Request, config S.LifecycleConfiguration, now time.Time) int {
+	versions, err := objectVersions(s3)
+	if err != nil || len(versions) == 0 {
+		return 0
+	}
+
+	var expired int
+	expire := func(versionID string, reason string) bool {
+		if _, err := deleteObject(s3, versionID); err != nil {
+			log.Printf("#Janitor: can not expire %s/%s (%s): %s", s3.Bucket, s3.Key, reason, err)
+			return false
+		}
+		log.Printf("#Janitor: expired %s/%s version %q (%s)", s3.Bucket, s3.Key, versionID, reason)
+		expired++
+		return true
+	}
+
+	if latest := versions[0]; !latest.DeleteMarker {
+		tags := readTags(latest.Path)
+		for _, rule := range config.Rules {
+			if !ruleMatchesObject(rule, s3.Key, objectSize(latest.Path, latest.Info), tags) {
+				continue
+			}
+			if expires, ok := expirationTime(rule, latest.Info.ModTime()); ok && !now.Before(expires) {
+				if expire("", "rule "+rule.ID) {
+					versions, _ = objectVersions(s3)
+				}
+				break
+			}
+		}
+	}
+
+	if len(versions) == 0 {
+		return expired
+	}
+	if latest := versions[0]; !latest.DeleteMarker && latest.Path == s3.Path {
+		class := transitionClass(config, s3.Key, latest.Path, latest.Info, readTags(latest.Path), now)
+		if len(class) > 0 && class != objectStorageClass(latest.Path) {
+			if _, err := storageClass(s3, class); err != nil {
+				log.Printf("#Janitor: can not move %s/%s to %s: %s", s3.Bucket, s3.Key, class, err)
+			} else if err := transitionObject(s3, class); err != nil {
+				log.Printf("#Janitor: can not move %s/%s to %s: %s", s3.Bucket, s3.Key, class, err)
+			} else {
+				log.Printf("#Janitor: moved %s/%s to %s", s3.Bucket, s3.Key, class)
+			}
+		}
+	}
+
+	for i := len(versions) - 1; i > 0; i-- {
+		v := versions[i]
+		since := versions[i-1].Info.ModTime()
+		tags := readTags(v.Path)
+		for _, rule := range config.Rules {
+			nve := rule.NoncurrentVersionExpiration
+			if nve == nil || nve.NewerNoncurrentVersions != nil && i-1 < *nve.NewerNoncurrentVersions || !ruleMatchesObject(rule, s3.Key, objectSize(v.Path, v.Info), tags) {
+				continue
+			}
+			if !now.Before(midnightAfter(since.AddDate(0, 0, nve.NoncurrentDays))) {
+				expire(v.ID, "noncurrent, rule "+rule.ID)
+				break
+			}
+		}
+	}
+
+	versions, _ = objectVersions(s3)
+	if len(versions) == 1 && versions[0].DeleteMarker {
+		for _, rule := range config.Rules {
+			exp := rule.Expiration
+			if exp == nil || exp.ExpiredObjectDeleteMarker == nil || !*exp.ExpiredObjectDeleteMarker || !ruleMatches(rule, s3.Key) {
+				continue
+			}
+			expire(versions[0].ID, "expired delete marker, rule "+rule.ID)
+			break
+		}
+	}
+
+	return expired
+}
+
+func uploadInfo(path string) (string, string, time.Time, error) {
+	stat, err := fs.Stat(path)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	bucket, _ := fs.Getxattr(path, "bucket")
+	key, _ := fs.Getxattr(path, "key")
+	initiated := stat.ModTime()
+	if value, err := fs.Getxattr(path, "initiated"); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			initiated = t
+		}
+	}
+
+	return bucket, key, initiated, nil
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	fs.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func TestCleanupUploads(t *testing.T) {
+	mount := t.TempDir()
+	_, do := newTestApp(t, mount)
+	initiate := func(target string) string {
+		t.Helper()
+		initiated := S.InitiateMultipartUploadResponse{}
+		if err := xml.Unmarshal(do(Post, "POST", target+"?uploads", "").Body.Bytes(), &initiated); err != nil {
+			t.Fatal(err)
+		}
+		return initiated.UploadID
+	}
+	exists := func(id string) bool {
+		_, err := os.Stat(filepath.Join(mount, Metadata, id))
+		return err == nil
+	}
+
+	do(Put, "PUT", "/plain", "")
+	do(Put, "PUT", "/ruled", "")
+	do(Put, "PUT", "/ruled?lifecycle", `<LifecycleConfiguration><Rule><ID>abort</ID><Status>Enabled</Status><Filter><Prefix>tmp/</Prefix></Filter>
+		<AbortIncompleteMultipartUpload><DaysAfterInitiation>1</DaysAfterInitiation></AbortIncompleteMultipartUpload></Rule></LifecycleConfiguration>`)
+	plain := initiate("/plain/key")
+	ruled := initiate("/ruled/tmp/key")
+	kept := initiate("/ruled/key")
+
+	now := time.Now()
+	CleanupUploads(mount, 0, now.Add(time.Hour))
+	if !exists(plain) || !exists(ruled) || !exists(kept) {
+		t.Fatal("uploads aborted early")
+	}
+	CleanupUploads(mount, 0, now.Add(25*time.Hour))
+	if !exists(plain) || exists(ruled) || !exists(kept) {
+		t.Error("lifecycle rule not applied to uploads")
+	}
+	CleanupUploads(mount, 48*time.Hour, now.Add(25*time.Hour))
+	if !exists(plain) || !exists(kept) {
+		t.Error("uploads younger than the maximum age aborted")
+	}
+	CleanupUploads(mount, 48*time.Hour, now.Add(49*time.Hour))
+	if exists(plain) || exists(kept) {
+		t.Error("uploads older than the maximum age kept")
+	}
+}
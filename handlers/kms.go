@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const (
+	kmsDir          = "kms"
+	kmsAccount      = "000000000000"
+	kmsDefaultAlias = "alias/aws/s3"
+	kmsKeyIDLength  = 36
+	kmsBlobHeader   = kmsKeyIDLength + 4 + sseNonceSize
+)
+
+var errKMSNotFound = errors.New("kms key does not exist")
+var errKMSDisabled = errors.New("kms key is disabled")
+var errKMSInvalidCiphertext = errors.New("ciphertext or encryption context is invalid")
+
+// KMS serves the subset of the AWS KMS JSON API that the local key
+// management service supports, selected by the X-Amz-Target header.
+func KMS(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#KMS: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if s3.MasterKey == nil {
+		return S.RespondJSONError(w, http.StatusBadRequest, "UnsupportedOperationException", errEncryptionNotConfigured)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var req S.KMSRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return S.RespondJSONError(w, http.StatusBadRequest, "SerializationException", err)
+		}
+	}
+
+	var result S.KMSResponse
+	var err error
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.") {
+	case "CreateKey":
+		if len(req.KeySpec) > 0 && req.KeySpec != "SYMMETRIC_DEFAULT" {
+			return S.RespondJSONError(w, http.StatusBadRequest, "UnsupportedOperationException", errors.New("only SYMMETRIC_DEFAULT keys are supported"))
+		}
+		var key S.KMSKey
+		key, err = createKMSKey(s3, req.Description, "")
+		result.KeyMetadata = kmsKeyMetadata(s3, key)
+	case "DescribeKey":
+		var key S.KMSKey
+		key, err = readKMSKey(s3, req.KeyId)
+		result.KeyMetadata = kmsKeyMetadata(s3, key)
+	case "ListKeys":
+		var keys []S.KMSKey
+		keys, err = listKMSKeys(s3)
+		for _, key := range keys {
+			result.Keys = append(result.Keys, S.KMSKeyListEntry{KeyId: key.KeyID, KeyArn: kmsARN(s3, key.KeyID)})
+		}
+		truncated := false
+		result.Truncated = &truncated
+	case "EnableKey", "DisableKey":
+		err = updateKMSKey(s3, req.KeyId, func(key *S.KMSKey) error {
+			key.Enabled = strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".EnableKey")
+			return nil
+		})
+	case "RotateKeyOnDemand":
+		err = updateKMSKey(s3, req.KeyId, func(key *S.KMSKey) error {
+			if !key.Enabled {
+				return errKMSDisabled
+			}
+			result.KeyId = key.KeyID
+			return addKMSKeyVersion(s3, key)
+		})
+	case "GenerateDataKey":
+		if req.NumberOfBytes == 0 {
+			req.NumberOfBytes = sseKeySize
+		}
+		if req.NumberOfBytes != sseKeySize || (len(req.KeySpec) > 0 && req.KeySpec != "AES_256") {
+			return S.RespondJSONError(w, http.StatusBadRequest, "ValidationException", errors.New("only 256 bit data keys are supported"))
+		}
+		var keyID string
+		result.Plaintext, result.CiphertextBlob, keyID, err = kmsGenerateDataKey(s3, req.KeyId, req.EncryptionContext)
+		result.KeyId = kmsARN(s3, keyID)
+	case "Decrypt":
+		var keyID string
+		result.Plaintext, keyID, err = kmsDecrypt(s3, req.CiphertextBlob, req.EncryptionContext)
+		if err == nil && len(req.KeyId) > 0 {
+			if key, e := readKMSKey(s3, req.KeyId); e != nil || key.KeyID != keyID {
+				err = errKMSInvalidCiphertext
+			}
+		}
+		result.KeyId = kmsARN(s3, keyID)
+		result.EncryptionAlgorithm = "SYMMETRIC_DEFAULT"
+	default:
+		return S.RespondJSONError(w, http.StatusBadRequest, "UnknownOperationException", nil)
+	}
+
+	switch err {
+	case nil:
+		return S.RespondJSON(w, http.StatusOK, result)
+	case errKMSNotFound:
+		return S.RespondJSONError(w, http.StatusBadRequest, "NotFoundException", err)
+	case errKMSDisabled:
+		return S.RespondJSONError(w, http.StatusBadRequest, "DisabledException", err)
+	case errKMSInvalidCiphertext:
+		return S.RespondJSONError(w, http.StatusBadRequest, "InvalidCiphertextException", err)
+	}
+	return S.RespondJSONError(w, http.StatusInternalServerError, "KMSInternalException", err)
+}
+
+func kmsKeyPath(mount string, id string) string {
+	return filepath.Join(mount, Metadata, kmsDir, id+".xml")
+}
+
+func kmsARN(s3 S.Request, id string) string {
+	return fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", s3.Region, kmsAccount, id)
+}
+
+func kmsKeyMetadata(s3 S.Request, key S.KMSKey) *S.KMSKeyMetadata {
+	created, _ := time.Parse(time.RFC3339, key.CreationDate)
+	state := "Enabled"
+	if !key.Enabled {
+		state = "Disabled"
+	}
+	return &S.KMSKeyMetadata{
+		AWSAccountId:          kmsAccount,
+		KeyId:                 key.KeyID,
+		Arn:                   kmsARN(s3, key.KeyID),
+		CreationDate:          float64(created.Unix()),
+		Enabled:               key.Enabled,
+		Description:           key.Description,
+		KeyState:              state,
+		KeyUsage:              "ENCRYPT_DECRYPT",
+		KeySpec:               "SYMMETRIC_DEFAULT",
+		CustomerMasterKeySpec: "SYMMETRIC_DEFAULT",
+		KeyManager:            "CUSTOMER",
+		Origin:                "AWS_KMS",
+		EncryptionAlgorithms:  []string{"SYMMETRIC_DEFAULT"},
+	}
+}
+
+func newKMSKeyID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func createKMSKey(s3 S.Request, description string, alias string) (S.KMSKey, error) {
+	key := S.KMSKey{
+		KeyID:        newKMSKeyID(),
+		Alias:        alias,
+		Description:  description,
+		Enabled:      true,
+		CreationDate: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := addKMSKeyVersion(s3, &key); err != nil {
+		return S.KMSKey{}, err
+	}
+	return key, writeKMSKey(s3.Mount, key)
+}
+
+func addKMSKeyVersion(s3 S.Request, key *S.KMSKey) error {
+	material := make([]byte, sseKeySize)
+	if _, err := rand.Read(material); err != nil {
+		return err
+	}
+	sealed, err := wrapKey(s3.MasterKey[:], material)
+	if err != nil {
+		return err
+	}
+	key.Versions = append(key.Versions, S.KMSKeyVersion{
+		Number:       len(key.Versions) + 1,
+		Material:     sealed,
+		CreationDate: time.Now().UTC().Format(time.RFC3339),
+	})
+	return nil
+}
+
+func writeKMSKey(mount string, key S.KMSKey) error {
+	data, err := xml.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	path := kmsKeyPath(mount, key.KeyID)
+	if err := fs.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := fs.WriteFile(tmp, data, masterKeyFileMode); err != nil {
+		return err
+	}
+	return fs.Rename(tmp, path)
+}
+
+func listKMSKeys(s3 S.Request) ([]S.KMSKey, error) {
+	entries, err := fs.ReadDir(filepath.Join(s3.Mount, Metadata, kmsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []S.KMSKey{}
+	for _, entry := range entries {
+		id, found := strings.CutSuffix(entry.Name(), ".xml")
+		if !found {
+			continue
+		}
+		key, err := readKMSKey(s3, id)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreationDate < keys[j].CreationDate })
+	return keys, nil
+}
+
+// readKMSKey resolves a key id, key ARN or alias to a key.
+func readKMSKey(s3 S.Request, ref string) (S.KMSKey, error) {
+	if strings.HasPrefix(ref, "alias/") || strings.Contains(ref, ":alias/") {
+		alias := ref[strings.Index(ref, "alias/"):]
+		keys, err := listKMSKeys(s3)
+		if err != nil {
+			return S.KMSKey{}, err
+		}
+		for _, key := range keys {
+			if key.Alias == alias {
+				return key, nil
+			}
+		}
+		return S.KMSKey{}, errKMSNotFound
+	}
+
+	_, id, found := strings.Cut(ref, ":key/")
+	if !found {
+		id = ref
+	}
+	if len(id) != kmsKeyIDLength || strings.ContainsAny(id, "/.") {
+		return S.KMSKey{}, errKMSNotFound
+	}
+	data, err := fs.ReadFile(kmsKeyPath(s3.Mount, id))
+	if os.IsNotExist(err) {
+		return S.KMSKey{}, errKMSNotFound
+	}
+	if err != nil {
+		return S.KMSKey{}, err
+	}
+
+	var key S.KMSKey
+	return key, xml.Unmarshal(data, &key)
+}
+
+func updateKMSKey(s3 S.Request, ref string, update func(*S.KMSKey) error) error {
+	unlock := lockKey(filepath.Join(s3.Mount, Metadata, kmsDir))
+	defer unlock()
+
+	key, err := readKMSKey(s3, ref)
+	if err != nil {
+		return err
+	}
+	if err := update(&key); err != nil {
+		return err
+	}
+	return writeKMSKey(s3.Mount, key)
+}
+
+// defaultKMSKey returns the key used for SSE-KMS without a key id, creating
+// it on first use.
+func defaultKMSKey(s3 S.Request) (S.KMSKey, error) {
+	unlock := lockKey(filepath.Join(s3.Mount, Metadata, kmsDir))
+	defer unlock()
+
+	key, err := readKMSKey(s3, kmsDefaultAlias)
+	if err == errKMSNotFound {
+		return createKMSKey(s3, "Default key for SSE-KMS", kmsDefaultAlias)
+	}
+	return key, err
+}
+
+func kmsKeyMaterial(s3 S.Request, key S.KMSKey, version int) ([]byte, error) {
+	if !key.Enabled {
+		return nil, errKMSDisabled
+	}
+	if version < 1 || version > len(key.Versions) {
+		return nil, errKMSInvalidCiphertext
+	}
+	return unwrapKey(s3.MasterKey[:], key.Versions[version-1].Material)
+}
+
+// kmsGenerateDataKey returns a new data key and its ciphertext blob, which
+// holds the key id and version followed by the data key sealed with the key
+// material and bound to the encryption context.
+func kmsGenerateDataKey(s3 S.Request, ref string, context map[string]string) ([]byte, []byte, string, error) {
+	key, err := readKMSKey(s3, ref)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	version := len(key.Versions)
+	material, err := kmsKeyMaterial(s3, key, version)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	gcm, err := newGCM(material)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	plaintext := make([]byte, sseKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, "", err
+	}
+	blob := append([]byte(key.KeyID), binary.BigEndian.AppendUint32(nil, uint32(version))...)
+	nonce := make([]byte, sseNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, "", err
+	}
+	blob = append(blob, nonce...)
+	return plaintext, gcm.Seal(blob, nonce, plaintext, encryptionContext(context)), key.KeyID, nil
+}
+
+func kmsDecrypt(s3 S.Request, blob []byte, context map[string]string) ([]byte, string, error) {
+	if len(blob) < kmsBlobHeader {
+		return nil, "", errKMSInvalidCiphertext
+	}
+	key, err := readKMSKey(s3, string(blob[:kmsKeyIDLength]))
+	if err == errKMSNotFound {
+		return nil, "", errKMSInvalidCiphertext
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	version := binary.BigEndian.Uint32(blob[kmsKeyIDLength:])
+	material, err := kmsKeyMaterial(s3, key, int(version))
+	if err != nil {
+		return nil, key.KeyID, err
+	}
+	gcm, err := newGCM(material)
+	if err != nil {
+		return nil, key.KeyID, err
+	}
+
+	nonce := blob[kmsKeyIDLength+4 : kmsBlobHeader]
+	plaintext, err := gcm.Open(nil, nonce, blob[kmsBlobHeader:], encryptionContext(context))
+	if err != nil {
+		return nil, key.KeyID, errKMSInvalidCiphertext
+	}
+	return plaintext, key.KeyID, nil
+}
+
+// encryptionContext serializes a context with sorted keys, so that the same
+// pairs always authenticate the same way.
+func encryptionContext(context map[string]string) []byte {
+	if len(context) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(context)
+	return data
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const lifecycleConfig = "lifecycle"
+
+func GetBucketLifecycleConfiguration(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetBucketLifecycleConfiguration: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	var config S.LifecycleConfiguration
+	if err := readBucketConfig(s3.Mount, s3.Bucket, lifecycleConfig, &config); err != nil {
+		if os.IsNotExist(err) {
+			return S.RespondError(w, http.StatusNotFound, "NoSuchLifecycleConfiguration", err, s3.Bucket)
+		}
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.RespondXML(w, http.StatusOK, config)
+}
+
+func PutBucketLifecycleConfiguration(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutBucketLifecycleConfiguration: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var config S.LifecycleConfiguration
+	if err := xml.Unmarshal(body, &config); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Bucket)
+	}
+
+	if err := validLifecycle(s3, config); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Bucket)
+	}
+
+	if err := writeBucketConfig(s3.Mount, s3.Bucket, lifecycleConfig, config); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func DeleteBucketLifecycle(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#DeleteBucketLifecycle: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if err := deleteBucketConfig(s3.Mount, s3.Bucket, lifecycleConfig); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusNoContent, nil, nil)
+}
+
+func validLifecycle(s3 S.Request, config S.LifecycleConfiguration) error {
+	if len(config.Rules) == 0 || len(config.Rules) > 1000 {
+		return errors.New("lifecycle configuration needs between 1 and 1000 rules")
+	}
+
+	ids := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if rule.Status != "Enabled" && rule.Status != "Disabled" {
+			return errors.New("rule status must be Enabled or Disabled")
+		}
+		if len(rule.ID) > 255 || (len(rule.ID) > 0 && ids[rule.ID]) {
+			return errors.New("rule id must be unique and at most 255 characters")
+		}
+		ids[rule.ID] = true
+
+		if rule.Prefix != nil && rule.Filter != nil {
+			return errors.New("rule can not have both Prefix and Filter")
+		}
+		if filter := rule.Filter; filter != nil {
+			conditions := 0
+			for _, set := range []bool{filter.Prefix != nil, filter.Tag != nil, filter.ObjectSizeGreaterThan != nil, filter.ObjectSizeLessThan != nil, filter.And != nil} {
+				if set {
+					conditions++
+				}
+			}
+			if conditions > 1 {
+				return errors.New("Filter must contain only one of Prefix, Tag, ObjectSizeGreaterThan, ObjectSizeLessThan or And")
+			}
+		}
+		f := ruleFilter(rule)
+		if err := validTags(f.tags, maxObjectTags); err != nil {
+			return err
+		}
+		if f.greaterThan != nil && f.lessThan != nil && *f.greaterThan >= *f.lessThan {
+			return errors.New("ObjectSizeGreaterThan must be less than ObjectSizeLessThan")
+		}
+
+		if rule.Expiration == nil && len(rule.Transitions) == 0 && rule.NoncurrentVersionExpiration == nil && rule.AbortIncompleteMultipartUpload == nil {
+			return errors.New("rule needs at least one action")
+		}
+		if exp := rule.Expiration; exp != nil {
+			actions := 0
+			for _, set := range []bool{exp.Days != 0, len(exp.Date) > 0, exp.ExpiredObjectDeleteMarker != nil} {
+				if set {
+					actions++
+				}
+			}
+			if actions != 1 {
+				return errors.New("Expiration needs exactly one of Days, Date or ExpiredObjectDeleteMarker")
+			}
+			if exp.Days < 0 {
+				return errors.New("Days must be a positive integer")
+			}
+			if len(exp.Date) > 0 {
+				date, err := time.Parse(time.RFC3339, exp.Date)
+				if err != nil || !date.Equal(date.Truncate(24*time.Hour)) {
+					return errors.New("Date must be midnight UTC in ISO 8601 format")
+				}
+			}
+			if exp.ExpiredObjectDeleteMarker != nil && len(f.tags) > 0 {
+				return errors.New("ExpiredObjectDeleteMarker can not be used with tag filters")
+			}
+		}
+		for _, transition := range rule.Transitions {
+			if (transition.Days > 0) == (len(transition.Date) > 0) || transition.Days < 0 {
+				return errors.New("Transition needs exactly one of Days or Date")
+			}
+			if len(transition.Date) > 0 {
+				date, err := time.Parse(time.RFC3339, transition.Date)
+				if err != nil || !date.Equal(date.Truncate(24*time.Hour)) {
+					return errors.New("Date must be midnight UTC in ISO 8601 format")
+				}
+			}
+			if class, err := storageClass(s3, transition.StorageClass); err != nil || class == standardClass {
+				return errors.New("Transition storage class must be a configured tier")
+			}
+		}
+		if nve := rule.NoncurrentVersionExpiration; nve != nil {
+			if nve.NoncurrentDays < 1 {
+				return errors.New("NoncurrentDays must be a positive integer")
+			}
+			if n := nve.NewerNoncurrentVersions; n != nil && (*n < 1 || *n > 100) {
+				return errors.New("NewerNoncurrentVersions must be between 1 and 100")
+			}
+		}
+		if abort := rule.AbortIncompleteMultipartUpload; abort != nil {
+			if abort.DaysAfterInitiation < 1 {
+				return errors.New("DaysAfterInitiation must be a positive integer")
+			}
+			if len(f.tags) > 0 || f.greaterThan != nil || f.lessThan != nil {
+				return errors.New("AbortIncompleteMultipartUpload can not be used with tag or size filters")
+			}
+		}
+	}
+
+	return nil
+}
+
+// lifecycleFilter flattens the prefix, tag and size conditions of a rule.
+type lifecycleFilter struct {
+	prefix      string
+	tags        []S.Tag
+	greaterThan *int64
+	lessThan    *int64
+}
+
+func ruleFilter(rule S.LifecycleRule) lifecycleFilter {
+	var f lifecycleFilter
+	if rule.Prefix != nil {
+		f.prefix = *rule.Prefix
+	}
+
+	filter := rule.Filter
+	if filter == nil {
+		return f
+	}
+	if filter.Prefix != nil {
+		f.prefix = *filter.Prefix
+	}
+	if filter.Tag != nil {
+		f.tags = append(f.tags, *filter.Tag)
+	}
+	f.greaterThan = filter.ObjectSizeGreaterThan
+	f.lessThan = filter.ObjectSizeLessThan
+	if and := filter.And; and != nil {
+		if and.Prefix != nil {
+			f.prefix = *and.Prefix
+		}
+		f.tags = append(f.tags, and.Tags...)
+		f.greaterThan = and.ObjectSizeGreaterThan
+		f.lessThan = and.ObjectSizeLessThan
+	}
+	return f
+}
+
+func ruleMatches(rule S.LifecycleRule, key string) bool {
+	return rule.Status == "Enabled" && strings.HasPrefix(key, ruleFilter(rule).prefix)
+}
+
+func ruleMatchesObject(rule S.LifecycleRule, key string, size int64, tags []S.Tag) bool {
+	if !ruleMatches(rule, key) {
+		return false
+	}
+
+	f := ruleFilter(rule)
+	if f.greaterThan != nil && size <= *f.greaterThan {
+		return false
+	}
+	if f.lessThan != nil && size >= *f.lessThan {
+		return false
+	}
+	for _, want := range f.tags {
+		if !slices.Contains(tags, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// expirationTime returns when a rule expires an object last modified at
+// modified. Day based expiration rounds up to the next midnight UTC.
+func expirationTime(rule S.LifecycleRule, modified time.Time) (time.Time, bool) {
+	exp := rule.Expiration
+	if exp == nil {
+		return time.Time{}, false
+	}
+	if exp.Days > 0 {
+		return midnightAfter(modified.AddDate(0, 0, exp.Days)), true
+	}
+	if len(exp.Date) > 0 {
+		date, err := time.Parse(time.RFC3339, exp.Date)
+		return date, err == nil
+	}
+	return time.Time{}, false
+}
+
+// transitionClass returns the storage class the latest due transition of the
+// matching rules moves an object to, or an empty string.
+func transitionClass(config S.LifecycleConfiguration, key string, path string, info os.FileInfo, tags []S.Tag, now time.Time) string {
+	var class string
+	var latest time.Time
+	for _, rule := range config.Rules {
+		if !ruleMatchesObject(rule, key, objectSize(path, info), tags) {
+			continue
+		}
+		for _, transition := range rule.Transitions {
+			due := midnightAfter(info.ModTime().AddDate(0, 0, transition.Days))
+			if len(transition.Date) > 0 {
+				due, _ = time.Parse(time.RFC3339, transition.Date)
+			}
+			if !now.Before(due) && !due.Before(latest) {
+				class = transition.StorageClass
+				latest = due
+			}
+		}
+	}
+	return class
+}
+
+func midnightAfter(t time.Time) time.Time {
+	t = t.UTC()
+	midnight := t.Truncate(24 * time.Hour)
+	if midnight.Before(t) {
+		midnight = midnight.Add(24 * time.Hour)
+	}
+	return midnight
+}
+
+func expirationResponseHeaders(s3 S.Request, path string, headers map[string]string) {
+	var config S.LifecycleConfiguration
+	if err := readBucketConfig(s3.Mount, s3.Bucket, lifecycleConfig, &config); err != nil {
+		return
+	}
+	info, err := fs.Stat(path)
+	if err != nil {
+		return
+	}
+
+	tags := readTags(path)
+	var earliest time.Time
+	var ruleID string
+	for _, rule := range config.Rules {
+		if !ruleMatchesObject(rule, s3.Key, objectSize(path, info), tags) {
+			continue
+		}
+		if expires, ok := expirationTime(rule, info.ModTime()); ok && (earliest.IsZero() || expires.Before(earliest)) {
+			earliest = expires
+			ruleID = rule.ID
+		}
+	}
+
+	if !earliest.IsZero() {
+		headers["x-amz-expiration"] = fmt.Sprintf("expiry-date=\"%s\", rule-id=\"%s\"", earliest.Format(RFC822Format), url.PathEscape(ruleID))
+	}
+}
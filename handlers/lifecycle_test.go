@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func TestApplyLifecycle(t *testing.T) {
+	mount := t.TempDir()
+	_, do := newTestApp(t, mount)
+	exists := func(target string) bool {
+		t.Helper()
+		return do(Head, "HEAD", target, "").Code == 200
+	}
+	lifecycle := func(bucket string, rules string) {
+		t.Helper()
+		if w := do(Put, "PUT", "/"+bucket+"?lifecycle", "<LifecycleConfiguration>"+rules+"</LifecycleConfiguration>"); w.Code != 200 {
+			t.Fatalf("lifecycle of %s: %d %s", bucket, w.Code, w.Body)
+		}
+	}
+
+	do(Put, "PUT", "/days", "")
+	lifecycle("days", `<Rule><ID>logs</ID><Status>Enabled</Status><Filter><Prefix>logs/</Prefix></Filter><Expiration><Days>3</Days></Expiration></Rule>
+		<Rule><ID>large</ID><Status>Enabled</Status><Filter><ObjectSizeGreaterThan>4</ObjectSizeGreaterThan></Filter><Expiration><Days>1</Days></Expiration></Rule>
+		<Rule><ID>disabled</ID><Status>Disabled</Status><Expiration><Days>1</Days></Expiration></Rule>`)
+	do(Put, "PUT", "/days/logs/a", "a")
+	do(Put, "PUT", "/days/keep", "b")
+	do(Put, "PUT", "/days/large", "large data")
+
+	now := time.Now()
+	ApplyLifecycle(mount, S.Tiers{}, now)
+	if !exists("/days/logs/a") || !exists("/days/large") {
+		t.Fatal("objects expired early")
+	}
+	ApplyLifecycle(mount, S.Tiers{}, now.AddDate(0, 0, 2))
+	if !exists("/days/logs/a") || exists("/days/large") {
+		t.Error("size filter not applied")
+	}
+	ApplyLifecycle(mount, S.Tiers{}, now.AddDate(0, 0, 4))
+	if exists("/days/logs/a") || !exists("/days/keep") {
+		t.Error("prefix filter not applied")
+	}
+
+	do(Put, "PUT", "/date", "")
+	date := now.AddDate(0, 0, 10).UTC().Truncate(24 * time.Hour).Format(time.RFC3339)
+	lifecycle("date", `<Rule><ID>tagged</ID><Status>Enabled</Status><Filter><Tag><Key>temp</Key><Value>yes</Value></Tag></Filter><Expiration><Date>`+date+`</Date></Expiration></Rule>`)
+	do(Put, "PUT", "/date/tagged", "a", "X-Amz-Tagging", "temp=yes")
+	do(Put, "PUT", "/date/untagged", "a", "X-Amz-Tagging", "temp=no")
+	ApplyLifecycle(mount, S.Tiers{}, now.AddDate(0, 0, 9))
+	if !exists("/date/tagged") {
+		t.Error("object expired before the date")
+	}
+	ApplyLifecycle(mount, S.Tiers{}, now.AddDate(0, 0, 11))
+	if exists("/date/tagged") || !exists("/date/untagged") {
+		t.Error("tag filter not applied")
+	}
+
+	do(Put, "PUT", "/versions", "")
+	do(Put, "PUT", "/versions?versioning", `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+	lifecycle("versions", `<Rule><ID>noncurrent</ID><Status>Enabled</Status><NoncurrentVersionExpiration><NoncurrentDays>1</NoncurrentDays><NewerNoncurrentVersions>2</NewerNoncurrentVersions></NoncurrentVersionExpiration></Rule>`)
+	ids := []string{}
+	for i := range 5 {
+		ids = append(ids, do(Put, "PUT", "/versions/key", fmt.Sprint(i)).Header().Get("x-amz-version-id"))
+	}
+	s3 := objectRequest(S.Request{Mount: mount, Bucket: "versions", Tiers: &S.Tiers{}}, "key")
+	config := S.LifecycleConfiguration{}
+	if err := readBucketConfig(mount, "versions", lifecycleConfig, &config); err != nil {
+		t.Fatal(err)
+	}
+	if n := applyLifecycleRules(s3, config, now); n != 0 {
+		t.Errorf("%d versions expired early", n)
+	}
+	if n := applyLifecycleRules(s3, config, now.AddDate(0, 0, 2)); n != 2 {
+		t.Errorf("%d versions expired, want 2", n)
+	}
+	for i, id := range ids {
+		if kept := exists("/versions/key?versionId=" + id); kept != (i >= 2) {
+			t.Errorf("version %d kept: %v", i, kept)
+		}
+	}
+}
+
+func TestLifecycleValidation(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+	for newer, code := range map[string]int{"": 200, "<NewerNoncurrentVersions>1</NewerNoncurrentVersions>": 200, "<NewerNoncurrentVersions>100</NewerNoncurrentVersions>": 200,
+		"<NewerNoncurrentVersions>0</NewerNoncurrentVersions>": 400, "<NewerNoncurrentVersions>101</NewerNoncurrentVersions>": 400} {
+		rules := `<LifecycleConfiguration><Rule><Status>Enabled</Status><NoncurrentVersionExpiration><NoncurrentDays>1</NoncurrentDays>` + newer + `</NoncurrentVersionExpiration></Rule></LifecycleConfiguration>`
+		if w := do(Put, "PUT", "/bucket?lifecycle", rules); w.Code != code {
+			t.Errorf("%q: %d, want %d", newer, w.Code, code)
+		}
+	}
+}
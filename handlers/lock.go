@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const objectLockConfig = "object-lock"
+
+var errObjectLocked = errors.New("object is protected by object lock")
+var errLockNotEnabled = errors.New("bucket is missing object lock configuration")
+
+func GetObjectLockConfiguration(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetObjectLockConfiguration: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	config, err := objectLockConfiguration(s3.Mount, s3.Bucket)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return S.RespondError(w, http.StatusNotFound, "ObjectLockConfigurationNotFoundError", err, s3.Bucket)
+		}
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.RespondXML(w, http.StatusOK, config)
+}
+
+func PutObjectLockConfiguration(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutObjectLockConfiguration: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var config S.ObjectLockConfiguration
+	if err := xml.Unmarshal(body, &config); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Bucket)
+	}
+
+	if config.ObjectLockEnabled != "Enabled" {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", errors.New("ObjectLockEnabled must be Enabled"), s3.Bucket)
+	}
+	if rule := config.Rule; rule != nil {
+		retention := rule.DefaultRetention
+		if !validLockMode(retention.Mode) || (retention.Days > 0) == (retention.Years > 0) || retention.Days < 0 || retention.Years < 0 {
+			return S.RespondError(w, http.StatusBadRequest, "MalformedXML", errors.New("invalid default retention"), s3.Bucket)
+		}
+	}
+
+	if versioningStatus(s3.Mount, s3.Bucket) != "Enabled" {
+		return S.RespondError(w, http.StatusConflict, "InvalidBucketState", errors.New("versioning must be enabled"), s3.Bucket)
+	}
+
+	if err := writeBucketConfig(s3.Mount, s3.Bucket, objectLockConfig, config); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func GetObjectRetention(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetObjectRetention: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	mode, until := objectRetention(path)
+	if len(mode) == 0 {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchObjectLockConfiguration", nil, s3.Key)
+	}
+
+	return S.RespondXML(w, http.StatusOK, S.Retention{
+		Mode:            mode,
+		RetainUntilDate: until.Format(ISO8601UTCFormat),
+	})
+}
+
+func PutObjectRetention(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutObjectRetention: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if !objectLockEnabled(s3.Mount, s3.Bucket) {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", errLockNotEnabled, s3.Key)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var retention S.Retention
+	if err := xml.Unmarshal(body, &retention); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Key)
+	}
+
+	var until time.Time
+	if len(retention.Mode) > 0 || len(retention.RetainUntilDate) > 0 {
+		var err error
+		until, err = time.Parse(time.RFC3339, retention.RetainUntilDate)
+		if err != nil || !validLockMode(retention.Mode) {
+			return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Key)
+		}
+		if !until.After(time.Now()) {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", errors.New("retain until date must be in the future"), s3.Key)
+		}
+	}
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	unlock := lockKey(s3.Path)
+	defer unlock()
+
+	mode, current := objectRetention(path)
+	if len(mode) > 0 && current.After(time.Now()) {
+		if mode == "COMPLIANCE" && (retention.Mode != "COMPLIANCE" || until.Before(current)) {
+			return S.RespondError(w, http.StatusForbidden, "AccessDenied", errObjectLocked, s3.Key)
+		}
+		if mode == "GOVERNANCE" && (len(retention.Mode) == 0 || until.Before(current)) && !s3.BypassGovernance {
+			return S.RespondError(w, http.StatusForbidden, "AccessDenied", errObjectLocked, s3.Key)
+		}
+	}
+
+	if len(retention.Mode) == 0 {
+		fs.Removexattr(path, "retention-mode")
+		fs.Removexattr(path, "retain-until")
+		return S.Respond(w, http.StatusOK, nil, nil)
+	}
+
+	if err := fs.Setxattr(path, "retention-mode", retention.Mode); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+	if err := fs.Setxattr(path, "retain-until", until.UTC().Format(time.RFC3339)); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func GetObjectLegalHold(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetObjectLegalHold: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	status, err := fs.Getxattr(path, "legal-hold")
+	if err != nil {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchObjectLockConfiguration", err, s3.Key)
+	}
+
+	return S.RespondXML(w, http.StatusOK, S.LegalHold{Status: status})
+}
+
+func PutObjectLegalHold(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutObjectLegalHold: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if !objectLockEnabled(s3.Mount, s3.Bucket) {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", errLockNotEnabled, s3.Key)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var hold S.LegalHold
+	if err := xml.Unmarshal(body, &hold); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Key)
+	}
+	if hold.Status != "ON" && hold.Status != "OFF" {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", errors.New("legal hold status must be ON or OFF"), s3.Key)
+	}
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	if err := fs.Setxattr(path, "legal-hold", hold.Status); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func objectLockConfiguration(mount string, bucket string) (S.ObjectLockConfiguration, error) {
+	var config S.ObjectLockConfiguration
+	err := readBucketConfig(mount, bucket, objectLockConfig, &config)
+	return config, err
+}
+
+func objectLockEnabled(mount string, bucket string) bool {
+	config, err := objectLockConfiguration(mount, bucket)
+	return err == nil && config.ObjectLockEnabled == "Enabled"
+}
+
+func validLockMode(mode string) bool {
+	return mode == "GOVERNANCE" || mode == "COMPLIANCE"
+}
+
+func objectRetention(path string) (string, time.Time) {
+	mode, err := fs.Getxattr(path, "retention-mode")
+	if err != nil {
+		return "", time.Time{}
+	}
+	value, _ := fs.Getxattr(path, "retain-until")
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return mode, until
+}
+
+// checkObjectLock reports whether the object version at path may be destroyed.
+func checkObjectLock(path string, bypassGovernance bool) error {
+	if hold, _ := fs.Getxattr(path, "legal-hold"); hold == "ON" {
+		return errObjectLocked
+	}
+
+	mode, until := objectRetention(path)
+	if len(mode) == 0 || !until.After(time.Now()) {
+		return nil
+	}
+	if mode == "GOVERNANCE" && bypassGovernance {
+		return nil
+	}
+	return errObjectLocked
+}
+
+// objectLockHeaders validates the object lock headers of a write and returns
+// the xattrs to store, falling back to the default retention of the bucket.
+func objectLockHeaders(mount string, bucket string, header http.Header) (map[string]string, error) {
+	mode := header.Get("X-Amz-Object-Lock-Mode")
+	date := header.Get("X-Amz-Object-Lock-Retain-Until-Date")
+	hold := header.Get("X-Amz-Object-Lock-Legal-Hold")
+
+	config, err := objectLockConfiguration(mount, bucket)
+	if err != nil || config.ObjectLockEnabled != "Enabled" {
+		if len(mode) > 0 || len(date) > 0 || len(hold) > 0 {
+			return nil, errLockNotEnabled
+		}
+		return nil, nil
+	}
+
+	attrs := make(map[string]string)
+	if len(mode) > 0 || len(date) > 0 {
+		until, err := time.Parse(time.RFC3339, date)
+		if err != nil || !validLockMode(mode) || !until.After(time.Now()) {
+			return nil, errors.New("invalid object lock mode or retain until date")
+		}
+		attrs["retention-mode"] = mode
+		attrs["retain-until"] = until.UTC().Format(time.RFC3339)
+	} else if config.Rule != nil {
+		retention := config.Rule.DefaultRetention
+		until := time.Now().AddDate(retention.Years, 0, retention.Days)
+		attrs["retention-mode"] = retention.Mode
+		attrs["retain-until"] = until.UTC().Format(time.RFC3339)
+	}
+
+	if len(hold) > 0 {
+		if hold != "ON" && hold != "OFF" {
+			return nil, errors.New("invalid legal hold status")
+		}
+		attrs["legal-hold"] = hold
+	}
+
+	return attrs, nil
+}
+
+func setObjectLock(path string, attrs map[string]string) error {
+	for k, v := range attrs {
+		if err := fs.Setxattr(path, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectLockResponseHeaders(path string, headers map[string]string) {
+	if mode, until := objectRetention(path); len(mode) > 0 {
+		headers["x-amz-object-lock-mode"] = mode
+		headers["x-amz-object-lock-retain-until-date"] = until.Format(ISO8601UTCFormat)
+	}
+	if hold, err := fs.Getxattr(path, "legal-hold"); err == nil {
+		headers["x-amz-object-lock-legal-hold"] = hold
+	}
+}
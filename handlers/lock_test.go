@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObjectLock(t *testing.T) {
+	app, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+	do(Put, "PUT", "/bucket?versioning", `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+	do(Put, "PUT", "/bucket?object-lock", `<ObjectLockConfiguration><ObjectLockEnabled>Enabled</ObjectLockEnabled></ObjectLockConfiguration>`)
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	put := func(key string, header ...string) string {
+		t.Helper()
+		w := do(Put, "PUT", "/bucket/"+key, "data", header...)
+		if w.Code != 200 {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+		return w.Header().Get("x-amz-version-id")
+	}
+	bypass := []string{"X-Amz-Bypass-Governance-Retention", "true"}
+	deleteVersion := func(key string, id string, flag bool, header ...string) int {
+		t.Helper()
+		*app.GovernanceBypass = flag
+		defer func() { *app.GovernanceBypass = false }()
+		return do(Delete, "DELETE", "/bucket/"+key+"?versionId="+id, "", header...).Code
+	}
+
+	compliance := put("compliance", "X-Amz-Object-Lock-Mode", "COMPLIANCE", "X-Amz-Object-Lock-Retain-Until-Date", until)
+	if code := deleteVersion("compliance", compliance, false); code != 403 {
+		t.Errorf("COMPLIANCE version deleted: %d", code)
+	}
+	if code := deleteVersion("compliance", compliance, true, bypass...); code != 403 {
+		t.Errorf("COMPLIANCE version deleted bypassing governance: %d", code)
+	}
+
+	governance := put("governance", "X-Amz-Object-Lock-Mode", "GOVERNANCE", "X-Amz-Object-Lock-Retain-Until-Date", until)
+	if code := deleteVersion("governance", governance, false); code != 403 {
+		t.Errorf("GOVERNANCE version deleted: %d", code)
+	}
+	if code := deleteVersion("governance", governance, false, bypass...); code != 403 {
+		t.Errorf("GOVERNANCE version deleted with the header but without -governance-bypass: %d", code)
+	}
+	if code := deleteVersion("governance", governance, true); code != 403 {
+		t.Errorf("GOVERNANCE version deleted with -governance-bypass but without the header: %d", code)
+	}
+	if code := deleteVersion("governance", governance, true, bypass...); code != 200 {
+		t.Errorf("GOVERNANCE version not deleted bypassing governance: %d", code)
+	}
+
+	held := put("held", "X-Amz-Object-Lock-Legal-Hold", "ON")
+	if code := deleteVersion("held", held, true, bypass...); code != 403 {
+		t.Errorf("version under legal hold deleted: %d", code)
+	}
+	do(Put, "PUT", "/bucket/held?legal-hold&versionId="+held, `<LegalHold><Status>OFF</Status></LegalHold>`)
+	if code := deleteVersion("held", held, false); code != 200 {
+		t.Errorf("version not deleted after the legal hold was lifted: %d", code)
+	}
+
+	// Versioning can not be suspended, so an overwrite or a delete without a
+	// version ID keeps the locked version.
+	if w := do(Put, "PUT", "/bucket?versioning", `<VersioningConfiguration><Status>Suspended</Status></VersioningConfiguration>`); w.Code != 409 {
+		t.Errorf("versioning suspended on a locked bucket: %d", w.Code)
+	}
+	for key, id := range map[string]string{"compliance": compliance, "held": put("held", "X-Amz-Object-Lock-Legal-Hold", "ON")} {
+		if other := put(key); other == id {
+			t.Errorf("%s overwritten in place", key)
+		}
+		if w := do(Delete, "DELETE", "/bucket/"+key, ""); w.Header().Get("x-amz-delete-marker") != "true" {
+			t.Errorf("%s deleted without a delete marker: %d", key, w.Code)
+		}
+		if w := do(Get, "GET", "/bucket/"+key+"?versionId="+id, ""); w.Body.String() != "data" {
+			t.Errorf("locked version of %s changed: %q", key, w.Body)
+		}
+		if code := deleteVersion(key, id, true, bypass...); code != 403 {
+			t.Errorf("locked version of %s deleted after an overwrite: %d", key, code)
+		}
+	}
+}
@@ -2,11 +2,23 @@ package handlers
 
 import (
 	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"unsafe"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
 )
 
 const Metadata = ".tri"
 
+const uploadIDLength = 50
+const tmpDir = "tmp"
+const sidecarDir = "sidecar"
+const mirrorDir = "mirror"
+
 var alpha = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func generate(size int) string {
@@ -17,3 +29,154 @@ func generate(size int) string {
 	}
 	return *(*string)(unsafe.Pointer(&b))
 }
+
+// NewMetadataStore returns the metadata store named kind for the mount and the
+// tier roots, either extended attributes or sidecar files kept in a sidecar
+// directory of each root.
+func NewMetadataStore(kind string, mount string, tiers S.Tiers) (fs.MetadataStore, error) {
+	return newMetadataStore(kind, map[string]string{mount: filepath.Join(mount, Metadata, sidecarDir)}, tiers)
+}
+
+// BackendOptions name the storage backend of a mount like the flags of the
+// tri binary.
+type BackendOptions struct {
+	Backend     string
+	Metadata    string
+	Mount       string
+	Mirrors     []string
+	WriteQuorum int
+	Disks       S.Disks
+	Parity      int
+	Tiers       S.Tiers
+}
+
+// OpenBackend opens the posix, mirrored or erasure coded backend of a mount.
+// The memory backend is not opened from a mount, it only lives as long as
+// the server keeping it.
+func OpenBackend(opts BackendOptions) (fs.Backend, error) {
+	switch {
+	case opts.Backend == "memory":
+		return nil, fmt.Errorf("the memory backend has no mount to open")
+	case len(opts.Mirrors) > 0 && opts.Backend != "posix":
+		return nil, fmt.Errorf("mirrors need the posix backend")
+	case opts.Backend == "erasure":
+		e, err := NewErasure(opts.Metadata, opts.Mount, opts.Disks, opts.Parity, opts.Tiers)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	case opts.Backend != "posix":
+		return nil, fmt.Errorf("unknown storage backend %s", opts.Backend)
+	case len(opts.Mirrors) > 0:
+		m, err := NewMirror(opts.Metadata, opts.Mount, opts.Mirrors, opts.WriteQuorum, opts.Tiers)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	store, err := NewMetadataStore(opts.Metadata, opts.Mount, opts.Tiers)
+	if err != nil {
+		return nil, fmt.Errorf("can not open metadata store: %w", err)
+	}
+	return fs.Posix{Store: store}, nil
+}
+
+// NewErasure returns the backend spreading the mount over the disks, with
+// parity of them holding parity shards and metadata kept in the store named
+// kind on every disk.
+func NewErasure(kind string, mount string, disks S.Disks, parity int, tiers S.Tiers) (*fs.Erasure, error) {
+	if len(disks) < 2 {
+		return nil, fmt.Errorf("erasure coding needs at least 2 disks")
+	}
+	if parity == 0 {
+		parity = len(disks) / 2
+	}
+
+	roots := map[string]string{}
+	for _, disk := range disks {
+		roots[filepath.Join(disk, fs.ErasureData)] = filepath.Join(disk, sidecarDir)
+	}
+	store, err := newMetadataStore(kind, roots, tiers)
+	if err != nil {
+		return nil, err
+	}
+	return fs.NewErasure(mount, disks, parity, store)
+}
+
+// NewMirror returns the backend keeping a copy of the mount on every mirror,
+// writes reaching at least quorum of the copies and metadata kept in the
+// store named kind next to each copy.
+func NewMirror(kind string, mount string, mirrors []string, quorum int, tiers S.Tiers) (*fs.Mirror, error) {
+	mounts := append([]string{mount}, mirrors...)
+	roots := map[string]string{}
+	for _, mount := range mounts {
+		roots[mount] = filepath.Join(mount, Metadata, sidecarDir)
+	}
+	store, err := newMetadataStore(kind, roots, tiers)
+	if err != nil {
+		return nil, err
+	}
+	return fs.NewMirror(fs.MirrorConfig{
+		Mounts:     mounts,
+		Quorum:     quorum,
+		Store:      store,
+		VersionKey: "etag",
+		State:      filepath.Join(Metadata, mirrorDir),
+		Skip:       []string{filepath.Join(Metadata, sidecarDir)},
+	})
+}
+
+// newMetadataStore returns the store named kind for the roots of a backend,
+// creating them for the sidecar store. The roots are directories of the host
+// the backend is opened on, so they are created on the local filesystem.
+func newMetadataStore(kind string, roots map[string]string, tiers S.Tiers) (fs.MetadataStore, error) {
+	switch kind {
+	case "xattr":
+		return fs.Xattrs{}, nil
+	case "sidecar":
+		for _, root := range tiers {
+			roots[root] = filepath.Join(root, sidecarDir)
+		}
+		for root := range roots {
+			if err := os.MkdirAll(root, os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
+		return fs.NewSidecars(roots)
+	}
+	return nil, fmt.Errorf("unknown metadata store %s", kind)
+}
+
+func validUploadID(id string) bool {
+	return len(id) == uploadIDLength && strings.Trim(id, string(alpha)) == ""
+}
+
+// createTemp creates the temporary file for a new object, inside the tier
+// root when the storage class is stored outside the mount.
+func createTemp(s3 S.Request, class string) (fs.File, error) {
+	dir := filepath.Join(s3.Mount, Metadata, tmpDir)
+	if root, ok := tierRoot(s3, class); ok {
+		dir = filepath.Join(root, TierTmp)
+	}
+	if err := fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	file, err := fs.CreateTemp(dir, "object-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		fs.Remove(file.Name())
+		return nil, err
+	}
+	if class != standardClass {
+		if err := fs.Setxattr(file.Name(), "storage-class", class); err != nil {
+			file.Close()
+			fs.Remove(file.Name())
+			return nil, err
+		}
+	}
+	return file, nil
+}
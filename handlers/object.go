@@ -2,10 +2,12 @@ package handlers
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
@@ -14,6 +16,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/autovia/tri/fs"
 	S "github.com/autovia/tri/structs"
@@ -22,15 +25,17 @@ import (
 const ISO8601UTCFormat = "2006-01-02T15:04:05.000Z"
 const RFC822Format = "Mon, 2 Jan 2006 15:04:05 GMT"
 
+const keepAliveInterval = 5 * time.Second
+
 func ListObjectsV2(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#ListObjectsV2 %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
 	}
 
-	contents, err := os.ReadDir(s3.Path)
+	contents, err := fs.ReadDir(s3.Path)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
 	}
@@ -38,21 +43,25 @@ func ListObjectsV2(w http.ResponseWriter, r *http.Request) error {
 	objects := []S.Object{}
 	prefixes := []S.CommonPrefix{}
 	for _, file := range contents {
-		fileInfo, _ := file.Info()
 		if !file.IsDir() {
-			t := fileInfo.ModTime()
-			etag, err := fs.Getxattr(filepath.Join(s3.Path, fileInfo.Name()), "etag")
+			path := filepath.Join(s3.Path, file.Name())
+			etag, err := objectETag(s3, path)
+			if err != nil {
+				return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+			}
+			fileInfo, err := fs.Stat(path)
 			if err != nil {
 				return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 			}
+			t := fileInfo.ModTime()
 			objects = append(objects, S.Object{
 				Key:          fileInfo.Name(),
 				LastModified: t.Format(ISO8601UTCFormat),
-				Size:         fileInfo.Size(),
+				Size:         objectSize(path, fileInfo),
 				ETag:         "\"" + etag + "\"",
-				StorageClass: "STANDARD"})
+				StorageClass: objectStorageClass(path)})
 		} else {
-			prefixes = append(prefixes, S.CommonPrefix{Prefix: fileInfo.Name() + "/"})
+			prefixes = append(prefixes, S.CommonPrefix{Prefix: file.Name() + "/"})
 		}
 	}
 
@@ -73,80 +82,271 @@ func CopyObject(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#CopyObject: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	source := r.Header.Get("X-Amz-Copy-Source")
+	source, rawQuery, _ := strings.Cut(r.Header.Get("X-Amz-Copy-Source"), "?")
 	sourcePath, err := url.QueryUnescape(source)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
 	}
-	etag, err := fs.Getxattr(filepath.Join(s3.Mount, sourcePath), "etag")
+	sourceQuery, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(sourcePath, "/"), "/")
+	src := objectRequest(S.Request{Mount: s3.Mount, Bucket: bucket}, key)
+	srcPath := src.Path
+	if sourceVersionID := sourceQuery.Get("versionId"); len(sourceVersionID) > 0 {
+		v, err := findVersion(src, sourceVersionID)
+		if err != nil {
+			return S.RespondError(w, http.StatusNotFound, "NoSuchVersion", err, s3.Key)
+		}
+		if v.DeleteMarker {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", errors.New("source is a delete marker"), s3.Key)
+		}
+		srcPath = v.Path
+		w.Header().Set("x-amz-copy-source-version-id", v.ID)
+	} else if !isObject(srcPath) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchKey", os.ErrNotExist, s3.Key)
+	} else if len(versioningStatus(s3.Mount, bucket)) > 0 {
+		w.Header().Set("x-amz-copy-source-version-id", currentVersionID(srcPath))
+	}
+
+	sourceKey, err := customerKey(r.Header, "X-Amz-Copy-Source-Server-Side-Encryption-Customer-")
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+	}
+	if code, awscode, err := checkCustomerKey(srcPath, sourceKey); err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	etag, err := objectETag(s3, srcPath)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 
-	if s3.Path != filepath.Join(s3.Mount, sourcePath) {
-		sourceFile, err := os.Open(filepath.Join(s3.Mount, sourcePath))
+	lock, err := objectLockHeaders(s3.Mount, s3.Bucket, r.Header)
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", err, s3.Key)
+	}
+
+	var tags []S.Tag
+	switch r.Header.Get("X-Amz-Tagging-Directive") {
+	case "", "COPY":
+		tags = readTags(srcPath)
+	case "REPLACE":
+		tags, err = parseTagging(r.Header.Get("X-Amz-Tagging"))
+		if err != nil {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidTag", err, s3.Key)
+		}
+	default:
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", errors.New("unknown tagging directive"), s3.Key)
+	}
+
+	class, err := storageClass(s3, r.Header.Get("X-Amz-Storage-Class"))
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidStorageClass", err, s3.Key)
+	}
+
+	sum, _ := readChecksum(srcPath)
+	algorithm := strings.ToUpper(r.Header.Get("X-Amz-Checksum-Algorithm"))
+	if len(algorithm) > 0 && newChecksumHash(algorithm) == nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", errInvalidChecksum, s3.Key)
+	}
+
+	encryption, err := requestedEncryption(s3, r)
+	if err != nil {
+		code, awscode := encryptionErrorCode(err, http.StatusBadRequest, "InvalidArgument")
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	versionID := newVersionID(versioningStatus(s3.Mount, s3.Bucket))
+	if s3.Path != srcPath || len(versionID) > 0 || len(lock) > 0 || len(algorithm) > 0 || r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" || len(r.Header.Get("X-Amz-Storage-Class")) > 0 || len(r.Header.Get("X-Amz-Server-Side-Encryption")) > 0 || encryption.CustomerKey != nil {
+		targetFile, err := createTemp(s3, class)
 		if err != nil {
 			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 		}
-		defer sourceFile.Close()
+		defer discardTemp(s3, targetFile.Name())
+		defer targetFile.Close()
 
-		if _, err := os.Stat(filepath.Dir(s3.Path)); os.IsNotExist(err) {
-			err := os.MkdirAll(filepath.Dir(s3.Path), os.ModePerm)
-			if err != nil {
-				return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
-			}
+		_, err = copyObjectData(s3, targetFile, srcPath, sourceKey, encryption, requestedCompression(s3, s3.Key, r.Header.Get("Content-Type")))
+		if err != nil {
+			code, awscode := encryptionErrorCode(err, http.StatusInternalServerError, "InternalError")
+			return S.RespondError(w, code, awscode, err, s3.Key)
 		}
 
-		targetFile, err := os.Create(s3.Path)
+		err = targetFile.Sync()
 		if err != nil {
 			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 		}
-		defer targetFile.Close()
-		_, err = io.Copy(targetFile, sourceFile)
+
+		err = fs.Setxattr(targetFile.Name(), "etag", etag)
 		if err != nil {
 			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 		}
 
-		err = targetFile.Sync()
+		err = setObjectLock(targetFile.Name(), lock)
+		if err != nil {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+
+		if len(algorithm) > 0 && algorithm != sum.Algorithm {
+			sum, err = fileChecksum(s3, targetFile.Name(), encryption.CustomerKey, algorithm)
+			if err != nil {
+				return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+			}
+		}
+		err = sum.write(targetFile.Name())
+		if err != nil {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+
+		err = writeTags(targetFile.Name(), tags)
 		if err != nil {
 			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 		}
 
-		err = fs.Setxattr(s3.Path, "etag", etag)
+		err = commitObject(s3, targetFile.Name(), versionID)
+		if err == errObjectLocked {
+			return S.RespondError(w, http.StatusForbidden, "AccessDenied", err, s3.Key)
+		}
 		if err != nil {
 			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 		}
 	}
 
-	stats, err := os.Stat(s3.Path)
+	if len(versionID) > 0 {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	headers := make(map[string]string)
+	encryptionResponseHeaders(s3.Path, encryption.CustomerKey, headers)
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+
+	stats, err := fs.Stat(s3.Path)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 	t := stats.ModTime()
-	return S.RespondXML(w, http.StatusOK, S.CopyObjectResult{
+	result := S.CopyObjectResult{
 		LastModified: t.Format(ISO8601UTCFormat),
 		ETag:         "\"" + etag + "\"",
-	})
+		ChecksumType: sum.Type,
+	}
+	result.Set(sum.Algorithm, sum.Value)
+	return S.RespondXML(w, http.StatusOK, result)
 }
 
 func CreateMultipartUpload(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#CreateMultipartUpload: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); !os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	if stat, err := fs.Stat(s3.Path); err == nil && stat.IsDir() {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", errors.New("path is a directory"), s3.Key)
 	}
 
 	if strings.HasSuffix(s3.Path, "/") {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", errors.New("path is a directory"), s3.Key)
 	}
 
-	uploadID := generate(50)
+	lock, err := objectLockHeaders(s3.Mount, s3.Bucket, r.Header)
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", err, s3.Key)
+	}
+
+	algorithm := strings.ToUpper(r.Header.Get("X-Amz-Checksum-Algorithm"))
+	checksumType := strings.ToUpper(r.Header.Get("X-Amz-Checksum-Type"))
+	if len(algorithm) > 0 {
+		if len(checksumType) == 0 {
+			checksumType = defaultChecksumType(algorithm)
+		}
+		if newChecksumHash(algorithm) == nil || !validChecksumType(algorithm, checksumType) {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", errInvalidChecksum, s3.Key)
+		}
+	} else if len(checksumType) > 0 {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", errInvalidChecksum, s3.Key)
+	}
+
+	tags, err := parseTagging(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidTag", err, s3.Key)
+	}
+
+	class, err := storageClass(s3, r.Header.Get("X-Amz-Storage-Class"))
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidStorageClass", err, s3.Key)
+	}
+
+	encryption, err := requestedEncryption(s3, r)
+	if err != nil {
+		code, awscode := encryptionErrorCode(err, http.StatusBadRequest, "InvalidArgument")
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	uploadID := generate(uploadIDLength)
 	metapath := filepath.Join(s3.Mount, Metadata, uploadID)
-	if err := os.MkdirAll(metapath, os.ModePerm); err != nil {
+	if err := fs.MkdirAll(metapath, os.ModePerm); err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 
+	for k, v := range map[string]string{
+		"bucket":    s3.Bucket,
+		"key":       s3.Key,
+		"initiated": time.Now().UTC().Format(time.RFC3339Nano),
+	} {
+		if err := fs.Setxattr(metapath, k, v); err != nil {
+			fs.RemoveAll(metapath)
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+	}
+
+	if err := setObjectLock(metapath, lock); err != nil {
+		fs.RemoveAll(metapath)
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	if err := writeTags(metapath, tags); err != nil {
+		fs.RemoveAll(metapath)
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	if class != standardClass {
+		if err := fs.Setxattr(metapath, "storage-class", class); err != nil {
+			fs.RemoveAll(metapath)
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+	}
+
+	if compression := requestedCompression(s3, s3.Key, r.Header.Get("Content-Type")); len(compression) > 0 {
+		if err := fs.Setxattr(metapath, "compression", compression); err != nil {
+			fs.RemoveAll(metapath)
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+	}
+
+	if len(algorithm) > 0 {
+		if err := fs.Setxattr(metapath, "checksum-algorithm", algorithm); err != nil {
+			fs.RemoveAll(metapath)
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+		if err := fs.Setxattr(metapath, "checksum-type", checksumType); err != nil {
+			fs.RemoveAll(metapath)
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+		w.Header().Set("x-amz-checksum-algorithm", algorithm)
+		w.Header().Set("x-amz-checksum-type", checksumType)
+	}
+
+	if err := encryption.write(metapath); err != nil {
+		fs.RemoveAll(metapath)
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+	headers := make(map[string]string)
+	encryption.headers(headers)
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+
 	return S.RespondXML(w, http.StatusOK, S.InitiateMultipartUploadResponse{
 		Bucket:   s3.Bucket,
 		Key:      s3.Key,
@@ -158,112 +358,356 @@ func CompleteMultipartUpload(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#CompleteMultipartUpload: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	metapath := filepath.Join(s3.Mount, Metadata, r.URL.Query().Get("uploadId"))
-	if _, err := os.Stat(metapath); os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	uploadID := r.URL.Query().Get("uploadId")
+	metapath := filepath.Join(s3.Mount, Metadata, uploadID)
+	if _, err := fs.Stat(metapath); !validUploadID(uploadID) || os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchUpload", err, s3.Key)
+	}
+
+	key, err := customerKey(r.Header, "X-Amz-Server-Side-Encryption-Customer-")
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+	}
+	if code, awscode, err := checkCustomerKey(metapath, key); err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
 	}
 
 	body, _ := io.ReadAll(r.Body)
 	var cmu S.CompleteMultipartUpload
-	err := xml.Unmarshal(body, &cmu)
+	err = xml.Unmarshal(body, &cmu)
 	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Key)
+	}
+
+	algorithm, _ := fs.Getxattr(metapath, "checksum-algorithm")
+	checksumType, _ := fs.Getxattr(metapath, "checksum-type")
+	sums := []string{}
+	sizes := []int64{}
+	for i, part := range cmu.Parts {
+		if i > 0 && part.PartNumber <= cmu.Parts[i-1].PartNumber {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidPartOrder", nil, s3.Key)
+		}
+		fn := filepath.Join(metapath, strconv.Itoa(part.PartNumber))
+		stat, err := fs.Stat(fn)
+		if err != nil {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidPart", err, s3.Key)
+		}
+		if len(algorithm) == 0 {
+			continue
+		}
+		c, ok := readChecksum(fn)
+		if !ok || c.Algorithm != algorithm {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidPart", errInvalidChecksum, s3.Key)
+		}
+		if sent := part.Get(algorithm); len(sent) > 0 && sent != c.Value {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidPart", errBadDigest, s3.Key)
+		}
+		sums = append(sums, c.Value)
+		sizes = append(sizes, objectSize(fn, stat))
+	}
+
+	var sum checksum
+	if len(algorithm) > 0 {
+		value, err := combineChecksums(algorithm, checksumType, sums, sizes)
+		if err != nil {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+		if sent := r.Header.Get(checksumHeader(algorithm)); len(sent) > 0 && sent != value {
+			return S.RespondError(w, http.StatusBadRequest, "BadDigest", errBadDigest, s3.Key)
+		}
+		sum = checksum{Algorithm: algorithm, Type: checksumType, Value: value}
+	}
+
+	versionID := newVersionID(versioningStatus(s3.Mount, s3.Bucket))
+	if len(versionID) > 0 {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	encryption := storedEncryption(metapath, key)
+	headers := make(map[string]string)
+	encryption.headers(headers)
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+
+	return S.RespondXMLKeepAlive(w, keepAliveInterval, func() any {
+		etag, err := assembleParts(s3, metapath, cmu.Parts, versionID, sum, encryption)
+		if err == errObjectLocked {
+			return S.Error{Code: "AccessDenied", Message: "AccessDenied", Resource: s3.Key}
+		}
+		if err != nil {
+			log.Printf(">>> CompleteMultipartUpload >>> %s", err)
+			return S.Error{Code: "InternalError", Message: "InternalError", Resource: s3.Key}
+		}
+
+		result := S.CompleteMultipartUploadResult{
+			Bucket:       s3.Bucket,
+			Key:          s3.Key,
+			ETag:         "\"" + etag + "\"",
+			ChecksumType: sum.Type,
+		}
+		result.Set(sum.Algorithm, sum.Value)
+		return result
+	})
+}
+
+func AbortMultipartUpload(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#AbortMultipartUpload: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	uploadID := r.URL.Query().Get("uploadId")
+	metapath := filepath.Join(s3.Mount, Metadata, uploadID)
+	if _, err := fs.Stat(metapath); !validUploadID(uploadID) || os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchUpload", err, s3.Key)
+	}
+
+	if err := fs.RemoveAll(metapath); err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 
-	outFile, err := os.Create(s3.Path)
+	return S.Respond(w, http.StatusNoContent, nil, nil)
+}
+
+func assembleParts(s3 S.Request, metapath string, parts []S.CompletedPart, versionID string, sum checksum, encryption serverSideEncryption) (string, error) {
+	var outFile fs.File
+	var err error
+	if class := objectStorageClass(metapath); class != standardClass {
+		outFile, err = createTemp(s3, class)
+	} else {
+		outFile, err = fs.Create(filepath.Join(metapath, "object"))
+	}
 	if err != nil {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		return "", err
 	}
+	tmp := outFile.Name()
+	defer discardTemp(s3, tmp)
 	defer outFile.Close()
 
-	var n int64
+	writer, err := encryptFile(s3, outFile, encryption)
+	if err != nil {
+		return "", err
+	}
+	compression, _ := fs.Getxattr(metapath, "compression")
+	writer, err = compressFile(writer, tmp, compression)
+	if err != nil {
+		return "", err
+	}
+
+	var offset int64
 	h := md5.New()
-	for _, part := range cmu.PartNumbers {
-		fn := filepath.Join(metapath, fmt.Sprintf("%v", part))
+	layout := []string{}
+	for _, part := range parts {
+		fn := filepath.Join(metapath, strconv.Itoa(part.PartNumber))
 		etag, err := fs.Getxattr(fn, "etag")
 		if err != nil {
-			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+			return "", err
 		}
-		h.Write([]byte(etag))
-		n++
-		partFile, err := os.Open(fn)
+		digest, err := hex.DecodeString(etag)
 		if err != nil {
-			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+			return "", err
 		}
-		_, err = io.Copy(outFile, partFile)
-		if err != nil {
-			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		h.Write(digest)
+
+		var n int64
+		if len(encryption.Algorithm) > 0 || len(compression) > 0 {
+			partFile, _, err := openObject(s3, fn, encryption.CustomerKey)
+			if err != nil {
+				return "", err
+			}
+			n, err = io.Copy(writer, partFile)
+			partFile.Close()
+			if err != nil {
+				return "", err
+			}
+		} else {
+			partFile, err := fs.Open(fn)
+			if err != nil {
+				return "", err
+			}
+			n, err = fs.CopyFile(outFile, partFile, offset)
+			partFile.Close()
+			if err != nil {
+				return "", err
+			}
 		}
-		partFile.Close()
-		err = os.Remove(fn)
-		if err != nil {
-			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		offset += n
+
+		entry := fmt.Sprintf("%d:%d", part.PartNumber, n)
+		if c, ok := readChecksum(fn); ok && c.Algorithm == sum.Algorithm {
+			entry += ":" + c.Value
 		}
+		layout = append(layout, entry)
 	}
-	err = os.Remove(metapath)
-	if err != nil {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := outFile.Sync(); err != nil {
+		return "", err
+	}
+	if s3.Dedup && len(encryption.Algorithm) == 0 && len(compression) == 0 && objectStorageClass(metapath) == standardClass {
+		if err := dedupFile(s3.Mount, tmp); err != nil {
+			return "", err
+		}
 	}
 
-	dashTag := append(h.Sum(nil), '-')
-	finalETag := strconv.AppendInt(dashTag, n, 10)
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(parts))
+	if err := fs.Setxattr(tmp, "etag", etag); err != nil {
+		return "", err
+	}
+	if err := sum.write(tmp); err != nil {
+		return "", err
+	}
+	if err := writePartLayout(s3.Mount, tmp, strings.Join(layout, ",")); err != nil {
+		return "", err
+	}
+	for _, k := range []string{"retention-mode", "retain-until", "legal-hold", "tagging"} {
+		if v, err := fs.Getxattr(metapath, k); err == nil {
+			if err := fs.Setxattr(tmp, k, v); err != nil {
+				return "", err
+			}
+		}
+	}
 
-	return S.RespondXML(w, http.StatusOK, S.CompleteMultipartUpload{
-		Bucket: s3.Bucket,
-		Key:    s3.Key,
-		ETag:   fmt.Sprintf("\"%s\"", finalETag),
-	})
+	if err := commitObject(s3, tmp, versionID); err != nil {
+		return "", err
+	}
+
+	return etag, fs.RemoveAll(metapath)
 }
 
 func PutObject(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#PutObject: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); !os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
+	if stat, err := fs.Stat(s3.Path); err == nil && stat.IsDir() {
+		return S.RespondError(w, http.StatusBadRequest, "InternalError", errors.New("path is a directory"), s3.Key)
 	}
 
 	if strings.HasSuffix(s3.Path, "/") {
-		err := os.MkdirAll(s3.Path, os.ModePerm)
+		err := fs.MkdirAll(s3.Path, os.ModePerm)
 		if err != nil {
 			return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 		}
 		return S.Respond(w, http.StatusOK, nil, nil)
 	}
 
-	if _, err := os.Stat(filepath.Dir(s3.Path)); os.IsNotExist(err) {
-		err := os.MkdirAll(filepath.Dir(s3.Path), os.ModePerm)
-		if err != nil {
-			return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
-		}
+	lock, err := objectLockHeaders(s3.Mount, s3.Bucket, r.Header)
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", err, s3.Key)
+	}
+
+	algorithm, err := requestedChecksum(r, "")
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", err, s3.Key)
+	}
+
+	tags, err := parseTagging(r.Header.Get("X-Amz-Tagging"))
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidTag", err, s3.Key)
+	}
+
+	class, err := storageClass(s3, r.Header.Get("X-Amz-Storage-Class"))
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidStorageClass", err, s3.Key)
 	}
 
-	targetFile, err := os.Create(s3.Path)
+	encryption, err := requestedEncryption(s3, r)
+	if err != nil {
+		code, awscode := encryptionErrorCode(err, http.StatusBadRequest, "InvalidArgument")
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	targetFile, err := createTemp(s3, class)
 	if err != nil {
 		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 	}
+	defer discardTemp(s3, targetFile.Name())
 	defer targetFile.Close()
 
 	defer r.Body.Close()
 
-	fileBytes, err := io.ReadAll(r.Body)
+	writer, err := encryptFile(s3, targetFile, encryption)
 	if err != nil {
-		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+	compression := requestedCompression(s3, s3.Key, r.Header.Get("Content-Type"))
+	writer, err = compressFile(writer, targetFile.Name(), compression)
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	var digest hash.Hash
+	dst := io.Writer(writer)
+	if s3.Dedup && len(encryption.Algorithm) == 0 && len(compression) == 0 && class == standardClass {
+		digest = sha256.New()
+		dst = io.MultiWriter(writer, digest)
 	}
-	hash := md5.Sum(fileBytes)
-	etag := hex.EncodeToString(hash[:])
 
-	_, err = targetFile.Write(fileBytes)
+	etag, sum, err := receiveBody(r, dst, algorithm)
+	if err == errInvalidDigest {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidDigest", err, s3.Key)
+	}
+	if err == errBadDigest {
+		return S.RespondError(w, http.StatusBadRequest, "BadDigest", err, s3.Key)
+	}
+	if err == S.ErrChunkSignature {
+		return S.RespondError(w, http.StatusForbidden, "SignatureDoesNotMatch", err, s3.Key)
+	}
 	if err != nil {
 		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 	}
 
-	err = fs.Setxattr(s3.Path, "etag", etag)
+	err = writer.Close()
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	if digest != nil {
+		err = storeBlob(s3.Mount, targetFile.Name(), hex.EncodeToString(digest.Sum(nil)))
+		if err != nil {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+	}
+
+	err = fs.Setxattr(targetFile.Name(), "etag", etag)
 	if err != nil {
 		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 	}
 
-	return S.Respond(w, http.StatusOK, nil, nil)
+	c := checksum{Algorithm: algorithm, Type: checksumFullObject, Value: sum}
+	err = c.write(targetFile.Name())
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	err = writeTags(targetFile.Name(), tags)
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	err = setObjectLock(targetFile.Name(), lock)
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	versionID := newVersionID(versioningStatus(s3.Mount, s3.Bucket))
+	err = commitObject(s3, targetFile.Name(), versionID)
+	if err == errObjectLocked {
+		return S.RespondError(w, http.StatusForbidden, "AccessDenied", err, s3.Key)
+	}
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	headers := make(map[string]string)
+	headers["ETag"] = "\"" + etag + "\""
+	if len(versionID) > 0 {
+		headers["x-amz-version-id"] = versionID
+	}
+	encryption.headers(headers)
+	c.headers(headers)
+
+	return S.Respond(w, http.StatusOK, headers, nil)
 }
 
 func UploadPart(w http.ResponseWriter, r *http.Request) error {
@@ -272,60 +716,127 @@ func UploadPart(w http.ResponseWriter, r *http.Request) error {
 
 	uploadID := filepath.Join(s3.Mount, Metadata, r.URL.Query().Get("uploadId"))
 	partNumber := filepath.Join(uploadID, r.URL.Query().Get("partNumber"))
-	if _, err := os.Stat(uploadID); os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
+	if _, err := fs.Stat(uploadID); !validUploadID(r.URL.Query().Get("uploadId")) || os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchUpload", err, s3.Key)
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("partNumber")); err != nil || n < 1 || n > 10000 {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
 	}
 
-	targetFile, err := os.Create(partNumber)
+	uploadAlgorithm, _ := fs.Getxattr(uploadID, "checksum-algorithm")
+	algorithm, err := requestedChecksum(r, uploadAlgorithm)
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", err, s3.Key)
+	}
+
+	targetFile, err := fs.CreateTemp(uploadID, "part")
 	if err != nil {
 		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 	}
+	defer fs.RemoveFile(targetFile.Name())
 	defer targetFile.Close()
 	defer r.Body.Close()
 
-	fileBytes, err := io.ReadAll(r.Body)
+	key, err := customerKey(r.Header, "X-Amz-Server-Side-Encryption-Customer-")
 	if err != nil {
-		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+	}
+	if code, awscode, err := checkCustomerKey(uploadID, key); err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
 	}
-	hash := md5.Sum(fileBytes)
-	etag := hex.EncodeToString(hash[:])
 
-	_, err = targetFile.Write(fileBytes)
+	encryption := storedEncryption(uploadID, key)
+	writer, err := encryptFile(s3, targetFile, encryption)
+	if err != nil {
+		code, awscode := encryptionErrorCode(err, http.StatusInternalServerError, "InternalError")
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	etag, sum, err := receiveBody(r, writer, algorithm)
+	if err == errInvalidDigest {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidDigest", err, s3.Key)
+	}
+	if err == errBadDigest {
+		return S.RespondError(w, http.StatusBadRequest, "BadDigest", err, s3.Key)
+	}
+	if err == S.ErrChunkSignature {
+		return S.RespondError(w, http.StatusForbidden, "SignatureDoesNotMatch", err, s3.Key)
+	}
 	if err != nil {
 		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 	}
 
-	err = fs.Setxattr(partNumber, "etag", etag)
+	err = writer.Close()
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	err = fs.Setxattr(targetFile.Name(), "etag", etag)
 	if err != nil {
 		return S.RespondError(w, http.StatusBadRequest, "InternalError", err, s3.Key)
 	}
 
-	w.Header().Set("ETag", "\""+etag+"\"")
-	return S.Respond(w, http.StatusOK, nil, nil)
+	c := checksum{Algorithm: algorithm, Type: checksumFullObject, Value: sum}
+	err = c.write(targetFile.Name())
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	err = fs.Rename(targetFile.Name(), partNumber)
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	headers := make(map[string]string)
+	headers["ETag"] = "\"" + etag + "\""
+	if len(algorithm) > 0 {
+		headers[checksumHeader(algorithm)] = sum
+	}
+	encryption.headers(headers)
+	return S.Respond(w, http.StatusOK, headers, nil)
 }
 
 func HeadObject(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#HeadObject: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusNotFound, "NoSuchKey", err, s3.Key)
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	key, err := customerKey(r.Header, "X-Amz-Server-Side-Encryption-Customer-")
+	if err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
+	}
+	if code, awscode, err := checkCustomerKey(path, key); err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
 	}
 
-	file, err := os.Stat(s3.Path)
+	file, err := fs.Stat(path)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 
 	headers := make(map[string]string)
 	t := file.ModTime()
-	headers["Content-Length"] = fmt.Sprintf("%v", file.Size())
+	headers["Content-Length"] = fmt.Sprintf("%v", objectSize(path, file))
 	headers["Last-Modified"] = t.Format(RFC822Format)
-	etag, err := fs.Getxattr(s3.Path, "etag")
+	etag, err := fs.Getxattr(path, "etag")
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 	headers["ETag"] = "\"" + etag + "\""
+	headers["Accept-Ranges"] = "bytes"
+	encryptionResponseHeaders(path, key, headers)
+	objectLockResponseHeaders(path, headers)
+	checksumResponseHeaders(r, path, headers)
+	taggingResponseHeaders(path, headers)
+	storageClassResponseHeaders(path, headers)
+	contentTypeResponseHeaders(path, headers)
+	if path == s3.Path {
+		expirationResponseHeaders(s3, path, headers)
+	}
 
 	return S.Respond(w, http.StatusOK, headers, nil)
 }
@@ -334,85 +845,82 @@ func GetObject(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#GetObject: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
-		return S.RespondError(w, 400, "NoSuchKey", err, s3.Key)
-	}
-
-	file, err := os.Open(s3.Path)
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
 	if err != nil {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		return S.RespondError(w, code, awscode, err, s3.Key)
 	}
-	stats, err := file.Stat()
+
+	key, err := customerKey(r.Header, "X-Amz-Server-Side-Encryption-Customer-")
 	if err != nil {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Key)
 	}
-	if stats.IsDir() {
-		return S.RespondError(w, 400, "NoSuchKey", err, s3.Key)
+	if code, awscode, err := checkCustomerKey(path, key); err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
 	}
 
 	headers := make(map[string]string)
-	t := stats.ModTime()
-	headers["Content-Length"] = fmt.Sprintf("%v", stats.Size())
-	headers["Last-Modified"] = t.Format(RFC822Format)
-
-	return S.RespondFile(w, http.StatusOK, headers, file)
-}
-
-func ListObjectVersions(w http.ResponseWriter, r *http.Request) error {
-	log.Printf("#ListObjectVersions: %v\n", r)
-	s3 := r.Context().Value(S.Request{}).(S.Request)
-
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
-		return S.RespondError(w, 400, "NoSuchKey", err, s3.Key)
+	if s3.Verify {
+		_, err := verifyObject(s3, path, key, nil)
+		if errors.Is(err, errBitrot) {
+			log.Printf(">>> GetObject >>> %s: %s", path, err)
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		}
+		if err == nil {
+			headers["x-tri-verified"] = "true"
+		}
 	}
 
-	file, err := os.Open(s3.Path)
+	stats, err := fs.Stat(path)
 	if err != nil {
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
-	stats, err := file.Stat()
+	content, _, err := openObject(s3, path, key)
 	if err != nil {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+		code, awscode := encryptionErrorCode(err, http.StatusInternalServerError, "InternalError")
+		return S.RespondError(w, code, awscode, err, s3.Key)
 	}
-	t := stats.ModTime()
-	return S.RespondXML(w, http.StatusOK, S.ListVersionsResult{
-		Name:        s3.Bucket,
-		Prefix:      s3.Key,
-		MaxKeys:     1,
-		IsTruncated: false,
-		Version: []S.ObjectVersion{
-			{
-				Object: S.Object{
-					Key:          s3.Key,
-					LastModified: t.Format(ISO8601UTCFormat),
-					ETag:         "xxx",
-					Size:         stats.Size(),
-					StorageClass: "STANDARD",
-					Owner:        &S.Owner{ID: "id", DisplayName: "name"},
-				},
-				IsLatest:  true,
-				VersionID: "xxx",
-			},
-		},
-	})
+
+	if etag, err := fs.Getxattr(path, "etag"); err == nil {
+		headers["ETag"] = "\"" + etag + "\""
+	}
+	encryptionResponseHeaders(path, key, headers)
+	objectLockResponseHeaders(path, headers)
+	checksumResponseHeaders(r, path, headers)
+	taggingResponseHeaders(path, headers)
+	storageClassResponseHeaders(path, headers)
+	contentTypeResponseHeaders(path, headers)
+	if path == s3.Path {
+		expirationResponseHeaders(s3, path, headers)
+	}
+
+	return S.RespondContent(w, r, headers, stats.ModTime(), content)
 }
 
 func DeleteObject(w http.ResponseWriter, r *http.Request) error {
 	log.Printf("#DeleteObject: %v\n", r)
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
-	if _, err := os.Stat(s3.Path); os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
-	}
-
-	if err := os.RemoveAll(s3.Path); err != nil {
+	versionID := r.URL.Query().Get("versionId")
+	deleted, err := deleteObject(s3, versionID)
+	if err != nil {
+		if os.IsNotExist(err) && len(versionID) > 0 {
+			return S.RespondError(w, http.StatusNotFound, "NoSuchVersion", err, s3.Key)
+		}
+		if err == errObjectLocked {
+			return S.RespondError(w, http.StatusForbidden, "AccessDenied", err, s3.Key)
+		}
 		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
 	}
 
-	fs.CleanupEmptyDirs(s3.Path, filepath.Join(s3.Mount, s3.Bucket))
-
 	headers := make(map[string]string)
 	headers["Content-Length"] = "0"
+	if deleted.DeleteMarker {
+		headers["x-amz-delete-marker"] = "true"
+		headers["x-amz-version-id"] = deleted.DeleteMarkerVersionID
+	}
+	if len(deleted.VersionID) > 0 {
+		headers["x-amz-version-id"] = deleted.VersionID
+	}
 
 	return S.Respond(w, http.StatusOK, headers, nil)
 }
@@ -422,6 +930,16 @@ func DeleteObjects(w http.ResponseWriter, r *http.Request) error {
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
 	body, _ := io.ReadAll(r.Body)
+	switch err := verifyBody(r, body); err {
+	case nil:
+	case errBadDigest:
+		return S.RespondError(w, http.StatusBadRequest, "BadDigest", err, s3.Bucket)
+	case errInvalidDigest:
+		return S.RespondError(w, http.StatusBadRequest, "InvalidDigest", err, s3.Bucket)
+	default:
+		return S.RespondError(w, http.StatusBadRequest, "InvalidRequest", err, s3.Bucket)
+	}
+
 	var delete S.Delete
 	err := xml.Unmarshal(body, &delete)
 	if err != nil {
@@ -431,34 +949,27 @@ func DeleteObjects(w http.ResponseWriter, r *http.Request) error {
 	objects := []S.DeletedObject{}
 	errors := []S.DeleteError{}
 	for _, file := range delete.Objects {
-		path := filepath.Join(s3.Mount, s3.Bucket, file.Key)
-		delErr := S.DeleteError{}
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			delErr = S.DeleteError{
-				Code:    "NoSuchKey",
-				Message: "NoSuchKey",
-				Key:     file.Key,
-			}
-		}
-
-		if err := os.RemoveAll(path); err != nil {
-			delErr = S.DeleteError{
-				Code:    "NoSuchKey",
-				Message: "NoSuchKey",
-				Key:     file.Key,
+		deleted, err := deleteObject(objectRequest(s3, file.Key), file.VersionID)
+		if err != nil {
+			code := "InternalError"
+			if err == errObjectLocked {
+				code = "AccessDenied"
 			}
-		}
-
-		fs.CleanupEmptyDirs(path, filepath.Join(s3.Mount, s3.Bucket))
-
-		if delErr != (S.DeleteError{}) {
-			errors = append(errors, delErr)
-		} else {
-			obj := S.DeletedObject{
-				Key: file.Key,
+			if os.IsNotExist(err) {
+				code = "NoSuchKey"
+				if len(file.VersionID) > 0 {
+					code = "NoSuchVersion"
+				}
 			}
-			objects = append(objects, obj)
+			errors = append(errors, S.DeleteError{
+				Code:      code,
+				Message:   code,
+				Key:       file.Key,
+				VersionID: file.VersionID,
+			})
+			continue
 		}
+		objects = append(objects, deleted)
 	}
 
 	return S.RespondXML(w, http.StatusOK, S.DeleteObjectsResponse{
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func TestCompleteMultipartUpload(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+	initiate := func(target string) string {
+		t.Helper()
+		initiated := S.InitiateMultipartUploadResponse{}
+		if err := xml.Unmarshal(do(Post, "POST", target+"?uploads", "").Body.Bytes(), &initiated); err != nil {
+			t.Fatal(err)
+		}
+		return initiated.UploadID
+	}
+	upload := func(target string, id string, parts []string) string {
+		t.Helper()
+		var complete strings.Builder
+		complete.WriteString("<CompleteMultipartUpload>")
+		for i, part := range parts {
+			w := do(Put, "PUT", fmt.Sprintf("%s?partNumber=%d&uploadId=%s", target, i+1, id), part)
+			if w.Code != 200 {
+				t.Fatalf("part %d: %d %s", i+1, w.Code, w.Body)
+			}
+			fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, w.Header().Get("ETag"))
+		}
+		complete.WriteString("</CompleteMultipartUpload>")
+		return complete.String()
+	}
+
+	parts := []string{strings.Repeat("a", 5<<20), "", strings.Repeat("bc", 1<<20+7), "d"}
+	id := initiate("/bucket/key")
+	w := do(Post, "POST", "/bucket/key?uploadId="+id, upload("/bucket/key", id, parts))
+	result := S.CompleteMultipartUploadResult{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); w.Code != 200 || err != nil {
+		t.Fatalf("complete: %d %v %s", w.Code, err, w.Body)
+	}
+	digests := md5.New()
+	for _, part := range parts {
+		sum := md5.Sum([]byte(part))
+		digests.Write(sum[:])
+	}
+	if etag := fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(digests.Sum(nil)), len(parts)); result.ETag != etag {
+		t.Errorf("ETag %s, want %s", result.ETag, etag)
+	}
+	if w := do(Get, "GET", "/bucket/key", ""); w.Body.String() != strings.Join(parts, "") {
+		t.Errorf("assembled object differs: %d bytes", w.Body.Len())
+	}
+
+	// The 200 is sent before the parts are assembled, so a failure is only
+	// reported in the body.
+	id = initiate("/bucket/file/key")
+	complete := upload("/bucket/file/key", id, parts[3:])
+	do(Put, "PUT", "/bucket/file", "data")
+	w = do(Post, "POST", "/bucket/file/key?uploadId="+id, complete)
+	failure := S.Error{}
+	if err := xml.Unmarshal(w.Body.Bytes(), &failure); w.Code != 200 || err != nil || failure.Code != "InternalError" {
+		t.Errorf("failed complete: %d %v %s", w.Code, err, w.Body)
+	}
+}
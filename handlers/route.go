@@ -4,7 +4,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
+	"github.com/autovia/tri/fs"
 	S "github.com/autovia/tri/structs"
 )
 
@@ -16,21 +18,58 @@ func Get(w http.ResponseWriter, r *http.Request) error {
 		return ListBuckets(w, r)
 	}
 
-	stat, err := os.Stat(s3.Path)
-	if os.IsNotExist(err) {
-		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
-	}
+	if isBucketRequest(r) {
+		if r.URL.Query().Has("versions") {
+			return ListObjectVersions(w, r)
+		}
 
-	if r.URL.Query().Has("versioning") {
-		return GetBucketVersioning(w, r)
-	}
+		if r.URL.Query().Has("versioning") {
+			return GetBucketVersioning(w, r)
+		}
 
-	if stat.IsDir() {
-		return ListObjectsV2(w, r)
+		if r.URL.Query().Has("lifecycle") {
+			return GetBucketLifecycleConfiguration(w, r)
+		}
+
+		if r.URL.Query().Has("object-lock") {
+			return GetObjectLockConfiguration(w, r)
+		}
+
+		if r.URL.Query().Has("location") {
+			return GetBucketLocation(w, r)
+		}
+
+		if r.URL.Query().Has("tagging") {
+			return GetBucketTagging(w, r)
+		}
+
+		if len(bucketSubresourceName(r)) > 0 {
+			return GetBucketSubresource(w, r)
+		}
+	} else {
+		if r.URL.Query().Has("retention") {
+			return GetObjectRetention(w, r)
+		}
+
+		if r.URL.Query().Has("legal-hold") {
+			return GetObjectLegalHold(w, r)
+		}
+
+		if r.URL.Query().Has("attributes") {
+			return GetObjectAttributes(w, r)
+		}
+
+		if r.URL.Query().Has("tagging") {
+			return GetObjectTagging(w, r)
+		}
 	}
 
-	if r.URL.Query().Has("versions") {
-		return ListObjectVersions(w, r)
+	stat, err := fs.Stat(s3.Path)
+	if isBucketRequest(r) || (err == nil && stat.IsDir()) {
+		if os.IsNotExist(err) {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+		}
+		return ListObjectsV2(w, r)
 	}
 
 	return GetObject(w, r)
@@ -41,6 +80,15 @@ func Put(w http.ResponseWriter, r *http.Request) error {
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
 	if len(s3.Key) > 0 {
+		if r.URL.Query().Has("retention") {
+			return PutObjectRetention(w, r)
+		}
+		if r.URL.Query().Has("legal-hold") {
+			return PutObjectLegalHold(w, r)
+		}
+		if r.URL.Query().Has("tagging") {
+			return PutObjectTagging(w, r)
+		}
 		if len(r.Header.Get("X-Amz-Copy-Source")) > 0 {
 			return CopyObject(w, r)
 		}
@@ -50,12 +98,36 @@ func Put(w http.ResponseWriter, r *http.Request) error {
 		return PutObject(w, r)
 	}
 
+	if r.URL.Query().Has("versioning") {
+		return PutBucketVersioning(w, r)
+	}
+
+	if r.URL.Query().Has("lifecycle") {
+		return PutBucketLifecycleConfiguration(w, r)
+	}
+
+	if r.URL.Query().Has("object-lock") {
+		return PutObjectLockConfiguration(w, r)
+	}
+
+	if r.URL.Query().Has("tagging") {
+		return PutBucketTagging(w, r)
+	}
+
+	if len(bucketSubresourceName(r)) > 0 {
+		return PutBucketSubresource(w, r)
+	}
+
 	return CreateBucket(w, r)
 }
 
 func Post(w http.ResponseWriter, r *http.Request) error {
 	log.Printf(">>> POST %v\n", r)
 
+	if strings.HasPrefix(r.Header.Get("X-Amz-Target"), "TrentService.") {
+		return KMS(w, r)
+	}
+
 	if r.URL.Query().Has("uploads") {
 		return CreateMultipartUpload(w, r)
 	}
@@ -76,9 +148,27 @@ func Delete(w http.ResponseWriter, r *http.Request) error {
 	s3 := r.Context().Value(S.Request{}).(S.Request)
 
 	if len(s3.Key) > 0 {
+		if r.URL.Query().Has("uploadId") {
+			return AbortMultipartUpload(w, r)
+		}
+		if r.URL.Query().Has("tagging") {
+			return DeleteObjectTagging(w, r)
+		}
 		return DeleteObject(w, r)
 	}
 
+	if r.URL.Query().Has("lifecycle") {
+		return DeleteBucketLifecycle(w, r)
+	}
+
+	if r.URL.Query().Has("tagging") {
+		return DeleteBucketTagging(w, r)
+	}
+
+	if len(bucketSubresourceName(r)) > 0 {
+		return DeleteBucketSubresource(w, r)
+	}
+
 	return DeleteBucket(w, r)
 }
 
@@ -91,3 +181,7 @@ func Head(w http.ResponseWriter, r *http.Request) error {
 	}
 	return HeadBucket(w, r)
 }
+
+func isBucketRequest(r *http.Request) bool {
+	return !strings.Contains(strings.Trim(r.URL.Path, "/"), "/")
+}
@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const quarantineDir = "quarantine"
+
+var errBitrot = errors.New("object data does not match its ETag or checksum")
+var errUnverifiable = errors.New("object data can not be verified by the server")
+
+// ScrubResult counts what a scrub found. Corrupt lists the objects whose data
+// no longer matches their ETag or checksum, Quarantined where they were moved.
+type ScrubResult struct {
+	Objects     int
+	Bytes       int64
+	Skipped     int
+	Corrupt     []string
+	Quarantined map[string]string
+	Errors      int
+}
+
+// throttle limits the rate data is read at across all files of a scrub.
+type throttle struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+func (t *throttle) wait(n int) {
+	if t == nil || t.rate <= 0 {
+		return
+	}
+	t.read += int64(n)
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	time.Sleep(time.Until(due))
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.wait(n)
+	return n, err
+}
+
+// partSizes returns the sizes of the parts of a multipart object as recorded
+// when it was completed.
+func partSizes(mount string, path string, parts int) ([]int64, bool) {
+	layout, err := readPartLayout(mount, path)
+	if err != nil {
+		return nil, false
+	}
+	sizes := []int64{}
+	for _, entry := range strings.Split(layout, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 {
+			return nil, false
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, len(sizes) == parts
+}
+
+// verifyObject reads the data of the object at path and compares it with its
+// ETag and checksum, part by part for multipart objects, and returns how much
+// it read. Objects encrypted with a customer key that is not given and copies
+// of multipart objects, which lack their part layout, are unverifiable.
+func verifyObject(s3 S.Request, path string, key []byte, t *throttle) (int64, error) {
+	etag, err := fs.Getxattr(path, "etag")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := fs.Getxattr(path, "sse-customer"); err == nil && key == nil {
+		return 0, errUnverifiable
+	}
+	digest, count, multipart := strings.Cut(etag, "-")
+	if raw, err := hex.DecodeString(digest); err != nil || len(raw) != md5.Size {
+		return 0, errUnverifiable
+	}
+	var sizes []int64
+	if multipart {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, errUnverifiable
+		}
+		var ok bool
+		if sizes, ok = partSizes(s3.Mount, path, n); !ok {
+			return 0, errUnverifiable
+		}
+	}
+	sum, hasSum := readChecksum(path)
+
+	file, size, err := openObject(s3, path, key)
+	if err == errCorruptObject {
+		return 0, fmt.Errorf("%w: %v", errBitrot, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if t != nil {
+		reader = throttledReader{file, t}
+	}
+	if !multipart {
+		sizes = []int64{size}
+	}
+
+	var whole hash.Hash
+	if hasSum && sum.Type == checksumFullObject {
+		whole = newChecksumHash(sum.Algorithm)
+	}
+	var read int64
+	digests := md5.New()
+	partDigest := []byte{}
+	sums := []string{}
+	for _, n := range sizes {
+		part := md5.New()
+		writers := []io.Writer{part}
+		var partSum hash.Hash
+		if hasSum && sum.Type == checksumComposite {
+			partSum = newChecksumHash(sum.Algorithm)
+			writers = append(writers, partSum)
+		}
+		if whole != nil {
+			writers = append(writers, whole)
+		}
+		copied, err := io.CopyN(io.MultiWriter(writers...), reader, n)
+		read += copied
+		if err != nil {
+			return read, fmt.Errorf("%w: %v", errBitrot, err)
+		}
+		partDigest = part.Sum(nil)
+		digests.Write(partDigest)
+		if partSum != nil {
+			sums = append(sums, base64.StdEncoding.EncodeToString(partSum.Sum(nil)))
+		}
+	}
+	if n, _ := reader.Read(make([]byte, 1)); n > 0 {
+		return read, fmt.Errorf("%w: data is longer than %d bytes", errBitrot, read)
+	}
+
+	computed := hex.EncodeToString(partDigest)
+	if multipart {
+		computed = fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), len(sizes))
+	}
+	if computed != etag {
+		return read, fmt.Errorf("%w: ETag %s computed as %s", errBitrot, etag, computed)
+	}
+	if hasSum {
+		value := ""
+		switch {
+		case whole != nil:
+			value = base64.StdEncoding.EncodeToString(whole.Sum(nil))
+		case len(sums) > 0:
+			value, _ = combineChecksums(sum.Algorithm, sum.Type, sums, sizes)
+		}
+		if len(value) > 0 && value != sum.Value {
+			return read, fmt.Errorf("%w: %s %s computed as %s", errBitrot, sum.Algorithm, sum.Value, value)
+		}
+	}
+	return read, nil
+}
+
+// quarantineObject moves the object at path, with its metadata, to the same
+// place below the quarantine directory of the mount, so it is no longer served.
+func quarantineObject(mount string, path string, reason error) (string, error) {
+	rel, err := filepath.Rel(mount, path)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(mount, Metadata, quarantineDir, rel)
+	if _, err := fs.Lstat(target); err == nil {
+		target += "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	if err := fs.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := fs.Setxattr(path, "quarantine-reason", reason.Error()); err != nil {
+		return "", err
+	}
+	if err := fs.Rename(path, target); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(rel, Metadata+string(filepath.Separator)) {
+		bucket, _, _ := strings.Cut(rel, string(filepath.Separator))
+		fs.CleanupEmptyDirs(path, filepath.Join(mount, bucket))
+	}
+	return target, nil
+}
+
+// scrubPaths calls f with every object version stored below the mount: the
+// current versions in the buckets and the versions kept aside.
+func scrubPaths(mount string, f func(path string)) error {
+	entries, err := fs.ReadDir(mount)
+	if err != nil {
+		return err
+	}
+	roots := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != Metadata {
+			roots = append(roots, filepath.Join(mount, entry.Name()))
+		}
+	}
+	roots = append(roots, filepath.Join(mount, Metadata, versionsDir))
+
+	for _, root := range roots {
+		err := fs.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			if marker, _ := fs.Getxattr(path, "delete-marker"); marker == "true" {
+				return nil
+			}
+			f(path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scrub verifies every object version below the mount, reading at most rate
+// bytes per second, and quarantines the corrupt ones if asked to. Objects
+// verified after skipBefore are skipped, which lets a scrub that was
+// interrupted carry on where it stopped.
+func Scrub(s3 S.Request, rate int64, quarantine bool, skipBefore time.Time) (ScrubResult, error) {
+	result := ScrubResult{Quarantined: map[string]string{}}
+	t := newThrottle(rate)
+	err := scrubPaths(s3.Mount, func(path string) {
+		if value, err := fs.Getxattr(path, "scrubbed"); err == nil {
+			if scrubbed, err := time.Parse(time.RFC3339, value); err == nil && scrubbed.After(skipBefore) {
+				return
+			}
+		}
+		// Files changed outside tri are not corrupt, they lack metadata.
+		if objectChanged(path) {
+			if _, err := adoptObject(s3, path); err != nil {
+				result.Errors++
+				log.Printf("#Scrub: %s: %s", path, err)
+			}
+			return
+		}
+		before, err := fs.Stat(path)
+		if err != nil {
+			result.Errors++
+			log.Printf("#Scrub: %s", err)
+			return
+		}
+
+		n, err := verifyObject(s3, path, nil, t)
+		result.Bytes += n
+		switch {
+		case err == nil:
+			result.Objects++
+			fs.Setxattr(path, "scrubbed", time.Now().UTC().Format(time.RFC3339))
+			return
+		case err == errUnverifiable:
+			result.Skipped++
+			return
+		case !errors.Is(err, errBitrot):
+			result.Errors++
+			log.Printf("#Scrub: %s: %s", path, err)
+			return
+		}
+
+		// The object may have been replaced while it was read.
+		unlock := lockKey(path)
+		defer unlock()
+		after, statErr := fs.Stat(path)
+		if statErr != nil || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+			return
+		}
+		result.Objects++
+		result.Corrupt = append(result.Corrupt, path)
+		log.Printf("#Scrub: %s: %s", path, err)
+		if !quarantine {
+			return
+		}
+		target, err := quarantineObject(s3.Mount, path, err)
+		if err != nil {
+			result.Errors++
+			log.Printf("#Scrub: can not quarantine %s: %s", path, err)
+			return
+		}
+		result.Quarantined[path] = target
+	})
+	return result, err
+}
+
+// Scrubber scrubs the mount every scrub interval, skipping the objects
+// verified during the last one, until ctx is done.
+func Scrubber(ctx context.Context, app *S.App) {
+	if *app.ScrubInterval <= 0 {
+		return
+	}
+	s3 := S.Request{Mount: *app.Mount, Tiers: &app.Tiers, MasterKey: app.MasterKey}
+
+	ticker := time.NewTicker(*app.ScrubInterval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		result, err := Scrub(s3, *app.ScrubRate<<20, true, start.Add(-*app.ScrubInterval))
+		if err != nil {
+			log.Printf("#Scrubber: %s", err)
+		}
+		log.Printf("#Scrubber: verified %d objects (%d bytes) in %s, %d corrupt, %d unverifiable, %d errors",
+			result.Objects, result.Bytes, time.Since(start).Round(time.Second), len(result.Corrupt), result.Skipped, result.Errors)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+func TestScrub(t *testing.T) {
+	mount := t.TempDir()
+	bucket := filepath.Join(mount, "bucket")
+	if err := os.MkdirAll(filepath.Join(bucket, "dir"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	md5hex := func(data string) string {
+		sum := md5.Sum([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	put := func(key, data string, metadata map[string]string) string {
+		path := filepath.Join(bucket, key)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range metadata {
+			if err := fs.Setxattr(path, k, v); err != nil {
+				t.Skipf("xattrs not supported: %s", err)
+			}
+		}
+		return path
+	}
+
+	put("good", "intact data", map[string]string{"etag": md5hex("intact data")})
+	c, err := fileChecksum(S.Request{Mount: mount}, filepath.Join(bucket, "good"), nil, "CRC32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.write(filepath.Join(bucket, "good"))
+	parts, _ := hex.DecodeString(md5hex("first") + md5hex("second"))
+	put("multipart", "firstsecond", map[string]string{
+		"etag":  fmt.Sprintf("%s-2", md5hex(string(parts))),
+		"parts": "1:5,2:6",
+	})
+	bad := put("dir/bad", "rotten data", map[string]string{"etag": md5hex("intact data")})
+	put("copied", "copy", map[string]string{"etag": md5hex("x") + "-3"})
+
+	s3 := S.Request{Mount: mount}
+	if _, err := verifyObject(s3, bad, nil, nil); err == nil || !strings.Contains(err.Error(), errBitrot.Error()) {
+		t.Errorf("corrupt object verified: %v", err)
+	}
+
+	result, err := Scrub(s3, 0, true, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Objects != 3 || result.Skipped != 1 || result.Errors != 0 || len(result.Corrupt) != 1 || result.Corrupt[0] != bad {
+		t.Fatalf("unexpected scrub result %+v", result)
+	}
+	target := filepath.Join(mount, Metadata, quarantineDir, "bucket", "dir", "bad")
+	if result.Quarantined[bad] != target {
+		t.Errorf("quarantined to %q", result.Quarantined[bad])
+	}
+	if _, err := os.Stat(filepath.Join(bucket, "dir")); !os.IsNotExist(err) {
+		t.Errorf("empty directory left behind: %v", err)
+	}
+	if reason, err := fs.Getxattr(target, "quarantine-reason"); err != nil || len(reason) == 0 {
+		t.Errorf("quarantine reason not kept: %q %v", reason, err)
+	}
+
+	os.WriteFile(filepath.Join(bucket, "good"), []byte("intact dat4"), 0644)
+	if result, _ := Scrub(s3, 0, false, time.Now().Add(-time.Hour)); result.Objects != 0 {
+		t.Errorf("recently verified objects scrubbed again: %+v", result)
+	}
+	if result, _ := Scrub(s3, 0, false, time.Now().Add(time.Second)); len(result.Corrupt) != 1 {
+		t.Errorf("checksum mismatch not found: %+v", result)
+	}
+}
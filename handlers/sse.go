@@ -0,0 +1,668 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const (
+	sseAES256         = "AES256"
+	sseKMS            = "aws:kms"
+	bucketEncryption  = "encryption"
+	sseChunkSize      = 64 * 1024
+	sseKeySize        = 32
+	sseNonceSize      = 12
+	sseSaltSize       = 16
+	sseOverhead       = 16
+	sseFinalChunk     = 1
+	sseIntermediate   = 0
+	masterKeyFileMode = 0600
+)
+
+var errEncryptionNotConfigured = errors.New("server side encryption requires a master key")
+var errInvalidEncryption = errors.New("invalid server side encryption algorithm")
+var errCorruptObject = errors.New("encrypted object data is corrupt")
+var errInvalidCustomerKey = errors.New("invalid customer key, algorithm or key MD5")
+var errMissingCustomerKey = errors.New("the object is encrypted with a customer key, which must be provided")
+var errWrongCustomerKey = errors.New("the provided customer key does not match the key used to encrypt the object")
+var errUnexpectedCustomerKey = errors.New("the object is not encrypted with a customer key")
+var errInvalidEncryptionContext = errors.New("the encryption context is not a base64 encoded JSON object")
+
+// serverSideEncryption is the encryption of object data at rest, either with
+// the master key (SSE-S3), with a key provided by the client (SSE-C) or with a
+// key of the local key management service (SSE-KMS).
+type serverSideEncryption struct {
+	Algorithm   string
+	CustomerKey []byte
+	KMSKeyID    string
+	Context     map[string]string
+}
+
+// LoadMasterKey reads the hex encoded master key from path, creating the file
+// with a random key when it does not exist yet. The key file belongs to the
+// host, not to the storage, so it is read from the local filesystem whatever
+// the backend.
+func LoadMasterKey(path string) (*[sseKeySize]byte, error) {
+	var key [sseKeySize]byte
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, err := rand.Read(key[:]); err != nil {
+			return nil, err
+		}
+		return &key, os.WriteFile(path, []byte(hex.EncodeToString(key[:])+"\n"), masterKeyFileMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(raw) != sseKeySize {
+		return nil, errors.New("master key must be 32 hex encoded bytes")
+	}
+	copy(key[:], raw)
+	return &key, nil
+}
+
+// requestedEncryption returns the server side encryption of a write, taken
+// from the customer key headers, the x-amz-server-side-encryption header or
+// the bucket default.
+func requestedEncryption(s3 S.Request, r *http.Request) (serverSideEncryption, error) {
+	key, err := customerKey(r.Header, "X-Amz-Server-Side-Encryption-Customer-")
+	if err != nil {
+		return serverSideEncryption{}, err
+	}
+	algorithm := r.Header.Get("X-Amz-Server-Side-Encryption")
+	if key != nil {
+		if len(algorithm) > 0 {
+			return serverSideEncryption{}, errInvalidEncryption
+		}
+		return serverSideEncryption{Algorithm: sseAES256, CustomerKey: key}, nil
+	}
+
+	keyID := r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id")
+	context := r.Header.Get("X-Amz-Server-Side-Encryption-Context")
+	if len(algorithm) == 0 {
+		if len(keyID) > 0 || len(context) > 0 {
+			return serverSideEncryption{}, errInvalidEncryption
+		}
+		var config S.ServerSideEncryptionConfiguration
+		if err := readBucketConfig(s3.Mount, s3.Bucket, bucketEncryption, &config); err == nil && len(config.Rules) > 0 {
+			algorithm = config.Rules[0].ApplyServerSideEncryptionByDefault.SSEAlgorithm
+			keyID = config.Rules[0].ApplyServerSideEncryptionByDefault.KMSMasterKeyID
+		}
+	}
+	if len(algorithm) == 0 {
+		return serverSideEncryption{}, nil
+	}
+	if algorithm != sseAES256 && algorithm != sseKMS {
+		return serverSideEncryption{}, errInvalidEncryption
+	}
+	if algorithm == sseAES256 && (len(keyID) > 0 || len(context) > 0) {
+		return serverSideEncryption{}, errInvalidEncryption
+	}
+	if s3.MasterKey == nil {
+		return serverSideEncryption{}, errEncryptionNotConfigured
+	}
+	if algorithm == sseAES256 {
+		return serverSideEncryption{Algorithm: algorithm}, nil
+	}
+
+	e := serverSideEncryption{Algorithm: algorithm, Context: map[string]string{}}
+	if len(context) > 0 {
+		data, err := base64.StdEncoding.DecodeString(context)
+		if err != nil || json.Unmarshal(data, &e.Context) != nil {
+			return serverSideEncryption{}, errInvalidEncryptionContext
+		}
+	}
+	if _, ok := e.Context["aws:s3:arn"]; !ok {
+		e.Context["aws:s3:arn"] = fmt.Sprintf("arn:aws:s3:::%s/%s", s3.Bucket, s3.Key)
+	}
+
+	kmsKey, err := resolveKMSKey(s3, keyID)
+	if err != nil {
+		return serverSideEncryption{}, err
+	}
+	if !kmsKey.Enabled {
+		return serverSideEncryption{}, errKMSDisabled
+	}
+	e.KMSKeyID = kmsARN(s3, kmsKey.KeyID)
+	return e, nil
+}
+
+// resolveKMSKey returns the key of the local key management service with the
+// given id, ARN or alias, or the default key when ref is empty.
+func resolveKMSKey(s3 S.Request, ref string) (S.KMSKey, error) {
+	if len(ref) == 0 {
+		return defaultKMSKey(s3)
+	}
+	return readKMSKey(s3, ref)
+}
+
+// customerKey decodes the SSE-C headers starting with prefix, returning nil
+// when they are absent.
+func customerKey(header http.Header, prefix string) ([]byte, error) {
+	algorithm := header.Get(prefix + "Algorithm")
+	value := header.Get(prefix + "Key")
+	digest := header.Get(prefix + "Key-Md5")
+	if len(algorithm) == 0 && len(value) == 0 && len(digest) == 0 {
+		return nil, nil
+	}
+	if algorithm != sseAES256 {
+		return nil, errInvalidCustomerKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != sseKeySize {
+		return nil, errInvalidCustomerKey
+	}
+	sum := md5.Sum(key)
+	if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errInvalidCustomerKey
+	}
+	return key, nil
+}
+
+// storedEncryption returns the encryption of the object or upload at path,
+// completed with the customer key of the request.
+func storedEncryption(path string, key []byte) serverSideEncryption {
+	if algorithm, err := fs.Getxattr(path, "sse-customer"); err == nil {
+		return serverSideEncryption{Algorithm: algorithm, CustomerKey: key}
+	}
+	algorithm, err := fs.Getxattr(path, "sse")
+	if err != nil {
+		return serverSideEncryption{}
+	}
+	e := serverSideEncryption{Algorithm: algorithm}
+	if algorithm == sseKMS {
+		e.KMSKeyID, _ = fs.Getxattr(path, "sse-kms-key-id")
+		if context, err := fs.Getxattr(path, "sse-context"); err == nil {
+			json.Unmarshal([]byte(context), &e.Context)
+		}
+	}
+	return e
+}
+
+// checkCustomerKey verifies the customer key of a request against the salted
+// fingerprint stored with the object or upload at path.
+func checkCustomerKey(path string, key []byte) (int, string, error) {
+	fingerprint, err := fs.Getxattr(path, "sse-fingerprint")
+	if err != nil {
+		if key != nil {
+			return http.StatusBadRequest, "InvalidRequest", errUnexpectedCustomerKey
+		}
+		return 0, "", nil
+	}
+	if key == nil {
+		return http.StatusBadRequest, "InvalidRequest", errMissingCustomerKey
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(fingerprint)
+	if err != nil || len(raw) < sseSaltSize || !hmac.Equal(raw, keyFingerprint(raw[:sseSaltSize], key)) {
+		return http.StatusForbidden, "AccessDenied", errWrongCustomerKey
+	}
+	return 0, "", nil
+}
+
+func keyFingerprint(salt []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(key)
+	return mac.Sum(bytes.Clone(salt))
+}
+
+func (e serverSideEncryption) write(path string) error {
+	if len(e.Algorithm) == 0 {
+		return nil
+	}
+	if e.Algorithm == sseKMS {
+		if err := fs.Setxattr(path, "sse-kms-key-id", e.KMSKeyID); err != nil {
+			return err
+		}
+		if err := fs.Setxattr(path, "sse-context", string(encryptionContext(e.Context))); err != nil {
+			return err
+		}
+	}
+	if e.CustomerKey == nil {
+		return fs.Setxattr(path, "sse", e.Algorithm)
+	}
+
+	salt := make([]byte, sseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	if err := fs.Setxattr(path, "sse-customer", e.Algorithm); err != nil {
+		return err
+	}
+	return fs.Setxattr(path, "sse-fingerprint", base64.StdEncoding.EncodeToString(keyFingerprint(salt, e.CustomerKey)))
+}
+
+func (e serverSideEncryption) headers(headers map[string]string) {
+	if len(e.Algorithm) == 0 {
+		return
+	}
+	if e.Algorithm == sseKMS {
+		headers["x-amz-server-side-encryption-aws-kms-key-id"] = e.KMSKeyID
+		headers["x-amz-server-side-encryption-context"] = base64.StdEncoding.EncodeToString(encryptionContext(e.Context))
+	}
+	if e.CustomerKey == nil {
+		headers["x-amz-server-side-encryption"] = e.Algorithm
+		return
+	}
+	sum := md5.Sum(e.CustomerKey)
+	headers["x-amz-server-side-encryption-customer-algorithm"] = e.Algorithm
+	headers["x-amz-server-side-encryption-customer-key-MD5"] = base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func validEncryptionConfiguration(s3 S.Request, v any) error {
+	config := v.(*S.ServerSideEncryptionConfiguration)
+	if len(config.Rules) != 1 {
+		return errors.New("encryption configuration requires exactly one rule")
+	}
+	rule := config.Rules[0].ApplyServerSideEncryptionByDefault
+	switch {
+	case rule.SSEAlgorithm != sseAES256 && rule.SSEAlgorithm != sseKMS:
+		return errInvalidEncryption
+	case rule.SSEAlgorithm == sseAES256 && len(rule.KMSMasterKeyID) > 0:
+		return errors.New("a KMS key id requires the aws:kms algorithm")
+	case s3.MasterKey == nil:
+		return errEncryptionNotConfigured
+	case len(rule.KMSMasterKeyID) > 0:
+		_, err := readKMSKey(s3, rule.KMSMasterKeyID)
+		return err
+	}
+	return nil
+}
+
+// encryptionErrorCode returns the response code of a server side encryption
+// error, falling back to code and awscode for other errors.
+func encryptionErrorCode(err error, code int, awscode string) (int, string) {
+	switch err {
+	case errEncryptionNotConfigured:
+		return http.StatusNotImplemented, "NotImplemented"
+	case errKMSNotFound:
+		return http.StatusBadRequest, "KMS.NotFoundException"
+	case errKMSDisabled:
+		return http.StatusBadRequest, "KMS.DisabledException"
+	}
+	return code, awscode
+}
+
+func encryptionResponseHeaders(path string, key []byte, headers map[string]string) {
+	storedEncryption(path, key).headers(headers)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey seals a data key with a master or customer key, prefixed by its nonce.
+func wrapKey(master []byte, key []byte) (string, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, sseNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, key, nil)), nil
+}
+
+func unwrapKey(master []byte, wrapped string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(raw) < sseNonceSize {
+		return nil, errCorruptObject
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, raw[:sseNonceSize], raw[sseNonceSize:], nil)
+}
+
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, sseNonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// sealWriter encrypts object data in chunks of sseChunkSize with AES-GCM. The
+// last chunk is sealed with a different additional data byte, so truncated
+// objects fail to decrypt.
+type sealWriter struct {
+	file  fs.File
+	gcm   cipher.AEAD
+	buf   []byte
+	index int64
+	size  int64
+}
+
+// encryptFile returns a writer storing data into file with the given server
+// side encryption. Closing the writer flushes the data and records the size
+// of the plaintext.
+func encryptFile(s3 S.Request, file fs.File, e serverSideEncryption) (io.WriteCloser, error) {
+	if len(e.Algorithm) == 0 {
+		return nopWriteCloser{file}, nil
+	}
+	key, wrapped, err := generateDataKey(s3, e)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.write(file.Name()); err != nil {
+		return nil, err
+	}
+	if err := fs.Setxattr(file.Name(), "sse-key", wrapped); err != nil {
+		return nil, err
+	}
+	return &sealWriter{file: file, gcm: gcm, buf: make([]byte, 0, sseChunkSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == sseChunkSize {
+			if err := s.seal(sseIntermediate); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):sseChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) seal(final byte) error {
+	out := s.gcm.Seal(nil, chunkNonce(s.index), s.buf, []byte{final})
+	if _, err := s.file.Write(out); err != nil {
+		return err
+	}
+	s.size += int64(len(s.buf))
+	s.index++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+func (s *sealWriter) Close() error {
+	if err := s.seal(sseFinalChunk); err != nil {
+		return err
+	}
+	return fs.Setxattr(s.file.Name(), "size", strconv.FormatInt(s.size, 10))
+}
+
+// generateDataKey returns a new data key and its wrapped form, sealed by the
+// local key management service for SSE-KMS and by encryptionKey otherwise.
+func generateDataKey(s3 S.Request, e serverSideEncryption) ([]byte, string, error) {
+	if e.Algorithm == sseKMS {
+		if s3.MasterKey == nil {
+			return nil, "", errEncryptionNotConfigured
+		}
+		key, blob, _, err := kmsGenerateDataKey(s3, e.KMSKeyID, e.Context)
+		return key, base64.StdEncoding.EncodeToString(blob), err
+	}
+
+	master, err := encryptionKey(s3, e)
+	if err != nil {
+		return nil, "", err
+	}
+	key := make([]byte, sseKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	wrapped, err := wrapKey(master, key)
+	return key, wrapped, err
+}
+
+// openDataKey unwraps a data key stored by generateDataKey.
+func openDataKey(s3 S.Request, e serverSideEncryption, wrapped string) ([]byte, error) {
+	if e.Algorithm == sseKMS {
+		if s3.MasterKey == nil {
+			return nil, errEncryptionNotConfigured
+		}
+		blob, err := base64.StdEncoding.DecodeString(wrapped)
+		if err != nil {
+			return nil, errCorruptObject
+		}
+		key, _, err := kmsDecrypt(s3, blob, e.Context)
+		if err == errKMSInvalidCiphertext {
+			return nil, errCorruptObject
+		}
+		return key, err
+	}
+
+	master, err := encryptionKey(s3, e)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unwrapKey(master, wrapped)
+	if err != nil {
+		return nil, errCorruptObject
+	}
+	return key, nil
+}
+
+// encryptionKey returns the key wrapping the data keys of an encryption.
+func encryptionKey(s3 S.Request, e serverSideEncryption) ([]byte, error) {
+	if e.CustomerKey != nil {
+		return e.CustomerKey, nil
+	}
+	if s3.MasterKey == nil {
+		return nil, errEncryptionNotConfigured
+	}
+	return s3.MasterKey[:], nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// openReader decrypts an object stored by sealWriter, seeking to the chunk
+// holding the requested offset.
+type openReader struct {
+	file   fs.File
+	gcm    cipher.AEAD
+	size   int64
+	offset int64
+	index  int64
+	chunk  []byte
+}
+
+func (o *openReader) chunks() int64 {
+	if o.size == 0 {
+		return 1
+	}
+	return (o.size + sseChunkSize - 1) / sseChunkSize
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	index := o.offset / sseChunkSize
+	if o.chunk == nil || o.index != index {
+		sealed := make([]byte, sseChunkSize+sseOverhead)
+		n, err := o.file.ReadAt(sealed, index*(sseChunkSize+sseOverhead))
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		final := byte(sseIntermediate)
+		if index == o.chunks()-1 {
+			final = sseFinalChunk
+		}
+		o.chunk, err = o.gcm.Open(o.chunk[:0], chunkNonce(index), sealed[:n], []byte{final})
+		if err != nil {
+			o.chunk = nil
+			return 0, errCorruptObject
+		}
+		o.index = index
+	}
+
+	start := o.offset - index*sseChunkSize
+	if start >= int64(len(o.chunk)) {
+		return 0, errCorruptObject
+	}
+	n := copy(p, o.chunk[start:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+func (o *openReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *openReader) Close() error {
+	return o.file.Close()
+}
+
+// openObject opens the data of the object version at path for reading and
+// returns its plaintext size, decrypting and decompressing it as needed. The
+// customer key must have been verified with checkCustomerKey for objects
+// encrypted with SSE-C.
+func openObject(s3 S.Request, path string, key []byte) (io.ReadSeekCloser, int64, error) {
+	file, err := fs.Open(objectDataPath(s3.Mount, path))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	var reader io.ReadSeekCloser = file
+	size := info.Size()
+	if wrapped, err := fs.Getxattr(path, "sse-key"); err == nil {
+		decrypted, err := decryptFile(s3, file, path, key, wrapped)
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		reader, size = decrypted, decrypted.size
+	}
+
+	if algorithm, err := fs.Getxattr(path, "compression"); err == nil {
+		codec, ok := codecs[algorithm]
+		if !ok {
+			reader.Close()
+			return nil, 0, errInvalidCompression
+		}
+		size = objectSize(path, info)
+		reader = &blockReader{source: reader, codec: codec, size: size, index: -1}
+	}
+	return reader, size, nil
+}
+
+func decryptFile(s3 S.Request, file fs.File, path string, customerKey []byte, wrapped string) (*openReader, error) {
+	key, err := openDataKey(s3, storedEncryption(path, customerKey), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	chunks := (info.Size() + sseChunkSize + sseOverhead - 1) / (sseChunkSize + sseOverhead)
+	size := info.Size() - chunks*sseOverhead
+	if chunks == 0 || size < 0 {
+		return nil, errCorruptObject
+	}
+	return &openReader{file: file, gcm: gcm, size: size}, nil
+}
+
+// objectSize returns the size of the object data at path, which differs from
+// the file size for encrypted and compressed objects.
+func objectSize(path string, info os.FileInfo) int64 {
+	if value, err := fs.Getxattr(path, "size"); err == nil {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return size
+		}
+	}
+	return info.Size()
+}
+
+// copyObjectData copies the object data at path, decrypted with its customer
+// key if needed, into the empty target with the given encryption and
+// compression. Data stored as is on both sides is cloned where possible, and
+// deduplicated data is referenced.
+func copyObjectData(s3 S.Request, target fs.File, path string, key []byte, e serverSideEncryption, compression string) (int64, error) {
+	if _, ok := blobDigest(path); ok && len(e.Algorithm) == 0 && len(compression) == 0 {
+		return 0, referenceBlob(s3.Mount, path, target.Name())
+	}
+	if storedAsIs(path) && len(e.Algorithm) == 0 && len(compression) == 0 {
+		source, err := fs.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer source.Close()
+		return fs.CopyFile(target, source, 0)
+	}
+
+	source, _, err := openObject(s3, path, key)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	writer, err := encryptFile(s3, target, e)
+	if err != nil {
+		return 0, err
+	}
+	writer, err = compressFile(writer, target.Name(), compression)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(writer, source)
+	if err != nil {
+		return n, err
+	}
+	return n, writer.Close()
+}
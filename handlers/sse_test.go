@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func encryptTestObject(t *testing.T, s3 S.Request, e serverSideEncryption, data []byte) string {
+	file, err := os.Create(filepath.Join(t.TempDir(), "object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer, err := encryptFile(s3, file, e)
+	if err != nil {
+		t.Skipf("xattrs not supported: %s", err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestEncryptedObject(t *testing.T) {
+	s3 := S.Request{MasterKey: &[sseKeySize]byte{1, 2, 3}}
+
+	for _, size := range []int{0, 1, sseChunkSize, sseChunkSize + 1, 3*sseChunkSize - 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		path := encryptTestObject(t, s3, serverSideEncryption{Algorithm: sseAES256}, data)
+
+		reader, n, err := openObject(s3, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(size) {
+			t.Errorf("size %d: reported size %d", size, n)
+		}
+		plain, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Errorf("size %d: data does not round trip: %v", size, err)
+		}
+
+		if size > 10 {
+			offset := int64(size / 2)
+			reader.Seek(offset, io.SeekStart)
+			part := make([]byte, 10)
+			if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, data[offset:offset+10]) {
+				t.Errorf("size %d: range read at %d failed: %v", size, offset, err)
+			}
+		}
+		reader.Close()
+	}
+}
+
+func TestEncryptedObjectTruncated(t *testing.T) {
+	s3 := S.Request{MasterKey: &[sseKeySize]byte{1, 2, 3}}
+	path := encryptTestObject(t, s3, serverSideEncryption{Algorithm: sseAES256}, make([]byte, 2*sseChunkSize+5))
+
+	if err := os.Truncate(path, sseChunkSize+sseOverhead); err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := openObject(s3, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); err != errCorruptObject {
+		t.Errorf("expected %v, got %v", errCorruptObject, err)
+	}
+}
+
+func TestCustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, sseKeySize)
+	data := []byte("customer encrypted")
+	path := encryptTestObject(t, S.Request{}, serverSideEncryption{Algorithm: sseAES256, CustomerKey: key}, data)
+
+	for _, test := range []struct {
+		key []byte
+		err error
+	}{
+		{nil, errMissingCustomerKey},
+		{bytes.Repeat([]byte{8}, sseKeySize), errWrongCustomerKey},
+		{key, nil},
+	} {
+		if _, _, err := checkCustomerKey(path, test.key); err != test.err {
+			t.Errorf("expected %v, got %v", test.err, err)
+		}
+	}
+
+	reader, _, err := openObject(S.Request{}, path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if plain, err := io.ReadAll(reader); err != nil || !bytes.Equal(plain, data) {
+		t.Errorf("data does not round trip: %v", err)
+	}
+}
+
+func TestKMSDataKey(t *testing.T) {
+	s3 := S.Request{Mount: t.TempDir(), MasterKey: &[sseKeySize]byte{1, 2, 3}}
+	key, err := createKMSKey(s3, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := map[string]string{"purpose": "test"}
+	plain, blob, _, err := kmsGenerateDataKey(s3, key.KeyID, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := kmsDecrypt(s3, blob, map[string]string{"purpose": "other"}); err != errKMSInvalidCiphertext {
+		t.Errorf("expected %v, got %v", errKMSInvalidCiphertext, err)
+	}
+	if err := updateKMSKey(s3, key.KeyID, func(key *S.KMSKey) error { return addKMSKeyVersion(s3, key) }); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, _, err := kmsDecrypt(s3, blob, context); err != nil || !bytes.Equal(decrypted, plain) {
+		t.Errorf("data key does not round trip after rotation: %v", err)
+	}
+
+	if err := updateKMSKey(s3, key.KeyID, func(key *S.KMSKey) error { key.Enabled = false; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kmsDecrypt(s3, blob, context); err != errKMSDisabled {
+		t.Errorf("expected %v, got %v", errKMSDisabled, err)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+// bucketSubresource describes a bucket configuration that tri either stores
+// verbatim or answers with a fixed document. Without a config constructor the
+// configuration is not supported and writes fail with NotImplemented.
+type bucketSubresource struct {
+	config   func() any
+	validate func(S.Request, any) error
+	notFound string
+	fallback any
+}
+
+var bucketSubresources = map[string]bucketSubresource{
+	"ownershipControls": {
+		config:   func() any { return &S.OwnershipControls{} },
+		validate: validOwnershipControls,
+		notFound: "OwnershipControlsNotFoundError",
+	},
+	bucketEncryption: {
+		config:   func() any { return &S.ServerSideEncryptionConfiguration{} },
+		validate: validEncryptionConfiguration,
+		notFound: "ServerSideEncryptionConfigurationNotFoundError",
+	},
+	bucketCompression: {
+		config:   func() any { return &S.CompressionConfiguration{} },
+		validate: validCompressionConfiguration,
+		notFound: "NoSuchCompressionConfiguration",
+	},
+	"publicAccessBlock": {
+		config:   func() any { return &S.PublicAccessBlockConfiguration{} },
+		notFound: "NoSuchPublicAccessBlockConfiguration",
+	},
+	"accelerate":     {fallback: S.AccelerateConfiguration{}},
+	"requestPayment": {fallback: S.RequestPaymentConfiguration{Payer: "BucketOwner"}},
+	"logging":        {fallback: S.BucketLoggingStatus{}},
+	"notification":   {fallback: S.NotificationConfiguration{}},
+	"acl": {fallback: S.AccessControlPolicy{
+		Owner: S.Owner{ID: "id", DisplayName: "name"},
+		AccessControlList: []S.Grant{{
+			Grantee:    S.Grantee{XMLNS: "http://www.w3.org/2001/XMLSchema-instance", Type: "CanonicalUser", ID: "id", DisplayName: "name"},
+			Permission: "FULL_CONTROL",
+		}},
+	}},
+	"cors":        {notFound: "NoSuchCORSConfiguration"},
+	"website":     {notFound: "NoSuchWebsiteConfiguration"},
+	"policy":      {notFound: "NoSuchBucketPolicy"},
+	"replication": {notFound: "ReplicationConfigurationNotFoundError"},
+}
+
+// bucketSubresourceNames lists every key of bucketSubresources in the order a
+// request naming several of them is matched, so the choice does not depend on
+// map iteration.
+var bucketSubresourceNames = []string{
+	"ownershipControls", bucketEncryption, bucketCompression, "publicAccessBlock",
+	"accelerate", "requestPayment", "logging", "notification", "acl",
+	"cors", "website", "policy", "replication",
+}
+
+func bucketSubresourceName(r *http.Request) string {
+	for _, name := range bucketSubresourceNames {
+		if r.URL.Query().Has(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func GetBucketSubresource(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetBucketSubresource: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	name := bucketSubresourceName(r)
+	sub := bucketSubresources[name]
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	if sub.config != nil {
+		config := sub.config()
+		err := readBucketConfig(s3.Mount, s3.Bucket, name, config)
+		if err == nil {
+			return S.RespondXML(w, http.StatusOK, config)
+		}
+		if !os.IsNotExist(err) {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+		}
+	}
+
+	if sub.fallback != nil {
+		return S.RespondXML(w, http.StatusOK, sub.fallback)
+	}
+	return S.RespondError(w, http.StatusNotFound, sub.notFound, nil, s3.Bucket)
+}
+
+func PutBucketSubresource(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutBucketSubresource: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	name := bucketSubresourceName(r)
+	sub := bucketSubresources[name]
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	if sub.config == nil {
+		return S.RespondError(w, http.StatusNotImplemented, "NotImplemented", errors.New(name+" is not supported"), s3.Bucket)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	config := sub.config()
+	if err := xml.Unmarshal(body, config); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Bucket)
+	}
+	if sub.validate != nil {
+		if err := sub.validate(s3, config); err != nil {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Bucket)
+		}
+	}
+
+	if err := writeBucketConfig(s3.Mount, s3.Bucket, name, config); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func DeleteBucketSubresource(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#DeleteBucketSubresource: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	name := bucketSubresourceName(r)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	if err := deleteBucketConfig(s3.Mount, s3.Bucket, name); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusNoContent, nil, nil)
+}
+
+func validOwnershipControls(_ S.Request, v any) error {
+	config := v.(*S.OwnershipControls)
+	if len(config.Rules) != 1 {
+		return errors.New("ownership controls require exactly one rule")
+	}
+	switch config.Rules[0].ObjectOwnership {
+	case "BucketOwnerEnforced", "BucketOwnerPreferred", "ObjectWriter":
+		return nil
+	}
+	return errors.New("invalid object ownership")
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func TestGetBucketLocation(t *testing.T) {
+	app, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+
+	for region, location := range map[string]string{"us-east-1": "", "eu-west-1": "eu-west-1"} {
+		*app.Region = region
+		w := do(Get, "GET", "/bucket?location", "")
+		result := S.LocationConstraint{}
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); w.Code != 200 || err != nil || result.Location != location {
+			t.Errorf("%s: %d %q %v", region, w.Code, result.Location, err)
+		}
+	}
+	if w := do(Get, "GET", "/missing?location", ""); w.Code != 404 || !strings.Contains(w.Body.String(), "NoSuchBucket") {
+		t.Errorf("location of a missing bucket: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestBucketTagging(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+
+	if w := do(Get, "GET", "/bucket?tagging", ""); w.Code != 404 || !strings.Contains(w.Body.String(), "NoSuchTagSet") {
+		t.Errorf("tagging of an untagged bucket: %d %s", w.Code, w.Body)
+	}
+	if w := do(Put, "PUT", "/bucket?tagging", taggingBody(t, tagSet(51, 3, 0))); w.Code != 400 {
+		t.Errorf("51 bucket tags: %d", w.Code)
+	}
+	tags := tagSet(50, 128, 256)
+	if w := do(Put, "PUT", "/bucket?tagging", taggingBody(t, tags)); w.Code != 204 {
+		t.Fatalf("50 bucket tags: %d %s", w.Code, w.Body)
+	}
+	tagging := S.Tagging{}
+	if err := xml.Unmarshal(do(Get, "GET", "/bucket?tagging", "").Body.Bytes(), &tagging); err != nil || encodeTags(tagging.TagSet) != encodeTags(tags) {
+		t.Errorf("bucket tags differ: %v", err)
+	}
+	if w := do(Put, "PUT", "/bucket?tagging", taggingBody(t, []S.Tag{{Key: "aws:key", Value: "value"}})); w.Code != 400 {
+		t.Errorf("aws: bucket tag: %d", w.Code)
+	}
+
+	if w := do(Delete, "DELETE", "/bucket?tagging", ""); w.Code != 204 {
+		t.Errorf("DeleteBucketTagging: %d", w.Code)
+	}
+	if w := do(Get, "GET", "/bucket?tagging", ""); w.Code != 404 {
+		t.Errorf("tagging after DeleteBucketTagging: %d", w.Code)
+	}
+}
+
+func TestBucketSubresources(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+
+	for _, name := range []string{"accelerate", "requestPayment", "logging", "notification", "acl", "cors", "website", "policy", "replication"} {
+		if w := do(Put, "PUT", "/bucket?"+name, "<Configuration/>"); w.Code != 501 || !strings.Contains(w.Body.String(), "NotImplemented") {
+			t.Errorf("PUT %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	for name, code := range map[string]string{"cors": "NoSuchCORSConfiguration", "website": "NoSuchWebsiteConfiguration", "policy": "NoSuchBucketPolicy"} {
+		if w := do(Get, "GET", "/bucket?"+name, ""); w.Code != 404 || !strings.Contains(w.Body.String(), code) {
+			t.Errorf("GET %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	if w := do(Get, "GET", "/bucket?requestPayment", ""); w.Code != 200 || !strings.Contains(w.Body.String(), "BucketOwner") {
+		t.Errorf("GET requestPayment: %d %s", w.Code, w.Body)
+	}
+
+	ownership := `<OwnershipControls><Rule><ObjectOwnership>BucketOwnerEnforced</ObjectOwnership></Rule></OwnershipControls>`
+	if w := do(Get, "GET", "/bucket?ownershipControls", ""); w.Code != 404 {
+		t.Errorf("GET ownershipControls before PUT: %d", w.Code)
+	}
+	if w := do(Put, "PUT", "/bucket?ownershipControls", ownership); w.Code != 200 {
+		t.Fatalf("PUT ownershipControls: %d %s", w.Code, w.Body)
+	}
+	if w := do(Get, "GET", "/bucket?ownershipControls", ""); w.Code != 200 || !strings.Contains(w.Body.String(), "BucketOwnerEnforced") {
+		t.Errorf("GET ownershipControls: %d %s", w.Code, w.Body)
+	}
+	if w := do(Put, "PUT", "/bucket?ownershipControls", strings.Replace(ownership, "BucketOwnerEnforced", "Anyone", 1)); w.Code != 400 {
+		t.Errorf("PUT invalid ownershipControls: %d", w.Code)
+	}
+	do(Delete, "DELETE", "/bucket?ownershipControls", "")
+	if w := do(Get, "GET", "/bucket?ownershipControls", ""); w.Code != 404 {
+		t.Errorf("GET ownershipControls after DELETE: %d", w.Code)
+	}
+}
+
+func TestBucketSubresourceName(t *testing.T) {
+	if len(bucketSubresourceNames) != len(bucketSubresources) {
+		t.Fatalf("%d names for %d subresources", len(bucketSubresourceNames), len(bucketSubresources))
+	}
+	for _, name := range bucketSubresourceNames {
+		if _, ok := bucketSubresources[name]; !ok {
+			t.Errorf("%s has no subresource", name)
+		}
+	}
+	for range 20 {
+		r := httptest.NewRequest("GET", "/bucket?replication&cors&acl", nil)
+		if name := bucketSubresourceName(r); name != "acl" {
+			t.Fatalf("picked %q, want acl", name)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const bucketTaggingConfig = "tagging"
+
+const (
+	maxObjectTags  = 10
+	maxBucketTags  = 50
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+var errInvalidTag = errors.New("invalid tag set")
+
+func GetObjectTagging(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetObjectTagging: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	return S.RespondXML(w, http.StatusOK, S.Tagging{TagSet: readTags(path)})
+}
+
+func PutObjectTagging(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutObjectTagging: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	body, _ := io.ReadAll(r.Body)
+	var tagging S.Tagging
+	if err := xml.Unmarshal(body, &tagging); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Key)
+	}
+	if err := validTags(tagging.TagSet, maxObjectTags); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidTag", err, s3.Key)
+	}
+
+	unlock := lockKey(s3.Path)
+	defer unlock()
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	if err := writeTags(path, tagging.TagSet); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func DeleteObjectTagging(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#DeleteObjectTagging: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	unlock := lockKey(s3.Path)
+	defer unlock()
+
+	path, code, awscode, err := objectPath(w, s3, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return S.RespondError(w, code, awscode, err, s3.Key)
+	}
+
+	if err := writeTags(path, nil); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Key)
+	}
+
+	return S.Respond(w, http.StatusNoContent, nil, nil)
+}
+
+// parseTagging decodes the URL query encoded x-amz-tagging header.
+func parseTagging(header string) ([]S.Tag, error) {
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return nil, errInvalidTag
+	}
+
+	tags := []S.Tag{}
+	for k, v := range values {
+		if len(v) != 1 {
+			return nil, errInvalidTag
+		}
+		tags = append(tags, S.Tag{Key: k, Value: v[0]})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+
+	return tags, validTags(tags, maxObjectTags)
+}
+
+func validTags(tags []S.Tag, limit int) error {
+	if len(tags) > limit {
+		return errors.New("tag set exceeds " + strconv.Itoa(limit) + " tags")
+	}
+
+	keys := make(map[string]bool)
+	for _, tag := range tags {
+		if keys[tag.Key] {
+			return errors.New("duplicate tag key " + tag.Key)
+		}
+		keys[tag.Key] = true
+
+		if utf8.RuneCountInString(tag.Key) == 0 || utf8.RuneCountInString(tag.Key) > maxTagKeyLen {
+			return errInvalidTag
+		}
+		if utf8.RuneCountInString(tag.Value) > maxTagValueLen {
+			return errInvalidTag
+		}
+		if strings.HasPrefix(strings.ToLower(tag.Key), "aws:") {
+			return errors.New("tag keys must not use the aws: prefix")
+		}
+	}
+	return nil
+}
+
+func encodeTags(tags []S.Tag) string {
+	values := url.Values{}
+	for _, tag := range tags {
+		values.Set(tag.Key, tag.Value)
+	}
+	return values.Encode()
+}
+
+func readTags(path string) []S.Tag {
+	value, err := fs.Getxattr(path, "tagging")
+	if err != nil {
+		return []S.Tag{}
+	}
+	tags, err := parseTagging(value)
+	if err != nil {
+		return []S.Tag{}
+	}
+	return tags
+}
+
+func writeTags(path string, tags []S.Tag) error {
+	if len(tags) == 0 {
+		fs.Removexattr(path, "tagging")
+		return nil
+	}
+	return fs.Setxattr(path, "tagging", encodeTags(tags))
+}
+
+func taggingResponseHeaders(path string, headers map[string]string) {
+	if tags := readTags(path); len(tags) > 0 {
+		headers["x-amz-tagging-count"] = strconv.Itoa(len(tags))
+	}
+}
+
+func GetBucketTagging(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetBucketTagging: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	var tagging S.Tagging
+	if err := readBucketConfig(s3.Mount, s3.Bucket, bucketTaggingConfig, &tagging); err != nil {
+		if os.IsNotExist(err) {
+			return S.RespondError(w, http.StatusNotFound, "NoSuchTagSet", err, s3.Bucket)
+		}
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.RespondXML(w, http.StatusOK, tagging)
+}
+
+func PutBucketTagging(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutBucketTagging: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var tagging S.Tagging
+	if err := xml.Unmarshal(body, &tagging); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Bucket)
+	}
+	if err := validTags(tagging.TagSet, maxBucketTags); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "InvalidTag", err, s3.Bucket)
+	}
+
+	if err := writeBucketConfig(s3.Mount, s3.Bucket, bucketTaggingConfig, tagging); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusNoContent, nil, nil)
+}
+
+func DeleteBucketTagging(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#DeleteBucketTagging: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	if err := deleteBucketConfig(s3.Mount, s3.Bucket, bucketTaggingConfig); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusNoContent, nil, nil)
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	S "github.com/autovia/tri/structs"
+)
+
+// tagSet returns a tag set of n tags whose keys and values are padded to the
+// given lengths.
+func tagSet(n int, keyLen int, valueLen int) []S.Tag {
+	tags := []S.Tag{}
+	for i := range n {
+		key := fmt.Sprintf("%03d", i)
+		tags = append(tags, S.Tag{Key: key + strings.Repeat("k", max(keyLen-len(key), 0)), Value: strings.Repeat("v", valueLen)})
+	}
+	return tags
+}
+
+func taggingBody(t *testing.T, tags []S.Tag) string {
+	t.Helper()
+	body, err := xml.Marshal(S.Tagging{TagSet: tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestObjectTagging(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+	do(Put, "PUT", "/bucket/key", "data")
+
+	for _, c := range []struct {
+		name string
+		tags []S.Tag
+		code int
+	}{
+		{"10 tags", tagSet(10, 3, 0), 200},
+		{"11 tags", tagSet(11, 3, 0), 400},
+		{"128 character key", tagSet(1, 128, 0), 200},
+		{"129 character key", tagSet(1, 129, 0), 400},
+		{"256 character value", tagSet(1, 3, 256), 200},
+		{"257 character value", tagSet(1, 3, 257), 400},
+		{"aws: prefix", []S.Tag{{Key: "aws:key", Value: "value"}}, 400},
+		{"AWS: prefix", []S.Tag{{Key: "AWS:key", Value: "value"}}, 400},
+		{"duplicate key", []S.Tag{{Key: "key", Value: "1"}, {Key: "key", Value: "2"}}, 400},
+	} {
+		if w := do(Put, "PUT", "/bucket/key?tagging", taggingBody(t, c.tags)); w.Code != c.code {
+			t.Errorf("%s: %d %s", c.name, w.Code, w.Body)
+		}
+	}
+
+	// count returns the x-amz-tagging-count of GET and HEAD, which must agree.
+	count := func(target string) string {
+		t.Helper()
+		get := do(Get, "GET", target, "").Header().Get("x-amz-tagging-count")
+		if head := do(Head, "HEAD", target, "").Header().Get("x-amz-tagging-count"); head != get {
+			t.Errorf("%s: tagging count %q on GET, %q on HEAD", target, get, head)
+		}
+		return get
+	}
+	tags := func(target string) string {
+		t.Helper()
+		tagging := S.Tagging{}
+		if err := xml.Unmarshal(do(Get, "GET", target+"?tagging", "").Body.Bytes(), &tagging); err != nil {
+			t.Fatal(err)
+		}
+		return encodeTags(tagging.TagSet)
+	}
+
+	if w := do(Put, "PUT", "/bucket/key", "data", "X-Amz-Tagging", "a=1&b=2"); w.Code != 200 {
+		t.Fatalf("PUT with x-amz-tagging: %d %s", w.Code, w.Body)
+	}
+	if n := count("/bucket/key"); n != "2" {
+		t.Errorf("tagging count %q after PUT", n)
+	}
+	if got := tags("/bucket/key"); got != "a=1&b=2" {
+		t.Errorf("tags %q after PUT", got)
+	}
+	if w := do(Put, "PUT", "/bucket/key", "other", "X-Amz-Tagging", "aws:a=1"); w.Code != 400 {
+		t.Errorf("PUT with an aws: tag: %d", w.Code)
+	}
+	if w := do(Put, "PUT", "/bucket/key", "other", "X-Amz-Tagging", encodeTags(tagSet(11, 3, 0))); w.Code != 400 {
+		t.Errorf("PUT with 11 tags: %d", w.Code)
+	}
+	if w := do(Get, "GET", "/bucket/key", ""); w.Body.String() != "data" {
+		t.Errorf("PUT with invalid tags stored the object: %q", w.Body)
+	}
+
+	copySource := []string{"X-Amz-Copy-Source", "/bucket/key"}
+	do(Put, "PUT", "/bucket/copy", "", copySource...)
+	if got := tags("/bucket/copy"); got != "a=1&b=2" {
+		t.Errorf("tags %q after a copy", got)
+	}
+	do(Put, "PUT", "/bucket/copy", "", append(copySource, "X-Amz-Tagging-Directive", "COPY", "X-Amz-Tagging", "c=3")...)
+	if got := tags("/bucket/copy"); got != "a=1&b=2" {
+		t.Errorf("tags %q after a copy with the COPY directive", got)
+	}
+	do(Put, "PUT", "/bucket/copy", "", append(copySource, "X-Amz-Tagging-Directive", "REPLACE", "X-Amz-Tagging", "c="+url.QueryEscape("3 4"))...)
+	if got := tags("/bucket/copy"); got != "c=3+4" {
+		t.Errorf("tags %q after a copy with the REPLACE directive", got)
+	}
+	if n := count("/bucket/copy"); n != "1" {
+		t.Errorf("tagging count %q after a copy with the REPLACE directive", n)
+	}
+	for _, header := range [][]string{{"X-Amz-Tagging-Directive", "MERGE"}, {"X-Amz-Tagging-Directive", "REPLACE", "X-Amz-Tagging", "aws:c=3"}} {
+		if w := do(Put, "PUT", "/bucket/copy", "", append(copySource, header...)...); w.Code != 400 {
+			t.Errorf("copy with %v: %d", header, w.Code)
+		}
+	}
+
+	if w := do(Delete, "DELETE", "/bucket/key?tagging", ""); w.Code != 204 {
+		t.Errorf("DeleteObjectTagging: %d", w.Code)
+	}
+	if n := count("/bucket/key"); n != "" {
+		t.Errorf("tagging count %q after DeleteObjectTagging", n)
+	}
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const standardClass = "STANDARD"
+
+const (
+	TierTmp     = "tmp"
+	TierObjects = "objects"
+)
+
+const tierObjectIDLength = 32
+
+var errInvalidStorageClass = errors.New("storage class is not configured")
+
+// storageClass validates a requested storage class against the configured tiers.
+func storageClass(s3 S.Request, class string) (string, error) {
+	if len(class) == 0 || class == standardClass {
+		return standardClass, nil
+	}
+	if _, ok := tierRoot(s3, class); ok {
+		return class, nil
+	}
+	return "", errInvalidStorageClass
+}
+
+func tierRoot(s3 S.Request, class string) (string, bool) {
+	if s3.Tiers == nil {
+		return "", false
+	}
+	root, ok := (*s3.Tiers)[class]
+	return root, ok
+}
+
+func objectStorageClass(path string) string {
+	if class, err := fs.Getxattr(path, "storage-class"); err == nil {
+		return class
+	}
+	return standardClass
+}
+
+func storageClassResponseHeaders(path string, headers map[string]string) {
+	if class := objectStorageClass(path); class != standardClass {
+		headers["x-amz-storage-class"] = class
+	}
+}
+
+// tierData returns the file in a tier's object store the symlink at path
+// points to. Links to anywhere else are not tier data and tell false.
+func tierData(s3 S.Request, path string) (string, bool) {
+	target, err := fs.Readlink(path)
+	if err != nil || s3.Tiers == nil {
+		return "", false
+	}
+	target = filepath.Clean(target)
+	for _, root := range *s3.Tiers {
+		if filepath.Dir(target) == filepath.Join(root, TierObjects) {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// placeObject moves a temporary file written inside a tier root to the tier's
+// object store and returns a symlink to it, which is committed under the key
+// in place of the file. Files written to the mount are returned unchanged.
+func placeObject(s3 S.Request, tmp string) (string, error) {
+	if s3.Tiers == nil {
+		return tmp, nil
+	}
+	for _, root := range *s3.Tiers {
+		if filepath.Dir(tmp) != filepath.Join(root, TierTmp) {
+			continue
+		}
+
+		data := filepath.Join(root, TierObjects, generate(tierObjectIDLength))
+		if err := fs.Rename(tmp, data); err != nil {
+			return "", err
+		}
+
+		dir := filepath.Join(s3.Mount, Metadata, tmpDir)
+		if err := fs.MkdirAll(dir, os.ModePerm); err != nil {
+			fs.RemoveFile(data)
+			return "", err
+		}
+		link := filepath.Join(dir, "link-"+generate(tierObjectIDLength))
+		if err := fs.Symlink(data, link); err != nil {
+			fs.RemoveFile(data)
+			return "", err
+		}
+		return link, nil
+	}
+	return tmp, nil
+}
+
+// replaceFile renames the committed file onto path and frees the tier data
+// and the blob of the file it replaces.
+func replaceFile(s3 S.Request, tmp string, path string) error {
+	old, tiered := tierData(s3, path)
+	digest, deduplicated := blobDigest(path)
+	layout, stored := partLayoutDigest(path)
+	if err := stampObject(tmp); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		return err
+	}
+	if tiered {
+		fs.RemoveFile(old)
+	}
+	if stored {
+		if err := releaseBlob(s3.Mount, layout); err != nil {
+			return err
+		}
+	}
+	if deduplicated {
+		return releaseBlob(s3.Mount, digest)
+	}
+	return nil
+}
+
+// transitionObject moves the data of the current version of a key to another
+// storage class, keeping its metadata and modification time.
+func transitionObject(s3 S.Request, class string) error {
+	unlock := lockKey(s3.Path)
+	defer unlock()
+
+	source, err := fs.Open(objectDataPath(s3.Mount, s3.Path))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	target, err := createTemp(s3, class)
+	if err != nil {
+		return err
+	}
+	defer fs.RemoveFile(target.Name())
+	defer target.Close()
+
+	if _, err := fs.CopyFile(target, source, 0); err != nil {
+		return err
+	}
+	if err := target.Sync(); err != nil {
+		return err
+	}
+
+	if err := fs.CopyXattrs(target.Name(), s3.Path); err != nil {
+		return err
+	}
+	if _, ok := blobDigest(s3.Path); ok {
+		fs.Removexattr(target.Name(), "blob")
+		fs.Removexattr(target.Name(), "size")
+	}
+	if class == standardClass {
+		fs.Removexattr(target.Name(), "storage-class")
+	} else if err := fs.Setxattr(target.Name(), "storage-class", class); err != nil {
+		return err
+	}
+	if err := fs.Chtimes(target.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	layout, stored := partLayoutDigest(target.Name())
+	if stored {
+		if err := retainBlob(s3.Mount, layout); err != nil {
+			return err
+		}
+	}
+
+	placed, err := placeObject(s3, target.Name())
+	if err != nil {
+		if stored {
+			releaseBlob(s3.Mount, layout)
+		}
+		return err
+	}
+	if err := replaceFile(s3, placed, s3.Path); err != nil {
+		removeObjectFile(s3, placed)
+		return err
+	}
+	return nil
+}
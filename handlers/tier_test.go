@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/autovia/tri/fs"
+)
+
+func TestTierLinks(t *testing.T) {
+	fs.UseBackend(fs.NewMemory())
+	defer fs.UseBackend(fs.Posix{})
+
+	mount, tier, outside := "/memory", "/tier", "/outside/file"
+	app, do := newTestApp(t, mount)
+	app.Tiers["GLACIER"] = tier
+	for _, dir := range []string{TierTmp, TierObjects} {
+		if err := fs.MkdirAll(filepath.Join(tier, dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	do(Put, "PUT", "/bucket", "")
+
+	do(Put, "PUT", "/bucket/tiered", "cold", "x-amz-storage-class", "GLACIER")
+	if entries, err := fs.ReadDir(filepath.Join(tier, TierObjects)); err != nil || len(entries) != 1 {
+		t.Fatalf("tier data not placed: %v %v", entries, err)
+	}
+	do(Put, "PUT", "/bucket/tiered", "warm")
+	if entries, err := fs.ReadDir(filepath.Join(tier, TierObjects)); err != nil || len(entries) != 0 {
+		t.Errorf("replaced tier data left: %v %v", entries, err)
+	}
+
+	if err := fs.MkdirAll(filepath.Dir(outside), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(outside, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(mount, "bucket", "linked")
+	survives := func(action string) {
+		t.Helper()
+		if data, err := fs.ReadFile(outside); err != nil || string(data) != "keep" {
+			t.Errorf("%s changed the linked file: %q %v", action, data, err)
+		}
+	}
+
+	if err := fs.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	do(Delete, "DELETE", "/bucket/linked", "")
+	if _, err := fs.Lstat(link); !os.IsNotExist(err) {
+		t.Errorf("link not deleted: %v", err)
+	}
+	survives("DELETE")
+
+	if err := fs.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	do(Put, "PUT", "/bucket/linked", "new")
+	if w := do(Get, "GET", "/bucket/linked", ""); w.Body.String() != "new" {
+		t.Errorf("overwritten link reads %q", w.Body)
+	}
+	survives("PUT")
+}
@@ -0,0 +1,621 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/autovia/tri/fs"
+	S "github.com/autovia/tri/structs"
+)
+
+const versionsDir = "versions"
+const versioningConfig = "versioning"
+const nullVersion = "null"
+const versionIDLength = 32
+
+var keyLocks [256]sync.Mutex
+
+type version struct {
+	ID           string
+	Key          string
+	Path         string
+	DeleteMarker bool
+	Info         os.FileInfo
+}
+
+func GetBucketVersioning(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#GetBucketVersioning: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	return S.RespondXML(w, http.StatusOK, S.VersioningConfiguration{Status: versioningStatus(s3.Mount, s3.Bucket)})
+}
+
+func PutBucketVersioning(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#PutBucketVersioning: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+
+	if _, err := fs.Stat(s3.Path); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	var config S.VersioningConfiguration
+	if err := xml.Unmarshal(body, &config); err != nil {
+		return S.RespondError(w, http.StatusBadRequest, "MalformedXML", err, s3.Bucket)
+	}
+
+	if config.Status != "Enabled" && config.Status != "Suspended" {
+		return S.RespondError(w, http.StatusBadRequest, "IllegalVersioningConfigurationException", nil, s3.Bucket)
+	}
+
+	if config.Status == "Suspended" && objectLockEnabled(s3.Mount, s3.Bucket) {
+		return S.RespondError(w, http.StatusConflict, "InvalidBucketState", errors.New("object lock requires versioning"), s3.Bucket)
+	}
+
+	if err := writeBucketConfig(s3.Mount, s3.Bucket, versioningConfig, config); err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	return S.Respond(w, http.StatusOK, nil, nil)
+}
+
+func ListObjectVersions(w http.ResponseWriter, r *http.Request) error {
+	log.Printf("#ListObjectVersions: %v\n", r)
+	s3 := r.Context().Value(S.Request{}).(S.Request)
+	query := r.URL.Query()
+
+	root := filepath.Join(s3.Mount, s3.Bucket)
+	if _, err := fs.Stat(root); os.IsNotExist(err) {
+		return S.RespondError(w, http.StatusNotFound, "NoSuchBucket", err, s3.Bucket)
+	}
+
+	maxKeys := 1000
+	if query.Has("max-keys") {
+		n, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || n < 0 {
+			return S.RespondError(w, http.StatusBadRequest, "InvalidArgument", err, s3.Bucket)
+		}
+		maxKeys = min(n, 1000)
+	}
+
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	keyMarker := query.Get("key-marker")
+	versionIDMarker := query.Get("version-id-marker")
+
+	keys, err := versionedKeys(s3.Mount, s3.Bucket, prefix)
+	if err != nil {
+		return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+	}
+
+	result := S.ListVersionsResult{
+		Name:            s3.Bucket,
+		Prefix:          prefix,
+		KeyMarker:       keyMarker,
+		VersionIDMarker: versionIDMarker,
+		MaxKeys:         maxKeys,
+		Delimiter:       delimiter,
+	}
+
+	count := 0
+	lastPrefix := ""
+	for _, key := range keys {
+		if len(delimiter) > 0 {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if commonPrefix == lastPrefix || commonPrefix <= keyMarker {
+					continue
+				}
+				if count == maxKeys {
+					result.IsTruncated = true
+					break
+				}
+				lastPrefix = commonPrefix
+				result.CommonPrefixes = append(result.CommonPrefixes, S.CommonPrefix{Prefix: commonPrefix})
+				result.NextKeyMarker, result.NextVersionIDMarker = commonPrefix, ""
+				count++
+				continue
+			}
+		}
+
+		if key < keyMarker || (key == keyMarker && len(versionIDMarker) == 0) {
+			continue
+		}
+
+		versions, err := objectVersions(objectRequest(s3, key))
+		if err != nil {
+			return S.RespondError(w, http.StatusInternalServerError, "InternalError", err, s3.Bucket)
+		}
+
+		skip := key == keyMarker
+		for i, v := range versions {
+			if skip {
+				skip = v.ID != versionIDMarker
+				continue
+			}
+			if count == maxKeys {
+				result.IsTruncated = true
+				break
+			}
+
+			t := v.Info.ModTime()
+			if v.DeleteMarker {
+				result.DeleteMarker = append(result.DeleteMarker, S.DeleteMarkerEntry{
+					Key:          key,
+					VersionID:    v.ID,
+					IsLatest:     i == 0,
+					LastModified: t.Format(ISO8601UTCFormat),
+					Owner:        &S.Owner{ID: "id", DisplayName: "name"},
+				})
+			} else {
+				etag, _ := fs.Getxattr(v.Path, "etag")
+				result.Version = append(result.Version, S.ObjectVersion{
+					Object: S.Object{
+						Key:          key,
+						LastModified: t.Format(ISO8601UTCFormat),
+						ETag:         "\"" + etag + "\"",
+						Size:         objectSize(v.Path, v.Info),
+						StorageClass: objectStorageClass(v.Path),
+						Owner:        &S.Owner{ID: "id", DisplayName: "name"},
+					},
+					IsLatest:  i == 0,
+					VersionID: v.ID,
+				})
+			}
+			result.NextKeyMarker, result.NextVersionIDMarker = key, v.ID
+			count++
+		}
+		if result.IsTruncated {
+			break
+		}
+	}
+
+	if !result.IsTruncated {
+		result.NextKeyMarker, result.NextVersionIDMarker = "", ""
+	}
+
+	return S.RespondXML(w, http.StatusOK, result)
+}
+
+func versioningStatus(mount string, bucket string) string {
+	var config S.VersioningConfiguration
+	if err := readBucketConfig(mount, bucket, versioningConfig, &config); err != nil {
+		return ""
+	}
+	return config.Status
+}
+
+func newVersionID(status string) string {
+	switch status {
+	case "Enabled":
+		return generate(versionIDLength)
+	case "Suspended":
+		return nullVersion
+	}
+	return ""
+}
+
+func validVersionID(id string) bool {
+	return id == nullVersion || (len(id) == versionIDLength && strings.Trim(id, string(alpha)) == "")
+}
+
+func currentVersionID(path string) string {
+	if id, err := fs.Getxattr(path, "version-id"); err == nil {
+		return id
+	}
+	return nullVersion
+}
+
+func versionDir(mount string, bucket string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(mount, Metadata, versionsDir, bucket, hex.EncodeToString(sum[:]))
+}
+
+func objectRequest(s3 S.Request, key string) S.Request {
+	s3.Key = key
+	s3.Path = filepath.Join(s3.Mount, s3.Bucket, key)
+	return s3
+}
+
+func lockKey(path string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	mu := &keyLocks[h.Sum32()%uint32(len(keyLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func isObject(path string) bool {
+	info, err := fs.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// objectVersions returns the versions of a key, newest first.
+func objectVersions(s3 S.Request) ([]version, error) {
+	var versions []version
+	if info, err := fs.Stat(s3.Path); err == nil && !info.IsDir() {
+		versions = append(versions, version{ID: currentVersionID(s3.Path), Key: s3.Key, Path: s3.Path, Info: info})
+	}
+
+	stored, err := storedVersions(versionDir(s3.Mount, s3.Bucket, s3.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(versions, stored...), nil
+}
+
+func storedVersions(dir string) ([]version, error) {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []version{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := fs.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := fs.Getxattr(path, "key")
+		if err != nil {
+			return nil, err
+		}
+		marker, _ := fs.Getxattr(path, "delete-marker")
+		versions = append(versions, version{
+			ID:           entry.Name(),
+			Key:          key,
+			Path:         path,
+			DeleteMarker: marker == "true",
+			Info:         info,
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		ti, tj := versions[i].Info.ModTime(), versions[j].Info.ModTime()
+		if ti.Equal(tj) {
+			return versions[i].ID > versions[j].ID
+		}
+		return ti.After(tj)
+	})
+
+	return versions, nil
+}
+
+func findVersion(s3 S.Request, versionID string) (version, error) {
+	if !validVersionID(versionID) {
+		return version{}, os.ErrNotExist
+	}
+
+	if info, err := fs.Stat(s3.Path); err == nil && !info.IsDir() && currentVersionID(s3.Path) == versionID {
+		return version{ID: versionID, Key: s3.Key, Path: s3.Path, Info: info}, nil
+	}
+
+	path := filepath.Join(versionDir(s3.Mount, s3.Bucket, s3.Key), versionID)
+	info, err := fs.Stat(path)
+	if err != nil {
+		return version{}, err
+	}
+	marker, _ := fs.Getxattr(path, "delete-marker")
+
+	return version{ID: versionID, Key: s3.Key, Path: path, DeleteMarker: marker == "true", Info: info}, nil
+}
+
+// versionedKeys lists the keys below prefix having a current or a stored version, sorted.
+func versionedKeys(mount string, bucket string, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	root := filepath.Join(mount, bucket)
+	err := fs.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		key, _ := filepath.Rel(root, path)
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			seen[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := fs.ReadDir(filepath.Join(mount, Metadata, versionsDir, bucket))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		stored, err := storedVersions(filepath.Join(mount, Metadata, versionsDir, bucket, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(stored) > 0 && strings.HasPrefix(stored[0].Key, prefix) {
+			seen[stored[0].Key] = true
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// archiveVersion moves the current object into the version store before it is replaced or deleted.
+func archiveVersion(s3 S.Request, status string) error {
+	if len(status) == 0 || !isObject(s3.Path) {
+		return nil
+	}
+
+	id := currentVersionID(s3.Path)
+	if id == nullVersion && status == "Suspended" {
+		return nil
+	}
+
+	dir := versionDir(s3.Mount, s3.Bucket, s3.Key)
+	if err := fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := fs.Setxattr(s3.Path, "key", s3.Key); err != nil {
+		return err
+	}
+
+	return fs.Rename(s3.Path, filepath.Join(dir, id))
+}
+
+// checkReplace refuses to destroy locked versions when the key is overwritten or deleted without a version id.
+func checkReplace(s3 S.Request, status string) error {
+	if status != "Enabled" && isObject(s3.Path) && (len(status) == 0 || currentVersionID(s3.Path) == nullVersion) {
+		if err := checkObjectLock(s3.Path, s3.BypassGovernance); err != nil {
+			return err
+		}
+	}
+	if status == "Suspended" {
+		return checkObjectLock(filepath.Join(versionDir(s3.Mount, s3.Bucket, s3.Key), nullVersion), s3.BypassGovernance)
+	}
+	return nil
+}
+
+func removeNullVersion(s3 S.Request) error {
+	err := removeObjectFile(s3, filepath.Join(versionDir(s3.Mount, s3.Bucket, s3.Key), nullVersion))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// commitObject moves a fully written temporary file to the key, keeping the
+// replaced object as a version when versioning is configured for the bucket.
+func commitObject(s3 S.Request, tmp string, versionID string) (err error) {
+	unlock := lockKey(s3.Path)
+	defer unlock()
+
+	placed, err := placeObject(s3, tmp)
+	if err != nil {
+		return err
+	}
+	if placed != tmp {
+		defer func() {
+			if err != nil {
+				removeObjectFile(s3, placed)
+			}
+		}()
+		tmp = placed
+	}
+
+	if len(versionID) > 0 {
+		if err := fs.Setxattr(tmp, "version-id", versionID); err != nil {
+			return err
+		}
+	}
+
+	status := versioningStatus(s3.Mount, s3.Bucket)
+	if err := checkReplace(s3, status); err != nil {
+		return err
+	}
+	if err := archiveVersion(s3, status); err != nil {
+		return err
+	}
+	if versionID == nullVersion {
+		if err := removeNullVersion(s3); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.MkdirAll(filepath.Dir(s3.Path), os.ModePerm); err != nil {
+		return err
+	}
+
+	return replaceFile(s3, tmp, s3.Path)
+}
+
+func putDeleteMarker(s3 S.Request, versionID string) error {
+	dir := versionDir(s3.Mount, s3.Bucket, s3.Key)
+	if err := fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, versionID)
+	file, err := fs.Create(path)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	for k, v := range map[string]string{
+		"key":           s3.Key,
+		"version-id":    versionID,
+		"delete-marker": "true",
+	} {
+		if err := fs.Setxattr(path, k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// promoteLatest makes the newest stored version current again unless it is a delete marker.
+func promoteLatest(s3 S.Request) error {
+	if isObject(s3.Path) {
+		return nil
+	}
+
+	dir := versionDir(s3.Mount, s3.Bucket, s3.Key)
+	stored, err := storedVersions(dir)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		fs.Remove(dir)
+		return nil
+	}
+	if stored[0].DeleteMarker {
+		return nil
+	}
+
+	if err := fs.MkdirAll(filepath.Dir(s3.Path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := fs.Rename(stored[0].Path, s3.Path); err != nil {
+		return err
+	}
+
+	if entries, err := fs.ReadDir(dir); err == nil && len(entries) == 0 {
+		fs.Remove(dir)
+	}
+	return nil
+}
+
+// deleteObject removes a key or one of its versions according to the versioning state of the bucket.
+func deleteObject(s3 S.Request, versionID string) (S.DeletedObject, error) {
+	unlock := lockKey(s3.Path)
+	defer unlock()
+
+	deleted := S.DeletedObject{Key: s3.Key}
+	root := filepath.Join(s3.Mount, s3.Bucket)
+
+	if len(versionID) > 0 {
+		v, err := findVersion(s3, versionID)
+		if err != nil {
+			return deleted, err
+		}
+		if err := checkObjectLock(v.Path, s3.BypassGovernance); err != nil {
+			return deleted, err
+		}
+		if err := removeObjectFile(s3, v.Path); err != nil {
+			return deleted, err
+		}
+		if err := promoteLatest(s3); err != nil {
+			return deleted, err
+		}
+		fs.CleanupEmptyDirs(s3.Path, root)
+
+		deleted.VersionID = v.ID
+		if v.DeleteMarker {
+			deleted.DeleteMarker = true
+			deleted.DeleteMarkerVersionID = v.ID
+		}
+		return deleted, nil
+	}
+
+	status := versioningStatus(s3.Mount, s3.Bucket)
+	if err := checkReplace(s3, status); err != nil {
+		return deleted, err
+	}
+	if len(status) == 0 {
+		if _, err := fs.Stat(s3.Path); err != nil {
+			return deleted, err
+		}
+		if err := removeObjectFile(s3, s3.Path); err != nil {
+			return deleted, err
+		}
+		fs.CleanupEmptyDirs(s3.Path, root)
+		return deleted, nil
+	}
+
+	if err := archiveVersion(s3, status); err != nil {
+		return deleted, err
+	}
+	if status == "Suspended" {
+		if err := removeObjectFile(s3, s3.Path); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		if err := removeNullVersion(s3); err != nil {
+			return deleted, err
+		}
+	}
+
+	markerID := newVersionID(status)
+	if err := putDeleteMarker(s3, markerID); err != nil {
+		return deleted, err
+	}
+	fs.CleanupEmptyDirs(s3.Path, root)
+
+	deleted.DeleteMarker = true
+	deleted.DeleteMarkerVersionID = markerID
+	return deleted, nil
+}
+
+// objectPath resolves the file serving a GET or HEAD request and sets the version headers.
+func objectPath(w http.ResponseWriter, s3 S.Request, versionID string) (string, int, string, error) {
+	if len(versionID) > 0 {
+		v, err := findVersion(s3, versionID)
+		if err != nil {
+			return "", http.StatusNotFound, "NoSuchVersion", err
+		}
+		w.Header().Set("x-amz-version-id", v.ID)
+		if v.DeleteMarker {
+			w.Header().Set("x-amz-delete-marker", "true")
+			return "", http.StatusMethodNotAllowed, "MethodNotAllowed", errors.New("version is a delete marker")
+		}
+		return v.Path, 0, "", nil
+	}
+
+	if !isObject(s3.Path) {
+		stored, _ := storedVersions(versionDir(s3.Mount, s3.Bucket, s3.Key))
+		if len(stored) > 0 && stored[0].DeleteMarker {
+			w.Header().Set("x-amz-delete-marker", "true")
+			w.Header().Set("x-amz-version-id", stored[0].ID)
+		}
+		return "", http.StatusNotFound, "NoSuchKey", os.ErrNotExist
+	}
+	if _, err := objectETag(s3, s3.Path); err != nil {
+		return "", http.StatusInternalServerError, "InternalError", err
+	}
+
+	if len(versioningStatus(s3.Mount, s3.Bucket)) > 0 {
+		w.Header().Set("x-amz-version-id", currentVersionID(s3.Path))
+	}
+	return s3.Path, 0, "", nil
+}
+
+func deleteVersionStore(mount string, bucket string) error {
+	return fs.RemoveAll(filepath.Join(mount, Metadata, versionsDir, bucket))
+}
+
+func hasStoredVersions(mount string, bucket string) bool {
+	entries, err := fs.ReadDir(filepath.Join(mount, Metadata, versionsDir, bucket))
+	return err == nil && len(entries) > 0
+}
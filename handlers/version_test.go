@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func TestVersioning(t *testing.T) {
+	_, do := newTestApp(t, t.TempDir())
+	do(Put, "PUT", "/bucket", "")
+	do(Put, "PUT", "/bucket?versioning", `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+
+	labels := map[string]string{nullVersion: "null"}
+	ids := []string{}
+	for _, data := range []string{"v1", "v2", "v3"} {
+		id := do(Put, "PUT", "/bucket/key", data).Header().Get("x-amz-version-id")
+		if !validVersionID(id) || id == nullVersion {
+			t.Fatalf("PUT returned version %q", id)
+		}
+		labels[id] = data
+		ids = append(ids, id)
+	}
+
+	// expect compares the versions and the delete markers listed for the key,
+	// in the order listed and named by their data, with the latest starred.
+	expect := func(versions string, markers string) {
+		t.Helper()
+		result := S.ListVersionsResult{}
+		if err := xml.Unmarshal(do(Get, "GET", "/bucket?versions", "").Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		name := func(id string, latest bool) string {
+			if latest {
+				return labels[id] + "*"
+			}
+			return labels[id]
+		}
+		listed, marked := []string{}, []string{}
+		for _, v := range result.Version {
+			listed = append(listed, name(v.VersionID, v.IsLatest))
+		}
+		for _, m := range result.DeleteMarker {
+			marked = append(marked, name(m.VersionID, m.IsLatest))
+		}
+		if got := strings.Join(listed, " "); got != versions {
+			t.Errorf("versions %q, want %q", got, versions)
+		}
+		if got := strings.Join(marked, " "); got != markers {
+			t.Errorf("delete markers %q, want %q", got, markers)
+		}
+	}
+	get := func(target string, status int, body string) {
+		t.Helper()
+		w := do(Get, "GET", target, "")
+		if w.Code != status || status == 200 && w.Body.String() != body {
+			t.Errorf("GET %s: %d %q", target, w.Code, w.Body)
+		}
+	}
+
+	expect("v3* v2 v1", "")
+	get("/bucket/key", 200, "v3")
+	get("/bucket/key?versionId="+ids[0], 200, "v1")
+	get("/bucket/key?versionId=nonexisting", 404, "")
+
+	w := do(Delete, "DELETE", "/bucket/key", "")
+	marker := w.Header().Get("x-amz-version-id")
+	if w.Header().Get("x-amz-delete-marker") != "true" || !validVersionID(marker) {
+		t.Fatalf("DELETE did not put a delete marker: %v", w.Header())
+	}
+	labels[marker] = "marker"
+	expect("v3 v2 v1", "marker*")
+	if w := do(Get, "GET", "/bucket/key", ""); w.Code != 404 || w.Header().Get("x-amz-delete-marker") != "true" || w.Header().Get("x-amz-version-id") != marker {
+		t.Errorf("GET of a deleted key: %d %v", w.Code, w.Header())
+	}
+	get("/bucket/key?versionId="+marker, 405, "")
+	get("/bucket/key?versionId="+ids[1], 200, "v2")
+
+	if w := do(Delete, "DELETE", "/bucket/key?versionId="+marker, ""); w.Header().Get("x-amz-delete-marker") != "true" || w.Header().Get("x-amz-version-id") != marker {
+		t.Errorf("DELETE of the delete marker: %v", w.Header())
+	}
+	get("/bucket/key", 200, "v3")
+	expect("v3* v2 v1", "")
+
+	do(Delete, "DELETE", "/bucket/key?versionId="+ids[2], "")
+	get("/bucket/key", 200, "v2")
+	expect("v2* v1", "")
+	do(Delete, "DELETE", "/bucket/key?versionId="+ids[0], "")
+	expect("v2*", "")
+
+	do(Put, "PUT", "/bucket?versioning", `<VersioningConfiguration><Status>Suspended</Status></VersioningConfiguration>`)
+	if id := do(Put, "PUT", "/bucket/key", "s1").Header().Get("x-amz-version-id"); id != nullVersion {
+		t.Errorf("PUT in a suspended bucket returned version %q", id)
+	}
+	do(Put, "PUT", "/bucket/key", "s2")
+	expect("null* v2", "")
+	get("/bucket/key?versionId=null", 200, "s2")
+	get("/bucket/key?versionId="+ids[1], 200, "v2")
+
+	if w := do(Delete, "DELETE", "/bucket/key", ""); w.Header().Get("x-amz-version-id") != nullVersion {
+		t.Errorf("DELETE in a suspended bucket: %v", w.Header())
+	}
+	expect("v2", "null*")
+	get("/bucket/key?versionId=null", 405, "")
+
+	do(Delete, "DELETE", "/bucket/key?versionId=null", "")
+	get("/bucket/key", 200, "v2")
+	expect("v2*", "")
+}
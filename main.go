@@ -5,53 +5,59 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	H "github.com/autovia/tri/handlers"
+	"github.com/autovia/tri/server"
 	S "github.com/autovia/tri/structs"
 )
 
 func main() {
-	app := &S.App{}
-	app.Addr = flag.String("addr", ":3000", "TCP address for the server to listen on, in the form host:port")
-	app.AccessKey = flag.String("access-key", "user", "aws_access_key_id")
-	app.SecretKey = flag.String("secret-key", "password", "aws_secret_access_key")
-	app.Mount = flag.String("mount", "./mount", "root directory containing the buckets and files")
-	flag.Parse()
-
-	// Router
-	app.Router = http.NewServeMux()
-	app.Router.Handle("/", S.Auth{App: app, R: map[string]any{
-		"GET":    H.Get,
-		"PUT":    H.Put,
-		"POST":   H.Post,
-		"DELETE": H.Delete,
-		"HEAD":   H.Head,
-	}})
-
-	// Check fs folders
-	if _, err := os.Stat(*app.Mount); os.IsNotExist(err) {
-		if err := os.Mkdir(*app.Mount, os.ModePerm); err != nil {
-			log.Fatalf("Can not create storage directoy at %s", *app.Mount)
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := H.RunCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("Storage directory created at %s", *app.Mount)
+		return
 	}
 
-	metadata := filepath.Join(*app.Mount, H.Metadata)
-	if _, err := os.Stat(metadata); os.IsNotExist(err) {
-		if err := os.Mkdir(metadata, os.ModePerm); err != nil {
-			log.Fatalf("Can not create metadata directoy at %s", *app.Mount)
-		}
-		log.Printf("Metadata directory created at %s", metadata)
+	opts := server.Options{Tiers: S.Tiers{}}
+	addr := flag.String("addr", ":3000", "TCP address for the server to listen on, in the form host:port")
+	flag.StringVar(&opts.AccessKey, "access-key", "user", "aws_access_key_id")
+	flag.StringVar(&opts.SecretKey, "secret-key", "password", "aws_secret_access_key")
+	mount := flag.String("mount", "./mount", "root directory containing the buckets and files, followed by comma separated directories holding a mirror of it")
+	flag.IntVar(&opts.WriteQuorum, "write-quorum", 0, "number of mirrored directories a write must reach, 0 for a majority of them")
+	flag.StringVar(&opts.Region, "region", "us-east-1", "region reported as the location of all buckets")
+	flag.Var(opts.Tiers, "tier", "storage class stored outside the mount as CLASS=dir, can be repeated")
+	flag.StringVar(&opts.KeyFile, "key-file", "", "file holding the master key for server side encryption, created when missing, empty to disable")
+	flag.StringVar(&opts.Metadata, "metadata", "xattr", "where object metadata is kept: xattr for user extended attributes, sidecar for files under the metadata directory")
+	flag.StringVar(&opts.Backend, "backend", "posix", "where buckets and objects are stored: posix for the mount directory, memory to keep them in memory until the server exits, erasure to spread them over several disks")
+	flag.Var(&opts.Disks, "disk", "directory of a disk the mount is erasure coded across with -backend erasure, can be repeated")
+	flag.IntVar(&opts.Parity, "parity", 0, "number of disks holding parity shards with -backend erasure, 0 for half of them")
+	flag.BoolVar(&opts.Dedup, "dedup", false, "store identical object data once under the metadata directory, keys referencing it by SHA-256")
+	flag.DurationVar(&opts.UploadMaxAge, "upload-max-age", 0, "abort incomplete multipart uploads older than this, 0 to keep them")
+	flag.DurationVar(&opts.JanitorInterval, "janitor-interval", time.Hour, "interval between scans for stale multipart uploads and lifecycle expiration, 0 to disable")
+	flag.BoolVar(&opts.GovernanceBypass, "governance-bypass", false, "honour x-amz-bypass-governance-retention to remove objects under GOVERNANCE retention")
+	flag.DurationVar(&opts.ScrubInterval, "scrub-interval", 0, "interval between scrubs re-hashing every object to find and quarantine corrupt data, 0 to disable")
+	flag.Int64Var(&opts.ScrubRate, "scrub-rate", 32, "MiB per second read by the scrubber, negative for no limit")
+	flag.BoolVar(&opts.VerifyReads, "verify-reads", false, "verify object data against its ETag before every GET, requests override it with x-tri-verify")
+	flag.Parse()
+
+	mounts := strings.Split(*mount, ",")
+	opts.Mount, opts.Mirrors = mounts[0], mounts[1:]
+
+	handler, err := server.New(opts)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Server
 	srv := &http.Server{
-		Addr:    *app.Addr,
-		Handler: app.Router,
+		Addr:    *addr,
+		Handler: handler,
 		//TLSConfig:    cfg,
 		//TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
-	log.Printf("Listen on %s", *app.Addr)
+	log.Printf("Listen on %s", *addr)
 	log.Fatal(srv.ListenAndServe())
 }
@@ -0,0 +1,330 @@
+// Package server runs tri inside another Go program, typically to give the
+// tests of a service a real S3 endpoint without a separate binary.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autovia/tri/fs"
+	H "github.com/autovia/tri/handlers"
+	S "github.com/autovia/tri/structs"
+)
+
+// Options configure a server like the flags of the tri binary. Empty fields
+// take the defaults of the flags, except for the janitor and the scrubber which
+// only run with a positive JanitorInterval and ScrubInterval.
+type Options struct {
+	Mount            string
+	Mirrors          []string
+	WriteQuorum      int
+	AccessKey        string
+	SecretKey        string
+	Region           string
+	Tiers            S.Tiers
+	KeyFile          string
+	Backend          string
+	Disks            S.Disks
+	Parity           int
+	Metadata         string
+	Dedup            bool
+	UploadMaxAge     time.Duration
+	JanitorInterval  time.Duration
+	GovernanceBypass bool
+	ScrubInterval    time.Duration
+	ScrubRate        int64
+	VerifyReads      bool
+}
+
+var (
+	selected   string
+	users      int
+	selectedMu sync.Mutex
+	memory     = fs.NewMemory()
+)
+
+// backendKey tells which servers can share a backend. The memory backend and
+// extended attributes serve any mount, the other backends and metadata stores
+// are opened for the mount, disks and tiers of one server.
+func backendKey(opts Options) string {
+	switch {
+	case opts.Backend == "memory":
+		return "memory"
+	case opts.Backend == "posix" && len(opts.Mirrors) == 0 && opts.Metadata == "xattr":
+		return "posix/xattr"
+	}
+	return fmt.Sprintf("%s/%s mount %s mirrors %v quorum %d disks %s parity %d tiers %s",
+		opts.Backend, opts.Metadata, opts.Mount, opts.Mirrors, opts.WriteQuorum, opts.Disks.String(), opts.Parity, opts.Tiers.String())
+}
+
+// useBackend selects the storage backend, which is shared by all servers of
+// the process, and returns it when it changed along with a function that
+// releases it. While servers use a backend, it is only shared with servers
+// that need the same one; a server needing another one is refused.
+func useBackend(opts Options) (fs.Backend, func(), error) {
+	selectedMu.Lock()
+	defer selectedMu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			selectedMu.Lock()
+			users--
+			selectedMu.Unlock()
+		})
+	}
+	kind := backendKey(opts)
+	if users > 0 {
+		if kind != selected {
+			return nil, nil, fmt.Errorf("storage backend %s is in use by another server, servers of a process must share it", selected)
+		}
+		users++
+		return nil, release, nil
+	}
+
+	b := fs.Backend(memory)
+	if opts.Backend != "memory" || len(opts.Mirrors) > 0 {
+		if opts.Backend == "posix" && len(opts.Mirrors) == 0 {
+			roots := []string{opts.Mount}
+			for _, root := range opts.Tiers {
+				roots = append(roots, root)
+			}
+			for _, root := range roots {
+				if err := os.MkdirAll(root, os.ModePerm); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		var err error
+		b, err = H.OpenBackend(H.BackendOptions{
+			Backend:     opts.Backend,
+			Metadata:    opts.Metadata,
+			Mount:       opts.Mount,
+			Mirrors:     opts.Mirrors,
+			WriteQuorum: opts.WriteQuorum,
+			Disks:       opts.Disks,
+			Parity:      opts.Parity,
+			Tiers:       opts.Tiers,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	fs.UseBackend(b)
+	selected = kind
+	users = 1
+	return b, release, nil
+}
+
+// New prepares the mount and returns the handler serving the S3 API. The
+// backend and metadata store are process wide, servers running side by side
+// must use the same ones and New fails for a server needing others.
+func New(opts Options) (http.Handler, error) {
+	handler, _, err := newHandler(opts)
+	return handler, err
+}
+
+// newHandler is New, also returning the function that stops the background
+// jobs and releases the backend once the server is done.
+func newHandler(opts Options) (http.Handler, func(), error) {
+	if len(opts.Mount) == 0 {
+		return nil, nil, fmt.Errorf("mount missing")
+	}
+	if len(opts.AccessKey) == 0 {
+		opts.AccessKey = "user"
+	}
+	if len(opts.SecretKey) == 0 {
+		opts.SecretKey = "password"
+	}
+	if len(opts.Region) == 0 {
+		opts.Region = "us-east-1"
+	}
+	if opts.Tiers == nil {
+		opts.Tiers = S.Tiers{}
+	}
+	if len(opts.Backend) == 0 {
+		opts.Backend = "posix"
+	}
+	if len(opts.Metadata) == 0 {
+		opts.Metadata = "xattr"
+	}
+	if opts.ScrubRate == 0 {
+		opts.ScrubRate = 32
+	}
+
+	b, release, err := useBackend(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(format string, args ...any) (http.Handler, func(), error) {
+		release()
+		return nil, nil, fmt.Errorf(format, args...)
+	}
+
+	// Check fs folders
+	if _, err := fs.Stat(opts.Mount); os.IsNotExist(err) {
+		if err := fs.MkdirAll(opts.Mount, os.ModePerm); err != nil {
+			return fail("can not create storage directory at %s", opts.Mount)
+		}
+		log.Printf("Storage directory created at %s", opts.Mount)
+	}
+
+	metadata := filepath.Join(opts.Mount, H.Metadata)
+	if _, err := fs.Stat(metadata); os.IsNotExist(err) {
+		if err := fs.MkdirAll(metadata, os.ModePerm); err != nil {
+			return fail("can not create metadata directory at %s", metadata)
+		}
+		log.Printf("Metadata directory created at %s", metadata)
+	}
+
+	for class, root := range opts.Tiers {
+		for _, dir := range []string{H.TierTmp, H.TierObjects} {
+			if err := fs.MkdirAll(filepath.Join(root, dir), os.ModePerm); err != nil {
+				return fail("can not create %s tier directory at %s", class, root)
+			}
+		}
+		log.Printf("Storage class %s stored at %s", class, root)
+	}
+
+	switch {
+	case opts.Backend == "memory":
+		log.Printf("Storage kept in memory")
+	case opts.Backend == "erasure":
+		log.Printf("Storage erasure coded across %s, metadata kept in %s", opts.Disks.String(), opts.Metadata)
+	case len(opts.Mirrors) > 0:
+		log.Printf("Storage mirrored to %s, metadata kept in %s", strings.Join(opts.Mirrors, ","), opts.Metadata)
+	default:
+		log.Printf("Metadata kept in %s", opts.Metadata)
+	}
+
+	app := &S.App{
+		AccessKey:        &opts.AccessKey,
+		SecretKey:        &opts.SecretKey,
+		Mount:            &opts.Mount,
+		Region:           &opts.Region,
+		Tiers:            opts.Tiers,
+		KeyFile:          &opts.KeyFile,
+		Dedup:            &opts.Dedup,
+		Metadata:         &opts.Metadata,
+		Backend:          &opts.Backend,
+		UploadMaxAge:     &opts.UploadMaxAge,
+		JanitorInterval:  &opts.JanitorInterval,
+		GovernanceBypass: &opts.GovernanceBypass,
+		ScrubInterval:    &opts.ScrubInterval,
+		ScrubRate:        &opts.ScrubRate,
+		VerifyReads:      &opts.VerifyReads,
+	}
+
+	if len(opts.KeyFile) > 0 {
+		key, err := H.LoadMasterKey(opts.KeyFile)
+		if err != nil {
+			return fail("can not load master key from %s: %w", opts.KeyFile, err)
+		}
+		app.MasterKey = key
+		log.Printf("Server side encryption enabled with master key %s", opts.KeyFile)
+	}
+
+	// Router
+	app.Router = http.NewServeMux()
+	app.Router.Handle("/", S.Auth{App: app, R: map[string]any{
+		"GET":    H.Get,
+		"PUT":    H.Put,
+		"POST":   H.Post,
+		"DELETE": H.Delete,
+		"HEAD":   H.Head,
+	}})
+
+	// Background jobs
+	ctx, cancel := context.WithCancel(context.Background())
+	go H.Janitor(ctx, app)
+	go H.Scrubber(ctx, app)
+	if m, ok := b.(*fs.Mirror); ok {
+		go H.ResyncMirror(ctx, m, time.Minute)
+	}
+
+	return app.Router, func() {
+		cancel()
+		release()
+	}, nil
+}
+
+// Endpoint tells a client where to find a test server and how to sign its
+// requests. With aws-sdk-go-v2:
+//
+//	s3.NewFromConfig(aws.Config{
+//		Region:      e.Region,
+//		Credentials: credentials.NewStaticCredentialsProvider(e.AccessKey, e.SecretKey, ""),
+//	}, func(o *s3.Options) {
+//		o.BaseEndpoint = aws.String(e.URL)
+//		o.UsePathStyle = true
+//	})
+type Endpoint struct {
+	URL       string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Mount     string
+}
+
+// TB is the part of testing.TB a test server needs, so the package does not
+// import testing into the programs embedding it.
+type TB interface {
+	Cleanup(func())
+	TempDir() string
+	Fatal(args ...any)
+}
+
+// NewTestServer starts a server on a local port that is closed with the
+// test. Unless given in opts, the mount is a temporary directory and the
+// credentials are random.
+func NewTestServer(t TB, opts Options) Endpoint {
+	if len(opts.Mount) == 0 {
+		opts.Mount = t.TempDir()
+	}
+	if len(opts.AccessKey) == 0 {
+		opts.AccessKey = randomString(10)
+	}
+	if len(opts.SecretKey) == 0 {
+		opts.SecretKey = randomString(20)
+	}
+	if len(opts.Region) == 0 {
+		opts.Region = "us-east-1"
+	}
+
+	handler, release, err := newHandler(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(release)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return Endpoint{
+		URL:       "http://" + listener.Addr().String(),
+		Region:    opts.Region,
+		AccessKey: opts.AccessKey,
+		SecretKey: opts.SecretKey,
+		Mount:     opts.Mount,
+	}
+}
+
+func randomString(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
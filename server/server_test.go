@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	S "github.com/autovia/tri/structs"
+)
+
+func sign(t *testing.T, e Endpoint, method, path, body string) *http.Response {
+	t.Helper()
+	r, err := http.NewRequest(method, e.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	hash := S.HexSHA256Hash([]byte(body))
+	r.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	r.Header.Set("X-Amz-Content-Sha256", hash)
+
+	scope := date + "/" + e.Region + "/s3/aws4_request"
+	canonical := strings.Join([]string{method, r.URL.EscapedPath(), r.URL.Query().Encode(),
+		"host:" + r.URL.Host, "x-amz-content-sha256:" + hash, "x-amz-date:" + r.Header.Get("X-Amz-Date"), "",
+		"host;x-amz-content-sha256;x-amz-date", hash}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + S.HexSHA256Hash([]byte(canonical))
+	key := []byte("AWS4" + e.SecretKey)
+	for _, part := range []string{date, e.Region, "s3", "aws4_request"} {
+		key = S.HmacSHA256(key, []byte(part))
+	}
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+e.AccessKey+"/"+scope+
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+hex.EncodeToString(S.HmacSHA256(key, []byte(toSign))))
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestNewTestServer(t *testing.T) {
+	for _, backend := range []string{"memory", "posix", "erasure", "mirror"} {
+		t.Run(backend, func(t *testing.T) {
+			opts := Options{Backend: backend}
+			switch backend {
+			case "erasure":
+				for range 3 {
+					opts.Disks = append(opts.Disks, t.TempDir())
+				}
+			case "mirror":
+				opts = Options{Mirrors: []string{t.TempDir(), t.TempDir()}}
+			}
+			e := NewTestServer(t, opts)
+
+			if resp, err := http.Get(e.URL + "/"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("unsigned request not rejected: %v %v", resp, err)
+			}
+			if resp := sign(t, e, "PUT", "/bucket", ""); resp.StatusCode != http.StatusOK {
+				t.Fatalf("create bucket: %s", resp.Status)
+			}
+			if resp := sign(t, e, "PUT", "/bucket/key", "embedded"); resp.StatusCode != http.StatusOK {
+				if backend != "memory" && resp.StatusCode == http.StatusInternalServerError {
+					t.Skip("xattrs not supported")
+				}
+				t.Fatalf("put object: %s", resp.Status)
+			}
+			resp := sign(t, e, "GET", "/bucket/key", "")
+			if data, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(data) != "embedded" {
+				t.Errorf("get object: %s %q", resp.Status, data)
+			}
+		})
+	}
+}
+
+func TestSharedBackend(t *testing.T) {
+	first := NewTestServer(t, Options{Backend: "memory"})
+	if _, err := New(Options{Mount: t.TempDir(), Metadata: "sidecar"}); err == nil {
+		t.Fatal("server with another backend started next to a running one")
+	}
+	second := NewTestServer(t, Options{Backend: "memory"})
+
+	if resp := sign(t, first, "PUT", "/bucket", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("create bucket: %s", resp.Status)
+	}
+	if resp := sign(t, second, "HEAD", "/bucket", ""); resp.StatusCode == http.StatusOK {
+		t.Errorf("mounts not separated: %s", resp.Status)
+	}
+}
+
+func TestReleaseStopsBackgroundJobs(t *testing.T) {
+	before := runtime.NumGoroutine()
+	_, release, err := newHandler(Options{Mount: t.TempDir(), Backend: "memory", JanitorInterval: time.Hour, ScrubInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, %d before the server", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,13 +1,76 @@
 package structs
 
 import (
+	"errors"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 type App struct {
-	Addr      *string
 	Router    *http.ServeMux
 	AccessKey *string
 	SecretKey *string
 	Mount     *string
+	Region    *string
+	Tiers     Tiers
+	KeyFile   *string
+	MasterKey *[32]byte
+	Dedup     *bool
+	Metadata  *string
+	Backend   *string
+
+	UploadMaxAge     *time.Duration
+	JanitorInterval  *time.Duration
+	GovernanceBypass *bool
+	ScrubInterval    *time.Duration
+	ScrubRate        *int64
+	VerifyReads      *bool
+}
+
+// Tiers maps storage classes other than STANDARD to the root directory holding their data.
+type Tiers map[string]string
+
+func (t Tiers) String() string {
+	tiers := []string{}
+	for class, root := range t {
+		tiers = append(tiers, class+"="+root)
+	}
+	sort.Strings(tiers)
+	return strings.Join(tiers, ",")
+}
+
+func (t Tiers) Set(value string) error {
+	class, root, found := strings.Cut(value, "=")
+	if !found || len(class) == 0 || len(root) == 0 {
+		return errors.New("tier must be given as CLASS=dir")
+	}
+	if class == "STANDARD" {
+		return errors.New("STANDARD is stored in the mount directory")
+	}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	t[class] = abs
+	return nil
+}
+
+// Disks lists the directories an erasure coded mount is spread over.
+type Disks []string
+
+func (d *Disks) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *Disks) Set(value string) error {
+	abs, err := filepath.Abs(value)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, abs)
+	return nil
 }
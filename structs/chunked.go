@@ -0,0 +1,160 @@
+package structs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errMalformedChunk = errors.New("malformed aws-chunked encoding")
+
+// ErrChunkSignature is returned reading a signed aws-chunked body whose chunk
+// or trailer signature does not match.
+var ErrChunkSignature = errors.New("chunk signature does not match")
+
+// chunkedReader decodes an aws-chunked request body and collects its trailing
+// headers. With a signer, every chunk and the trailer must carry a valid
+// signature.
+type chunkedReader struct {
+	body      io.ReadCloser
+	r         *bufio.Reader
+	remaining int64
+	trailer   http.Header
+	done      bool
+	signer    *chunkSigner
+	signature string
+	hash      hash.Hash
+}
+
+func NewChunkedReader(body io.ReadCloser, trailer http.Header) io.ReadCloser {
+	return &chunkedReader{body: body, r: bufio.NewReader(body), trailer: trailer}
+}
+
+func newSignedChunkedReader(body io.ReadCloser, trailer http.Header, signer *chunkSigner) io.ReadCloser {
+	return &chunkedReader{body: body, r: bufio.NewReader(body), trailer: trailer, signer: signer, hash: sha256.New()}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+
+	if c.remaining == 0 {
+		line, err := c.readLine()
+		if err == io.EOF && c.signer != nil {
+			// A signed body ends with a signed empty chunk, so one cut at a
+			// chunk boundary is not complete.
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		size, extension, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return 0, errMalformedChunk
+		}
+		if c.signer != nil {
+			signature, found := strings.CutPrefix(strings.TrimSpace(extension), "chunk-signature=")
+			if !found {
+				return 0, errMalformedChunk
+			}
+			c.signature = signature
+			c.hash.Reset()
+		}
+		if n == 0 {
+			c.done = true
+			if err := c.verifyChunk(); err != nil {
+				return 0, err
+			}
+			return 0, c.readTrailer()
+		}
+		c.remaining = n
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.signer != nil {
+		c.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if c.remaining == 0 {
+		if line, err := c.readLine(); err != nil || len(line) > 0 {
+			return n, errMalformedChunk
+		}
+		if err := c.verifyChunk(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// verifyChunk checks the signature of the chunk just read.
+func (c *chunkedReader) verifyChunk() error {
+	if c.signer != nil && !c.signer.verifyChunk(hex.EncodeToString(c.hash.Sum(nil)), c.signature) {
+		return ErrChunkSignature
+	}
+	return nil
+}
+
+func (c *chunkedReader) readTrailer() error {
+	var signed strings.Builder
+	signature := ""
+	for {
+		line, err := c.readLine()
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return errMalformedChunk
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if c.signer != nil && strings.EqualFold(name, "x-amz-trailer-signature") {
+			signature = value
+			continue
+		}
+		signed.WriteString(strings.ToLower(name) + ":" + value + "\n")
+		if c.trailer != nil {
+			c.trailer.Set(name, value)
+		}
+	}
+
+	if c.signer != nil && c.signer.trailer && !c.signer.verifyTrailer(HexSHA256Hash([]byte(signed.String())), signature) {
+		return ErrChunkSignature
+	}
+	return io.EOF
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
@@ -0,0 +1,62 @@
+package structs
+
+import "encoding/xml"
+
+// KMSKey is a key of the local key management service as stored under the
+// metadata directory. The key material of each version is sealed with the
+// master key.
+type KMSKey struct {
+	XMLName      xml.Name        `xml:"KMSKey"`
+	KeyID        string          `xml:"KeyId"`
+	Alias        string          `xml:"Alias,omitempty"`
+	Description  string          `xml:"Description,omitempty"`
+	Enabled      bool            `xml:"Enabled"`
+	CreationDate string          `xml:"CreationDate"`
+	Versions     []KMSKeyVersion `xml:"Version"`
+}
+
+type KMSKeyVersion struct {
+	Number       int
+	Material     string
+	CreationDate string
+}
+
+type KMSRequest struct {
+	KeyId             string
+	Description       string
+	KeySpec           string
+	NumberOfBytes     int
+	EncryptionContext map[string]string
+	CiphertextBlob    []byte
+}
+
+type KMSResponse struct {
+	KeyMetadata         *KMSKeyMetadata   `json:",omitempty"`
+	Keys                []KMSKeyListEntry `json:",omitempty"`
+	Truncated           *bool             `json:",omitempty"`
+	KeyId               string            `json:",omitempty"`
+	CiphertextBlob      []byte            `json:",omitempty"`
+	Plaintext           []byte            `json:",omitempty"`
+	EncryptionAlgorithm string            `json:",omitempty"`
+}
+
+type KMSKeyMetadata struct {
+	AWSAccountId          string
+	KeyId                 string
+	Arn                   string
+	CreationDate          float64
+	Enabled               bool
+	Description           string
+	KeyState              string
+	KeyUsage              string
+	KeySpec               string
+	KeyManager            string
+	Origin                string
+	EncryptionAlgorithms  []string
+	CustomerMasterKeySpec string
+}
+
+type KMSKeyListEntry struct {
+	KeyId  string
+	KeyArn string
+}
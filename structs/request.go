@@ -6,14 +6,21 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type Request struct {
-	Bucket string
-	Key    string
-	Path   string
-	Mount  string
+	Bucket           string
+	Key              string
+	Path             string
+	Mount            string
+	Region           string
+	Tiers            *Tiers
+	MasterKey        *[32]byte
+	Dedup            bool
+	BypassGovernance bool
+	Verify           bool
 }
 
 func (app *App) ParseRequest(r *http.Request) (*http.Request, error) {
@@ -57,11 +64,41 @@ func (app *App) ParseRequest(r *http.Request) (*http.Request, error) {
 		}
 	}
 
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") || strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		r.Trailer = make(http.Header)
+		switch sha := r.Header.Get("X-Amz-Content-Sha256"); {
+		case sha == streamingPayload || sha == streamingPayloadTrailer:
+			signer, ok := r.Context().Value(chunkSignerKey{}).(*chunkSigner)
+			if !ok {
+				return nil, fmt.Errorf("signed chunks without a verified request signature")
+			}
+			r.Body = newSignedChunkedReader(r.Body, r.Trailer, signer)
+		case strings.HasPrefix(sha, "STREAMING-") && sha != "STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+			return nil, fmt.Errorf("%s is not supported", sha)
+		default:
+			r.Body = NewChunkedReader(r.Body, r.Trailer)
+		}
+		if n, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			r.ContentLength = n
+		}
+	}
+
+	verify := *app.VerifyReads
+	if v, err := strconv.ParseBool(r.Header.Get("X-Tri-Verify")); err == nil {
+		verify = v
+	}
+
 	req := Request{
-		Bucket: bucket,
-		Key:    key,
-		Path:   path,
-		Mount:  *app.Mount,
+		Bucket:           bucket,
+		Key:              key,
+		Path:             path,
+		Mount:            *app.Mount,
+		Region:           *app.Region,
+		Tiers:            &app.Tiers,
+		MasterKey:        app.MasterKey,
+		Dedup:            *app.Dedup,
+		BypassGovernance: *app.GovernanceBypass && strings.EqualFold(r.Header.Get("X-Amz-Bypass-Governance-Retention"), "true"),
+		Verify:           verify,
 	}
 
 	ctx := context.WithValue(r.Context(), Request{}, req)
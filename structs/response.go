@@ -1,11 +1,12 @@
 package structs
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"time"
 )
 
 func RespondXML(w http.ResponseWriter, code int, payload any) error {
@@ -35,20 +36,48 @@ func Respond(w http.ResponseWriter, code int, headers map[string]string, body []
 	return nil
 }
 
-func RespondFile(w http.ResponseWriter, code int, headers map[string]string, file *os.File) error {
+// RespondContent serves content with support for Range and conditional requests.
+func RespondContent(w http.ResponseWriter, r *http.Request, headers map[string]string, modtime time.Time, content io.ReadSeekCloser) error {
 	if len(headers) > 0 {
 		for k, v := range headers {
 			w.Header().Set(k, v)
 		}
 	}
 
-	w.WriteHeader(code)
-	defer file.Close()
-	io.Copy(w, file)
+	defer content.Close()
+	http.ServeContent(w, r, "", modtime, content)
 
 	return nil
 }
 
+func RespondXMLKeepAlive(w http.ResponseWriter, interval time.Duration, fn func() any) error {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	rc.Flush()
+
+	done := make(chan any, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case payload := <-done:
+			out, _ := xml.MarshalIndent(payload, " ", "  ")
+			log.Print(">>> RespondXMLKeepAlive >>>", string(out))
+			w.Write([]byte(out))
+			return nil
+		case <-ticker.C:
+			w.Write([]byte(" "))
+			rc.Flush()
+		}
+	}
+}
+
 type Error struct {
 	XMLName   xml.Name `xml:"Error"`
 	Code      string   `xml:"Code"`
@@ -57,6 +86,33 @@ type Error struct {
 	RequestId string   `xml:"RequestId"`
 }
 
+func RespondJSON(w http.ResponseWriter, code int, payload any) error {
+	out, _ := json.Marshal(payload)
+	log.Print(">>> RespondJSON >>>", string(out))
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(code)
+	w.Write(out)
+
+	return nil
+}
+
+// RespondJSONError writes an error in the format of JSON based AWS services.
+func RespondJSONError(w http.ResponseWriter, httpcode int, awscode string, err error) error {
+	log.Printf(">>> RespondJSONError >>> %s, %s", err, awscode)
+
+	message := awscode
+	if err != nil {
+		message = err.Error()
+	}
+	out, _ := json.Marshal(map[string]string{"__type": awscode, "message": message})
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(httpcode)
+	w.Write(out)
+
+	return nil
+}
+
 func RespondError(w http.ResponseWriter, httpcode int, awscode string, err error, resource string) error {
 	e := Error{
 		Code:     awscode,
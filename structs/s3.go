@@ -57,13 +57,15 @@ type Owner struct {
 
 type VersioningConfiguration struct {
 	XMLName xml.Name `xml:"VersioningConfiguration"`
-	Status  string   `xml:"Status"`
+	Status  string   `xml:"Status,omitempty"`
 }
 
 type CopyObjectResult struct {
 	XMLName      xml.Name `xml:"CopyObjectResult"`
 	LastModified string
 	ETag         string
+	Checksums
+	ChecksumType string `xml:"ChecksumType,omitempty"`
 }
 
 type ListVersionsResult struct {
@@ -79,18 +81,31 @@ type ListVersionsResult struct {
 	IsTruncated         bool
 	CommonPrefixes      []CommonPrefix
 	Version             []ObjectVersion
+	DeleteMarker        []DeleteMarkerEntry
 	EncodingType        string `xml:"EncodingType,omitempty"`
 }
 
 type ObjectVersion struct {
 	Object
-	IsLatest       bool
-	VersionID      string `xml:"VersionId"`
-	isDeleteMarker bool
+	IsLatest  bool
+	VersionID string `xml:"VersionId"`
+}
+
+type DeleteMarkerEntry struct {
+	Key          string
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool
+	LastModified string
+	Owner        *Owner `xml:"Owner,omitempty"`
+}
+
+type ObjectIdentifier struct {
+	Key       string
+	VersionID string `xml:"VersionId,omitempty"`
 }
 
 type Delete struct {
-	Objects []Object `xml:"Object"`
+	Objects []ObjectIdentifier `xml:"Object"`
 	Quiet   bool
 }
 
@@ -122,10 +137,267 @@ type InitiateMultipartUploadResponse struct {
 }
 
 type CompleteMultipartUpload struct {
-	XMLName     xml.Name `xml:"CompleteMultipartUpload"`
-	PartNumbers []int    `xml:"Part>PartNumber"`
-	Location    string
-	Bucket      string
-	Key         string
-	ETag        string
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []CompletedPart `xml:"Part"`
+}
+
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+	Checksums
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+	Checksums
+	ChecksumType string `xml:"ChecksumType,omitempty"`
+}
+
+type Checksums struct {
+	ChecksumCRC32     string `xml:"ChecksumCRC32,omitempty"`
+	ChecksumCRC32C    string `xml:"ChecksumCRC32C,omitempty"`
+	ChecksumSHA1      string `xml:"ChecksumSHA1,omitempty"`
+	ChecksumSHA256    string `xml:"ChecksumSHA256,omitempty"`
+	ChecksumCRC64NVME string `xml:"ChecksumCRC64NVME,omitempty"`
+}
+
+func (c *Checksums) Get(algorithm string) string {
+	switch algorithm {
+	case "CRC32":
+		return c.ChecksumCRC32
+	case "CRC32C":
+		return c.ChecksumCRC32C
+	case "SHA1":
+		return c.ChecksumSHA1
+	case "SHA256":
+		return c.ChecksumSHA256
+	case "CRC64NVME":
+		return c.ChecksumCRC64NVME
+	}
+	return ""
+}
+
+func (c *Checksums) Set(algorithm string, value string) {
+	switch algorithm {
+	case "CRC32":
+		c.ChecksumCRC32 = value
+	case "CRC32C":
+		c.ChecksumCRC32C = value
+	case "SHA1":
+		c.ChecksumSHA1 = value
+	case "SHA256":
+		c.ChecksumSHA256 = value
+	case "CRC64NVME":
+		c.ChecksumCRC64NVME = value
+	}
+}
+
+type LifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Rules   []LifecycleRule `xml:"Rule"`
+}
+
+type LifecycleRule struct {
+	ID                             string                          `xml:"ID,omitempty"`
+	Status                         string                          `xml:"Status"`
+	Prefix                         *string                         `xml:"Prefix,omitempty"`
+	Filter                         *LifecycleFilter                `xml:"Filter,omitempty"`
+	Expiration                     *LifecycleExpiration            `xml:"Expiration,omitempty"`
+	Transitions                    []LifecycleTransition           `xml:"Transition,omitempty"`
+	NoncurrentVersionExpiration    *NoncurrentVersionExpiration    `xml:"NoncurrentVersionExpiration,omitempty"`
+	AbortIncompleteMultipartUpload *AbortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload,omitempty"`
+}
+
+type LifecycleFilter struct {
+	Prefix                *string       `xml:"Prefix,omitempty"`
+	Tag                   *Tag          `xml:"Tag,omitempty"`
+	ObjectSizeGreaterThan *int64        `xml:"ObjectSizeGreaterThan,omitempty"`
+	ObjectSizeLessThan    *int64        `xml:"ObjectSizeLessThan,omitempty"`
+	And                   *LifecycleAnd `xml:"And,omitempty"`
+}
+
+type LifecycleAnd struct {
+	Prefix                *string `xml:"Prefix,omitempty"`
+	Tags                  []Tag   `xml:"Tag"`
+	ObjectSizeGreaterThan *int64  `xml:"ObjectSizeGreaterThan,omitempty"`
+	ObjectSizeLessThan    *int64  `xml:"ObjectSizeLessThan,omitempty"`
+}
+
+type LifecycleExpiration struct {
+	Days                      int    `xml:"Days,omitempty"`
+	Date                      string `xml:"Date,omitempty"`
+	ExpiredObjectDeleteMarker *bool  `xml:"ExpiredObjectDeleteMarker,omitempty"`
+}
+
+type LifecycleTransition struct {
+	Days         int    `xml:"Days,omitempty"`
+	Date         string `xml:"Date,omitempty"`
+	StorageClass string
+}
+
+type NoncurrentVersionExpiration struct {
+	NoncurrentDays          int
+	NewerNoncurrentVersions *int `xml:"NewerNoncurrentVersions,omitempty"`
+}
+
+type AbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int
+}
+
+type ObjectLockConfiguration struct {
+	XMLName           xml.Name        `xml:"ObjectLockConfiguration"`
+	ObjectLockEnabled string          `xml:"ObjectLockEnabled,omitempty"`
+	Rule              *ObjectLockRule `xml:"Rule,omitempty"`
+}
+
+type ObjectLockRule struct {
+	DefaultRetention DefaultRetention
+}
+
+type DefaultRetention struct {
+	Mode  string
+	Days  int `xml:"Days,omitempty"`
+	Years int `xml:"Years,omitempty"`
+}
+
+type Retention struct {
+	XMLName         xml.Name `xml:"Retention"`
+	Mode            string   `xml:"Mode,omitempty"`
+	RetainUntilDate string   `xml:"RetainUntilDate,omitempty"`
+}
+
+type LegalHold struct {
+	XMLName xml.Name `xml:"LegalHold"`
+	Status  string
+}
+
+type GetObjectAttributesResponse struct {
+	XMLName      xml.Name        `xml:"GetObjectAttributesResponse"`
+	ETag         string          `xml:"ETag,omitempty"`
+	Checksum     *ObjectChecksum `xml:"Checksum,omitempty"`
+	ObjectParts  *ObjectParts    `xml:"ObjectParts,omitempty"`
+	StorageClass string          `xml:"StorageClass,omitempty"`
+	ObjectSize   *int64          `xml:"ObjectSize,omitempty"`
+}
+
+type ObjectChecksum struct {
+	Checksums
+	ChecksumType string
+}
+
+type ObjectParts struct {
+	IsTruncated          bool
+	MaxParts             int
+	NextPartNumberMarker int
+	PartNumberMarker     int
+	Parts                []ObjectPart `xml:"Part"`
+	PartsCount           int
+}
+
+type ObjectPart struct {
+	Checksums
+	PartNumber int
+	Size       int64
+}
+
+type Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []Tag    `xml:"TagSet>Tag"`
+}
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+type CreateBucketConfiguration struct {
+	XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+	LocationConstraint string
+}
+
+type LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type OwnershipControls struct {
+	XMLName xml.Name                `xml:"OwnershipControls"`
+	Rules   []OwnershipControlsRule `xml:"Rule"`
+}
+
+type OwnershipControlsRule struct {
+	ObjectOwnership string
+}
+
+type PublicAccessBlockConfiguration struct {
+	XMLName               xml.Name `xml:"PublicAccessBlockConfiguration"`
+	BlockPublicAcls       bool
+	IgnorePublicAcls      bool
+	BlockPublicPolicy     bool
+	RestrictPublicBuckets bool
+}
+
+type ServerSideEncryptionConfiguration struct {
+	XMLName xml.Name                   `xml:"ServerSideEncryptionConfiguration"`
+	Rules   []ServerSideEncryptionRule `xml:"Rule"`
+}
+
+type ServerSideEncryptionRule struct {
+	ApplyServerSideEncryptionByDefault ServerSideEncryptionByDefault
+	BucketKeyEnabled                   bool `xml:"BucketKeyEnabled,omitempty"`
+}
+
+type ServerSideEncryptionByDefault struct {
+	SSEAlgorithm   string
+	KMSMasterKeyID string `xml:"KMSMasterKeyID,omitempty"`
+}
+
+// CompressionConfiguration enables transparent compression of the objects of
+// a bucket whose content type or key extension is listed. Algorithm is gzip
+// or zstd.
+type CompressionConfiguration struct {
+	XMLName      xml.Name `xml:"CompressionConfiguration"`
+	Algorithm    string
+	ContentTypes []string `xml:"ContentType"`
+	Extensions   []string `xml:"Extension"`
+}
+
+type AccelerateConfiguration struct {
+	XMLName xml.Name `xml:"AccelerateConfiguration"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+type RequestPaymentConfiguration struct {
+	XMLName xml.Name `xml:"RequestPaymentConfiguration"`
+	Payer   string
+}
+
+type BucketLoggingStatus struct {
+	XMLName xml.Name `xml:"BucketLoggingStatus"`
+}
+
+type NotificationConfiguration struct {
+	XMLName xml.Name `xml:"NotificationConfiguration"`
+}
+
+type AccessControlPolicy struct {
+	XMLName           xml.Name `xml:"AccessControlPolicy"`
+	Owner             Owner
+	AccessControlList []Grant `xml:"AccessControlList>Grant"`
+}
+
+type Grant struct {
+	Grantee    Grantee
+	Permission string
+}
+
+type Grantee struct {
+	XMLNS       string `xml:"xmlns:xsi,attr"`
+	Type        string `xml:"xsi:type,attr"`
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
 }
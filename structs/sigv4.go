@@ -1,9 +1,12 @@
 package structs
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
 	"net/http"
 	"net/url"
 	"sort"
@@ -12,6 +15,17 @@ import (
 
 const emptyBody = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
 
+// Payload hashes announcing an aws-chunked body whose chunks, and trailer, are
+// signed in a chain starting from the signature of the request.
+const (
+	streamingPayload        = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+)
+
+// maxSignedBody limits the body read to compute the payload hash of KMS
+// requests, which are signed without X-Amz-Content-Sha256.
+const maxSignedBody = 1 << 20
+
 func (app *App) ValidSignatureV4(r *http.Request) (bool, *http.Request) {
 	//log.Printf("---%s---", r.Header.Get("Authorization"))
 
@@ -24,6 +38,14 @@ func (app *App) ValidSignatureV4(r *http.Request) (bool, *http.Request) {
 	if r.Header.Get("X-Amz-Content-Sha256") == emptyBody {
 		payload = []byte("")
 	}
+	if len(payload) == 0 && r.Body != nil && strings.HasPrefix(r.Header.Get("X-Amz-Target"), "TrentService.") {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil || len(body) > maxSignedBody {
+			return false, nil
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		payload = []byte(HexSHA256Hash(body))
+	}
 
 	query := r.URL.Query()
 	canonicalRequest := canonicalRequest(r.Method, r.URL, query.Encode(), payload, headers)
@@ -37,11 +59,52 @@ func (app *App) ValidSignatureV4(r *http.Request) (bool, *http.Request) {
 	}
 
 	signature := signingKeySignature(*app.SecretKey, stringToSign, headers)
-	if signature == "" {
+	if signature == "" || signature != headers["Signature"] {
 		return false, nil
 	}
 
-	return signature == headers["Signature"], r
+	if p := string(payload); p == streamingPayload || p == streamingPayloadTrailer {
+		scope, _ := strings.CutPrefix(headers["Credential"], *app.AccessKey+"/")
+		signer := &chunkSigner{
+			key:      signingKey(*app.SecretKey, headers),
+			date:     headers["x-amz-date"],
+			scope:    scope,
+			previous: signature,
+			trailer:  p == streamingPayloadTrailer,
+		}
+		r = r.WithContext(context.WithValue(r.Context(), chunkSignerKey{}, signer))
+	}
+	return true, r
+}
+
+// chunkSignerKey holds the chunkSigner of a request in its context.
+type chunkSignerKey struct{}
+
+// chunkSigner verifies the chunk signatures of a signed aws-chunked body, each
+// signing its chunk and the signature before it.
+type chunkSigner struct {
+	key      []byte
+	date     string
+	scope    string
+	previous string
+	trailer  bool
+}
+
+func (s *chunkSigner) verifyChunk(hash string, signature string) bool {
+	return s.verify("AWS4-HMAC-SHA256-PAYLOAD\n"+s.date+"\n"+s.scope+"\n"+s.previous+"\n"+emptyBody+"\n"+hash, signature)
+}
+
+func (s *chunkSigner) verifyTrailer(hash string, signature string) bool {
+	return s.verify("AWS4-HMAC-SHA256-TRAILER\n"+s.date+"\n"+s.scope+"\n"+s.previous+"\n"+hash, signature)
+}
+
+func (s *chunkSigner) verify(stringToSign string, signature string) bool {
+	expected := hex.EncodeToString(HmacSHA256(s.key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	s.previous = signature
+	return true
 }
 
 func authorizationHeader(header http.Header, host string, req string) map[string]string {
@@ -117,17 +180,23 @@ func stringToSign(canonicalRequest string, accessKey string, headers map[string]
 }
 
 func signingKeySignature(secret string, stringToSign string, headers map[string]string) string {
+	key := signingKey(secret, headers)
+	if key == nil {
+		return ""
+	}
+	return hex.EncodeToString(HmacSHA256(key, []byte(stringToSign)))
+}
+
+func signingKey(secret string, headers map[string]string) []byte {
 	signPayload := strings.Split(headers["Credential"], "/")
 	if len(signPayload) != 5 {
-		return ""
+		return nil
 	}
 
 	dateKey := HmacSHA256([]byte("AWS4"+secret), []byte(signPayload[1]))
 	dateRegionKey := HmacSHA256(dateKey, []byte(signPayload[2]))
 	dateRegionServiceKey := HmacSHA256(dateRegionKey, []byte(signPayload[3]))
-	signingKey := HmacSHA256(dateRegionServiceKey, []byte(signPayload[4]))
-
-	return hex.EncodeToString(HmacSHA256(signingKey, []byte(stringToSign)))
+	return HmacSHA256(dateRegionServiceKey, []byte(signPayload[4]))
 }
 
 func HexSHA256Hash(b []byte) string {